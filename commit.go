@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// Trailers sync adds to its commits
+const (
+	hostTrailer              = "Host"
+	systemTrailer            = "System"
+	templateOverwriteTrailer = "Template-Overwrite"
+)
+
+// legacyOverwriteMarker marks template overwrites in commits of older versions
+const legacyOverwriteMarker = "[TEMPLATE-OVERWRITES]"
+
+// maxSubjectLength is the length a generated commit subject is kept within
+const maxSubjectLength = 72
+
+// syncCommit is a commit sync is about to make
+type syncCommit struct {
+	Paths   []string
+	Message string
+}
+
+// stagedChanges lists the changes in the index of the dotfiles repository
+func (dm *DotfilesManager) stagedChanges() ([]syncChange, error) {
+	cmd := exec.Command("git", "diff", "--cached", "--name-status", "--no-renames", "-z")
+	cmd.Dir = dm.DotfilesDir
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list staged changes: %w", err)
+	}
+	globalExcludes, err := dm.globalExcludes()
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []syncChange
+	fields := strings.Split(strings.TrimSuffix(string(output), "\x00"), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		change := syncChange{Path: fields[i+1], Kind: changeModified, Staged: true}
+		switch fields[i] {
+		case "A":
+			change.Kind = changeNew
+		case "D":
+			change.Kind = changeDeleted
+		}
+		if change.Group = dm.syncGroup(change.Path, globalExcludes); change.Group == "" {
+			change.Group = topGroup(change.Path)
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// describeGroup summarizes the changes to a package for a commit subject,
+// naming a single file and counting several, e.g. "shell: .zshrc"
+func describeGroup(name string, changes []syncChange) string {
+	if len(changes) == 1 {
+		if name == repositoryGroup {
+			return changes[0].Path
+		}
+		return name + ": " + strings.TrimPrefix(changes[0].Path, name+"/")
+	}
+	return fmt.Sprintf("%s: %d files", name, len(changes))
+}
+
+// commitSubject summarizes which packages changed, e.g. "nvim: 3 files, shell: .zshrc",
+// falling back to just their names when that gets too long
+func commitSubject(names []string, groups map[string][]syncChange) string {
+	var parts []string
+	for _, name := range names {
+		parts = append(parts, describeGroup(name, groups[name]))
+	}
+	if subject := strings.Join(parts, ", "); len(subject) <= maxSubjectLength {
+		return subject
+	}
+	if subject := "Update " + strings.Join(names, ", "); len(subject) <= maxSubjectLength {
+		return subject
+	}
+	return fmt.Sprintf("Update %d packages", len(names))
+}
+
+// commitTrailers returns the trailers recording where a commit was made and
+// which of its files were regenerated from templates
+func (dm *DotfilesManager) commitTrailers(overwrites []string) string {
+	var trailers []string
+	if name := hostname(); name != "" {
+		trailers = append(trailers, hostTrailer+": "+name)
+	}
+	trailers = append(trailers, systemTrailer+": "+dm.System)
+	for _, file := range overwrites {
+		trailers = append(trailers, templateOverwriteTrailer+": "+file)
+	}
+	return strings.Join(trailers, "\n")
+}
+
+// planCommits returns the commits for the changes: one for all of them, or
+// one per package with commit_per_package set. A message given on the command
+// line replaces the generated summary.
+func (dm *DotfilesManager) planCommits(changes []syncChange, message string) []syncCommit {
+	names, groups := groupChanges(changes)
+	overwrites := make(map[string][]string)
+	for _, file := range templateOverwrites {
+		group := topGroup(path.Clean(strings.ReplaceAll(file, "\\", "/")))
+		if _, ok := groups[group]; !ok {
+			group = ""
+		}
+		overwrites[group] = append(overwrites[group], file)
+	}
+
+	if dm.Config.GitHub == nil || !dm.Config.GitHub.CommitPerPackage || len(names) < 2 {
+		var commit syncCommit
+		var overwritten []string
+		for _, name := range names {
+			for _, change := range groups[name] {
+				commit.Paths = append(commit.Paths, change.Path)
+			}
+			overwritten = append(overwritten, overwrites[name]...)
+		}
+		overwritten = append(overwritten, overwrites[""]...)
+
+		subject := message
+		if subject == "" {
+			subject = commitSubject(names, groups) + "\n\n" + strings.TrimRight(formatChanges(changes, ""), "\n")
+		}
+		commit.Message = subject + "\n\n" + dm.commitTrailers(overwritten)
+		return []syncCommit{commit}
+	}
+
+	var commits []syncCommit
+	for i, name := range names {
+		var commit syncCommit
+		for _, change := range groups[name] {
+			commit.Paths = append(commit.Paths, change.Path)
+		}
+		// Overwrites outside of any package go with the first commit
+		overwritten := overwrites[name]
+		if i == 0 {
+			overwritten = append(overwritten, overwrites[""]...)
+		}
+
+		subject := describeGroup(name, groups[name])
+		if message != "" {
+			subject = name + ": " + message
+		}
+		if len(groups[name]) > 1 {
+			subject += "\n\n" + strings.TrimRight(formatChanges(groups[name], ""), "\n")
+		}
+		commit.Message = subject + "\n\n" + dm.commitTrailers(overwritten)
+		commits = append(commits, commit)
+	}
+	return commits
+}
+
+// commitChanges commits the staged changes as planned by planCommits. Each of
+// several commits is made from the part of the index holding its own files.
+func (dm *DotfilesManager) commitChanges(message string) error {
+	changes, err := dm.stagedChanges()
+	if err != nil {
+		return err
+	}
+	commits := dm.planCommits(changes, message)
+
+	if len(commits) == 1 {
+		if err := dm.runGitCommand("commit", "--quiet", "-m", commits[0].Message); err != nil {
+			return fmt.Errorf("failed to commit changes: %w", err)
+		}
+		templateOverwrites = nil
+		fmt.Printf("✓ Committed %s\n", firstLine(commits[0].Message))
+		return nil
+	}
+
+	cmd := exec.Command("git", "write-tree")
+	cmd.Dir = dm.DotfilesDir
+	output, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("failed to save the staged changes: %w", err)
+	}
+	staged := strings.TrimSpace(string(output))
+
+	for _, commit := range commits {
+		if err := dm.commitPaths(staged, commit); err != nil {
+			// Put every change not committed yet back into the index
+			if restoreErr := dm.runGitCommand("read-tree", staged); restoreErr != nil {
+				fmt.Printf("Warning: failed to restore the staged changes: %v\n", restoreErr)
+			}
+			return err
+		}
+		fmt.Printf("✓ Committed %s\n", firstLine(commit.Message))
+	}
+	templateOverwrites = nil
+	return nil
+}
+
+// commitPaths commits the paths of a commit as they are in the staged tree
+func (dm *DotfilesManager) commitPaths(staged string, commit syncCommit) error {
+	base := []string{"read-tree", "--empty"}
+	if dm.runGitCommand("rev-parse", "--verify", "--quiet", "HEAD") == nil {
+		base = []string{"read-tree", "HEAD"}
+	}
+	if err := dm.runGitCommand(base...); err != nil {
+		return fmt.Errorf("failed to reset the index: %w", err)
+	}
+	if err := dm.runGitPathspecs(commit.Paths, "restore", "--staged", "--source="+staged); err != nil {
+		return fmt.Errorf("failed to stage %s: %w", firstLine(commit.Message), err)
+	}
+	if err := dm.runGitCommand("commit", "--quiet", "-m", commit.Message); err != nil {
+		return fmt.Errorf("failed to commit %s: %w", firstLine(commit.Message), err)
+	}
+	return nil
+}
+
+// firstLine returns the first line of s
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
+
+// templateHistoryEntry is a commit that regenerated files from templates
+type templateHistoryEntry struct {
+	Hash    string
+	Date    string
+	Subject string
+	Files   []string
+}
+
+// templateHistory returns the commits with template overwrites, oldest first.
+// Overwrites are read from the Template-Overwrite trailers, or from the
+// [TEMPLATE-OVERWRITES] section of commits made by older versions.
+func (dm *DotfilesManager) templateHistory() ([]templateHistoryEntry, error) {
+	format := "--format=%h%x1f%ad%x1f%s%x1f%(trailers:key=" + templateOverwriteTrailer + ",valueonly,separator=%x1e)%x1f%b"
+	cmd := exec.Command("git", "log", "-z", "--reverse", "--date=short", format,
+		"--grep=^"+templateOverwriteTrailer+": ", "--grep="+strings.ReplaceAll(legacyOverwriteMarker, "[", "\\["))
+	cmd.Dir = dm.DotfilesDir
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to search git history: %w", err)
+	}
+
+	var entries []templateHistoryEntry
+	for _, record := range strings.Split(string(output), "\x00") {
+		fields := strings.SplitN(record, "\x1f", 5)
+		if len(fields) < 5 {
+			continue
+		}
+		entry := templateHistoryEntry{Hash: fields[0], Date: fields[1], Subject: fields[2]}
+		for _, file := range strings.Split(strings.TrimSpace(fields[3]), "\x1e") {
+			if file = strings.TrimSpace(file); file != "" {
+				entry.Files = append(entry.Files, file)
+			}
+		}
+		if len(entry.Files) == 0 {
+			entry.Files = legacyOverwrites(fields[4])
+		}
+		if len(entry.Files) > 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// legacyOverwrites returns the files listed under the [TEMPLATE-OVERWRITES]
+// marker of a commit message
+func legacyOverwrites(body string) []string {
+	_, section, found := strings.Cut(body, legacyOverwriteMarker)
+	if !found {
+		return nil
+	}
+	var files []string
+	for _, line := range strings.Split(section, "\n") {
+		if file, ok := strings.CutPrefix(strings.TrimSpace(line), "- "); ok {
+			files = append(files, file)
+		}
+	}
+	return files
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"runtime"
+	"strings"
+)
+
+// condExpr is a parsed template condition such as "macos or (arch and not work)"
+type condExpr struct {
+	Op   string // "atom", "not", "and" or "or"
+	Atom string
+	Args []*condExpr
+}
+
+// parseCondition parses a condition. Atoms are joined with "and", "or" and
+// "not", which bind in the usual order, and can be grouped with parentheses.
+func parseCondition(condition string) (*condExpr, error) {
+	p := &conditionParser{tokens: tokenizeCondition(condition)}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected '%s'", p.tokens[p.pos])
+	}
+	return expr, nil
+}
+
+// tokenizeCondition splits a condition into words and parentheses
+func tokenizeCondition(condition string) []string {
+	condition = strings.NewReplacer("(", " ( ", ")", " ) ").Replace(condition)
+	return strings.Fields(condition)
+}
+
+type conditionParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *conditionParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *conditionParser) parseOr() (*condExpr, error) {
+	return p.parseChain("or", p.parseAnd)
+}
+
+func (p *conditionParser) parseAnd() (*condExpr, error) {
+	return p.parseChain("and", p.parseNot)
+}
+
+// parseChain parses operands joined by op
+func (p *conditionParser) parseChain(op string, operand func() (*condExpr, error)) (*condExpr, error) {
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	args := []*condExpr{first}
+	for p.peek() == op {
+		p.pos++
+		next, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, next)
+	}
+	if len(args) == 1 {
+		return first, nil
+	}
+	return &condExpr{Op: op, Args: args}, nil
+}
+
+func (p *conditionParser) parseNot() (*condExpr, error) {
+	switch token := p.peek(); token {
+	case "":
+		return nil, fmt.Errorf("condition ends unexpectedly")
+	case "not":
+		p.pos++
+		arg, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &condExpr{Op: "not", Args: []*condExpr{arg}}, nil
+	case "(":
+		p.pos++
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing ')'")
+		}
+		p.pos++
+		return expr, nil
+	case ")", "and", "or":
+		return nil, fmt.Errorf("unexpected '%s'", token)
+	default:
+		if err := validateAtom(token); err != nil {
+			return nil, err
+		}
+		p.pos++
+		return &condExpr{Op: "atom", Atom: token}, nil
+	}
+}
+
+// eval evaluates the condition, deciding each atom with match
+func (e *condExpr) eval(match func(string) bool) bool {
+	switch e.Op {
+	case "atom":
+		return match(e.Atom)
+	case "not":
+		return !e.Args[0].eval(match)
+	case "and":
+		for _, arg := range e.Args {
+			if !arg.eval(match) {
+				return false
+			}
+		}
+		return true
+	default:
+		for _, arg := range e.Args {
+			if arg.eval(match) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (dm *DotfilesManager) matchesCondition(condition string) bool {
+	return dm.matchesConditionOn(dm.System, condition)
+}
+
+// matchesConditionOn decides a single condition atom for this machine as if
+// it ran system. Besides system names, atoms can test the hostname, user and
+// CPU architecture, as in host:work-*, user:alice or arch:arm64.
+func (dm *DotfilesManager) matchesConditionOn(system, condition string) bool {
+	if kind, value, ok := strings.Cut(condition, ":"); ok {
+		switch kind {
+		case "host":
+			return hostMatches(value, hostname())
+		case "user":
+			matched, _ := path.Match(value, currentUser())
+			return matched
+		case "arch":
+			return normalizeArch(value) == runtime.GOARCH
+		default:
+			return false
+		}
+	}
+
+	switch condition {
+	case "all":
+		return true
+	case "macos":
+		return system == "macos"
+	case "linux":
+		return system == "arch" || system == "ubuntu" || system == "debian" || system == "fedora" || system == "linux"
+	case "arch":
+		return system == "arch"
+	case "ubuntu":
+		return system == "ubuntu"
+	case "debian":
+		return system == "debian"
+	case "fedora":
+		return system == "fedora"
+	default:
+		return system == condition
+	}
+}
+
+// conditionKinds are the prefixes a condition atom can have
+var conditionKinds = []string{"host", "user", "arch"}
+
+// validateAtom checks that a prefixed atom is one dotctl knows
+func validateAtom(atom string) error {
+	kind, value, ok := strings.Cut(atom, ":")
+	if !ok {
+		return nil
+	}
+	known := false
+	for _, k := range conditionKinds {
+		known = known || k == kind
+	}
+	if !known {
+		return fmt.Errorf("unknown condition '%s', expected one of %s:<value>", atom, strings.Join(conditionKinds, ":, "))
+	}
+	if value == "" {
+		return fmt.Errorf("condition '%s' needs a value", atom)
+	}
+	if _, err := path.Match(value, ""); err != nil {
+		return fmt.Errorf("invalid pattern in '%s': %w", atom, err)
+	}
+	return nil
+}
+
+// normalizeArch maps the names uname uses for CPU architectures to Go's
+func normalizeArch(arch string) string {
+	switch arch {
+	case "x86_64", "x64":
+		return "amd64"
+	case "aarch64", "armv8":
+		return "arm64"
+	case "i386", "i686", "x86":
+		return "386"
+	case "armv7l", "armv6l":
+		return "arm"
+	default:
+		return arch
+	}
+}
+
+// matchesPackageAtom decides a condition atom of a package. Unlike in
+// templates, system names match the system exactly, so linux does not select
+// a package on arch or ubuntu.
+func (dm *DotfilesManager) matchesPackageAtom(system, atom string) bool {
+	if strings.Contains(atom, ":") {
+		return dm.matchesConditionOn(system, atom)
+	}
+	return atom == "all" || atom == system
+}
+
+// matchesAnyCondition reports whether any of a package's conditions holds on
+// this machine when it runs system. Invalid conditions never match.
+func (dm *DotfilesManager) matchesAnyCondition(conditions []string, system string) bool {
+	match := func(atom string) bool { return dm.matchesPackageAtom(system, atom) }
+	for _, condition := range conditions {
+		expr, err := parseCondition(condition)
+		if err == nil && expr.eval(match) {
+			return true
+		}
+	}
+	return false
+}
+
+// validatePackageConditions checks the systems and when settings of a package
+func (dm *DotfilesManager) validatePackageConditions(packageName string) error {
+	config, ok := dm.Config.Packages[packageName].(map[string]interface{})
+	if !ok {
+		if condition, ok := dm.Config.Packages[packageName].(string); ok {
+			if _, err := parseCondition(condition); err != nil {
+				return fmt.Errorf("invalid condition '%s': %w", condition, err)
+			}
+		}
+		return nil
+	}
+
+	for _, key := range []string{"systems", "when"} {
+		value, exists := config[key]
+		if !exists {
+			continue
+		}
+		conditions, ok := conditionList(value)
+		if !ok {
+			return fmt.Errorf("%s must be a condition or a list of conditions", key)
+		}
+		for _, condition := range conditions {
+			if _, err := parseCondition(condition); err != nil {
+				return fmt.Errorf("invalid condition '%s' in %s: %w", condition, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// conditionList reads a systems or when setting, which is a single condition or a list
+func conditionList(value interface{}) ([]string, bool) {
+	switch value := value.(type) {
+	case string:
+		return []string{value}, true
+	case []interface{}:
+		var conditions []string
+		for _, item := range value {
+			if condition, ok := item.(string); ok {
+				conditions = append(conditions, condition)
+			}
+		}
+		return conditions, true
+	default:
+		return nil, false
+	}
+}
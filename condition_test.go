@@ -0,0 +1,126 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestShouldDeployPackage(t *testing.T) {
+	dm := &DotfilesManager{}
+	tests := []struct {
+		name   string
+		config interface{}
+		system string
+		want   bool
+	}{
+		{"all", "all", "arch", true},
+		{"exact system", "arch", "arch", true},
+		{"other system", "macos", "arch", false},
+		{"family name is not a family", "linux", "ubuntu", false},
+		{"plain linux", "linux", "linux", true},
+		{"systems list", map[string]interface{}{"systems": []interface{}{"macos", "fedora"}}, "fedora", true},
+		{"systems list without the system", map[string]interface{}{"systems": []interface{}{"linux"}}, "debian", false},
+		{"no systems", map[string]interface{}{"home": true}, "debian", true},
+		{"expression", "arch or debian", "debian", true},
+		{"negation", "not macos", "arch", true},
+		{"CPU architecture", "arch:" + runtime.GOARCH, "macos", true},
+		{"other CPU architecture", "arch:s390x-none", "macos", false},
+		{"when must hold too", map[string]interface{}{"systems": []interface{}{"all"}, "when": "arch:s390x-none"}, "arch", false},
+		{"invalid condition", "hots:laptop", "arch", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := dm.shouldDeployPackage(test.config, test.system); got != test.want {
+				t.Errorf("shouldDeployPackage(%v, %s) = %v, want %v", test.config, test.system, got, test.want)
+			}
+		})
+	}
+}
+
+// formatCondition writes a parsed condition in prefix form, e.g. (or a (and b c))
+func formatCondition(e *condExpr) string {
+	if e.Op == "atom" {
+		return e.Atom
+	}
+	parts := []string{e.Op}
+	for _, arg := range e.Args {
+		parts = append(parts, formatCondition(arg))
+	}
+	return "(" + strings.Join(parts, " ") + ")"
+}
+
+func TestParseCondition(t *testing.T) {
+	tests := []struct {
+		condition string
+		want      string
+		err       string
+	}{
+		{condition: "macos", want: "macos"},
+		{condition: "  linux  ", want: "linux"},
+		{condition: "arch or fedora", want: "(or arch fedora)"},
+		{condition: "arch or fedora or debian", want: "(or arch fedora debian)"},
+		{condition: "macos or linux and not ubuntu", want: "(or macos (and linux (not ubuntu)))"},
+		{condition: "not macos and linux", want: "(and (not macos) linux)"},
+		{condition: "not not macos", want: "(not (not macos))"},
+		{condition: "(macos or linux) and not ubuntu", want: "(and (or macos linux) (not ubuntu))"},
+		{condition: "not (macos or linux)", want: "(not (or macos linux))"},
+		{condition: "((macos))", want: "macos"},
+		{condition: "macos and(linux or arch)", want: "(and macos (or linux arch))"},
+		{condition: "host:work-* and not user:root", want: "(and host:work-* (not user:root))"},
+		{condition: "", err: "condition ends unexpectedly"},
+		{condition: "macos and", err: "condition ends unexpectedly"},
+		{condition: "not", err: "condition ends unexpectedly"},
+		{condition: "or macos", err: "unexpected 'or'"},
+		{condition: "macos linux", err: "unexpected 'linux'"},
+		{condition: "(macos or linux", err: "missing ')'"},
+		{condition: "macos)", err: "unexpected ')'"},
+		{condition: "()", err: "unexpected ')'"},
+		{condition: "hots:laptop", err: "unknown condition 'hots:laptop', expected one of host:, user:, arch:<value>"},
+		{condition: "host:", err: "condition 'host:' needs a value"},
+		{condition: "host:[", err: "invalid pattern in 'host:['"},
+	}
+	for _, test := range tests {
+		expr, err := parseCondition(test.condition)
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("parseCondition(%q) error = %v, want %q", test.condition, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCondition(%q) failed: %v", test.condition, err)
+			continue
+		}
+		if got := formatCondition(expr); got != test.want {
+			t.Errorf("parseCondition(%q) = %s, want %s", test.condition, got, test.want)
+		}
+	}
+}
+
+func TestConditionEval(t *testing.T) {
+	holds := map[string]bool{"linux": true, "arch": true}
+	match := func(atom string) bool { return holds[atom] }
+	tests := []struct {
+		condition string
+		want      bool
+	}{
+		{"linux", true},
+		{"macos", false},
+		{"not macos", true},
+		{"macos or arch", true},
+		{"linux and not arch", false},
+		{"macos or linux and not arch", false},
+		{"(macos or linux) and arch", true},
+		{"not (macos or ubuntu) and linux", true},
+	}
+	for _, test := range tests {
+		expr, err := parseCondition(test.condition)
+		if err != nil {
+			t.Fatalf("parseCondition(%q) failed: %v", test.condition, err)
+		}
+		if got := expr.eval(match); got != test.want {
+			t.Errorf("%q = %v, want %v", test.condition, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Conflict policies applied when a deploy target already exists and was not created by dotctl
+const (
+	conflictBackup    = "backup"    // Move the existing file into the backup tree and restore it on undeploy
+	conflictSkip      = "skip"      // Leave the existing file alone and do not deploy this target
+	conflictFail      = "fail"      // Abort deployment of the package
+	conflictOverwrite = "overwrite" // Delete the existing file
+)
+
+const defaultConflictPolicy = conflictBackup
+
+// BackupEntry records a file or directory that was moved aside to make room for a deployment
+type BackupEntry struct {
+	Package    string    `yaml:"package"`
+	Original   string    `yaml:"original"`
+	Backup     string    `yaml:"backup"`
+	BackedUpAt time.Time `yaml:"backed_up_at"`
+}
+
+func isValidConflictPolicy(policy string) bool {
+	switch policy {
+	case conflictBackup, conflictSkip, conflictFail, conflictOverwrite:
+		return true
+	}
+	return false
+}
+
+// conflictPolicy returns the policy for a package, falling back to the global setting
+func (dm *DotfilesManager) conflictPolicy(packageName string) (string, error) {
+	policy := dm.Config.ConflictPolicy
+	if packageConfig := dm.getPackageConfig(packageName); packageConfig != nil && packageConfig.Conflict != "" {
+		policy = packageConfig.Conflict
+	}
+	if policy == "" {
+		return defaultConflictPolicy, nil
+	}
+	if !isValidConflictPolicy(policy) {
+		return "", fmt.Errorf("invalid conflict policy '%s' for %s (use backup, skip, fail or overwrite)", policy, packageName)
+	}
+	return policy, nil
+}
+
+// isManagedTarget reports whether target is something dotctl itself put there
+func (dm *DotfilesManager) isManagedTarget(target, source string) bool {
+	if isLinkTo(target, source) {
+		return true
+	}
+	entry := dm.State.find(target)
+	if entry == nil {
+		return false
+	}
+	switch entry.Type {
+	case stateEntryLink:
+		return isLinkTo(target, entry.Source)
+	case stateEntryTemplate, stateEntryCopy, stateEntryDecrypted:
+		return hashFile(target) == entry.Hash
+	}
+	return false
+}
+
+// backupRoot returns the directory holding backups, next to the state file
+func (dm *DotfilesManager) backupRoot() string {
+	return filepath.Join(filepath.Dir(dm.StateFile), "backups")
+}
+
+// backupPathFor returns the location target is moved to in this run's backup tree
+func (dm *DotfilesManager) backupPathFor(target string) string {
+	if dm.backupRunID == "" {
+		dm.backupRunID = time.Now().Format("20060102-150405")
+	}
+	relPath := strings.TrimPrefix(filepath.Clean(target), string(filepath.Separator))
+	return filepath.Join(dm.backupRoot(), dm.backupRunID, relPath)
+}
+
+func (dm *DotfilesManager) backupTarget(packageName, target, backupPath string) error {
+	if err := os.MkdirAll(filepath.Dir(backupPath), 0755); err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	if err := dm.renamePath(target, backupPath); err != nil {
+		return fmt.Errorf("failed to back up %s: %w", target, err)
+	}
+
+	dm.State.recordBackup(BackupEntry{
+		Package:  packageName,
+		Original: target,
+		Backup:   backupPath,
+	})
+	fmt.Printf("BACKUP: %s -> %s\n", target, backupPath)
+	return nil
+}
+
+// restoreBackup moves a backed up original back into place once its target is free
+func (dm *DotfilesManager) restoreBackup(target, backupPath string) error {
+	if _, err := os.Lstat(target); err == nil {
+		fmt.Printf("SKIP: Not restoring backup of %s, path is in use (backup kept at %s)\n", target, backupPath)
+		return nil
+	}
+	if _, err := os.Lstat(backupPath); os.IsNotExist(err) {
+		fmt.Printf("Warning: Backup of %s is missing at %s\n", target, backupPath)
+		dm.State.removeBackup(target)
+		return nil
+	}
+
+	if err := dm.renamePath(backupPath, target); err != nil {
+		return fmt.Errorf("failed to restore %s from backup: %w", target, err)
+	}
+	dm.State.removeBackup(target)
+	fmt.Printf("RESTORE: %s\n", target)
+	return nil
+}
+
+// recordBackup adds a backup entry to the state
+func (s *DeploymentState) recordBackup(entry BackupEntry) {
+	if entry.BackedUpAt.IsZero() {
+		entry.BackedUpAt = time.Now()
+	}
+	s.Backups = append(s.Backups, entry)
+}
+
+// findBackup returns the most recent backup of original, or nil if there is none
+func (s *DeploymentState) findBackup(original string) *BackupEntry {
+	for i := len(s.Backups) - 1; i >= 0; i-- {
+		if s.Backups[i].Original == original {
+			return &s.Backups[i]
+		}
+	}
+	return nil
+}
+
+// removeBackup drops the most recent backup of original
+func (s *DeploymentState) removeBackup(original string) {
+	for i := len(s.Backups) - 1; i >= 0; i-- {
+		if s.Backups[i].Original == original {
+			s.Backups = append(s.Backups[:i], s.Backups[i+1:]...)
+			return
+		}
+	}
+}
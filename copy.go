@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Drift states of a deployed copy compared to its package file
+const (
+	copyInSync        = ""
+	copySourceChanged = "package file changed"
+	copyTargetChanged = "deployed copy modified"
+	copyBothChanged   = "changed in both the package and the deployed copy"
+	copyMissing       = "deployed copy missing"
+)
+
+// copyDrift compares a deployed copy against the hash recorded when it was
+// copied and the current hash of its source
+func copyDrift(recordedHash, sourceHash, targetPath string) string {
+	if _, err := os.Lstat(targetPath); os.IsNotExist(err) {
+		return copyMissing
+	}
+	targetHash := hashFile(targetPath)
+
+	switch {
+	case targetHash == sourceHash:
+		return copyInSync
+	case targetHash == recordedHash:
+		return copySourceChanged
+	case sourceHash == recordedHash:
+		return copyTargetChanged
+	default:
+		return copyBothChanged
+	}
+}
+
+// planCopy plans copying source to target. sourceHash is the content the source
+// will have once earlier operations such as template rendering have run.
+func (dm *DotfilesManager) planCopy(plan *DeploymentPlan, packageName, source, sourceHash, target string, fresh, interactive bool) error {
+	copyOp := Operation{Type: opCopy, Package: packageName, Source: source, Target: target}
+	if fresh {
+		plan.add(copyOp)
+		return nil
+	}
+
+	entry := dm.State.find(target)
+	if entry == nil || entry.Type != stateEntryCopy || entry.Source != source {
+		// An identical regular file is simply taken over; links are always replaced
+		if info, err := os.Lstat(target); err == nil && (info.Mode()&os.ModeSymlink != 0 || hashFile(target) != sourceHash) {
+			proceed, err := dm.planTarget(plan, packageName, source, target)
+			if err != nil || !proceed {
+				return err
+			}
+		}
+		plan.add(copyOp)
+		return nil
+	}
+
+	drift := copyDrift(entry.Hash, sourceHash, target)
+	switch drift {
+	case copyInSync, copySourceChanged, copyMissing:
+		plan.add(copyOp)
+		return nil
+	}
+
+	// Changes made to the deployed copy would be lost by copying over it
+	if !interactive {
+		plan.add(Operation{Type: opSkip, Package: packageName, Target: target, Reason: drift + ", run 'dotctl --interactive deploy' to resolve"})
+		return nil
+	}
+
+	choice, err := dm.promptForCopyDrift(source, target, drift, dm.packageForPath(source) != "" && !isTemplateOutput(source))
+	if err != nil {
+		return fmt.Errorf("failed to prompt for %s: %w", target, err)
+	}
+	switch choice {
+	case "o":
+		plan.add(copyOp)
+	case "b":
+		plan.add(Operation{Type: opCopyBack, Package: packageName, Source: source, Target: target})
+	default:
+		plan.add(Operation{Type: opSkip, Package: packageName, Target: target, Reason: drift + ", kept as is"})
+	}
+	return nil
+}
+
+// isTemplateOutput reports whether path is generated from a template next to it
+func isTemplateOutput(path string) bool {
+	_, err := os.Stat(path + ".template")
+	return err == nil
+}
+
+// promptForCopyDrift asks how to reconcile a deployed copy that was modified.
+// It returns "o" to overwrite the copy, "b" to copy it back into the package or
+// "k" to keep both as they are.
+func (dm *DotfilesManager) promptForCopyDrift(source, target, drift string, canCopyBack bool) (string, error) {
+	sourceContent, err := os.ReadFile(source)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	targetContent, err := os.ReadFile(target)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprintf(dm.out, "\n⚠️  Deployed copy out of sync (%s): %s\n", drift, target)
+	fmt.Fprintf(dm.out, "Package file: %s\n\n", source)
+
+	showContentDiff(dm.out, "Package file", "Deployed copy", string(sourceContent), string(targetContent))
+
+	options := "o/k/d"
+	fmt.Fprintf(dm.out, "\nOptions:\n")
+	fmt.Fprintf(dm.out, "  o - Overwrite deployed copy with the package file\n")
+	if canCopyBack {
+		fmt.Fprintf(dm.out, "  b - Copy the deployed changes back into the package\n")
+		options = "o/b/k/d"
+	}
+	fmt.Fprintf(dm.out, "  k - Keep both as they are (recommended)\n")
+	fmt.Fprintf(dm.out, "  d - Show full diff\n")
+
+	for {
+		fmt.Fprintf(dm.out, "Choice [%s]: ", options)
+
+		var response string
+		fmt.Scanln(&response)
+		response = strings.ToLower(strings.TrimSpace(response))
+
+		switch response {
+		case "d":
+			showFullContentDiff(dm.out, "Package file", "Deployed copy", string(sourceContent), string(targetContent))
+		case "o":
+			return response, nil
+		case "b":
+			if canCopyBack {
+				return response, nil
+			}
+			fmt.Fprintln(dm.out, "The package file is generated from a template, edit the template instead")
+		case "k", "":
+			return "k", nil
+		default:
+			fmt.Fprintf(dm.out, "Invalid choice '%s'\n", response)
+		}
+	}
+}
+
+// applyCopy copies a package file into place and records its hash
+func (dm *DotfilesManager) applyCopy(op Operation) error {
+	data, err := os.ReadFile(op.Source)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", op.Source, err)
+	}
+	info, err := os.Stat(op.Source)
+	if err != nil {
+		return fmt.Errorf("failed to inspect %s: %w", op.Source, err)
+	}
+
+	if existing, err := os.ReadFile(op.Target); err != nil || string(existing) != string(data) {
+		if err := dm.writeFile(op.Target, data, info.Mode().Perm()); err != nil {
+			return fmt.Errorf("failed to copy %s to %s: %w", op.Source, op.Target, err)
+		}
+		fmt.Printf("COPY: %s -> %s\n", op.Source, op.Target)
+	}
+
+	dm.recordCopy(op.owner(), op.Source, op.Target, data)
+	return nil
+}
+
+// applyCopyBack copies a modified deployed copy back over its package file
+func (dm *DotfilesManager) applyCopyBack(op Operation) error {
+	data, err := os.ReadFile(op.Target)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", op.Target, err)
+	}
+	perm := os.FileMode(0644)
+	if info, err := os.Stat(op.Source); err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	if err := dm.writeFile(op.Source, data, perm); err != nil {
+		return fmt.Errorf("failed to copy %s back to %s: %w", op.Target, op.Source, err)
+	}
+	fmt.Printf("COPY BACK: %s -> %s\n", op.Target, op.Source)
+
+	dm.recordCopy(op.owner(), op.Source, op.Target, data)
+	return nil
+}
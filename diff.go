@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/yourusername/dotctl/internal/diff"
+)
+
+// diffContext is the number of unchanged lines shown around each change
+const diffContext = 3
+
+// showDeployDiff prints, file by file, how deploying packages would change the
+// content at their targets. It reports whether anything would change.
+func (dm *DotfilesManager) showDeployDiff(packages []string) (bool, error) {
+	if len(packages) == 0 {
+		packages = dm.getPackagesForSystem("")
+	}
+
+	changedFiles, keptFiles := 0, 0
+	for _, pkg := range packages {
+		if info, err := os.Stat(filepath.Join(dm.DotfilesDir, pkg)); err != nil || !info.IsDir() {
+			fmt.Printf("✗ %s: package directory not found\n", pkg)
+			continue
+		}
+
+		files, err := dm.inspectPackage(pkg)
+		if err != nil {
+			fmt.Printf("✗ %s: %v\n", pkg, err)
+			continue
+		}
+
+		header := false
+		for _, file := range files {
+			if file.State == fileDeployed {
+				continue
+			}
+			if !header {
+				fmt.Printf("=== %s ===\n", pkg)
+				header = true
+			}
+			// Deploying leaves a decrypted file that was modified alone
+			if file.State == fileDecrypted {
+				fmt.Printf("%s (%s: %s)\n\n", file.Target, file.State, file.Detail)
+				keptFiles++
+				continue
+			}
+			changedFiles++
+
+			if err := dm.showFileDiff(file); err != nil {
+				fmt.Printf("✗ %s: %v\n", file.Target, err)
+			}
+		}
+	}
+
+	if changedFiles == 0 && keptFiles > 0 {
+		fmt.Println("✓ Deploying would change nothing, modified decrypted files are left alone")
+		return false, nil
+	}
+	if changedFiles == 0 {
+		fmt.Println("✓ No differences, deployed files are up to date")
+		return false, nil
+	}
+	fmt.Printf("%d file(s) would change\n", changedFiles)
+	return true, nil
+}
+
+// showFileDiff prints the unified diff between what is at a target now and
+// what deploying would put there
+func (dm *DotfilesManager) showFileDiff(file fileStatus) error {
+	newLabel := file.Source
+	var newContent []byte
+	if file.Template != "" {
+		rendered, err := dm.renderTemplateFile(file.Template)
+		if err != nil {
+			return err
+		}
+		newContent = []byte(rendered)
+		newLabel = file.Template + " (rendered)"
+	} else if file.Encrypted {
+		key, err := dm.requireEncryptionKey()
+		if err != nil {
+			return err
+		}
+		content, err := ageDecrypt(file.Source, key)
+		if err != nil {
+			return err
+		}
+		newContent = content
+		newLabel = file.Source + " (decrypted)"
+	} else {
+		content, err := os.ReadFile(file.Source)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file.Source, err)
+		}
+		newContent = content
+	}
+
+	// Links are followed, a dangling link counts as nothing being there
+	oldLabel := file.Target
+	oldContent, err := os.ReadFile(file.Target)
+	if os.IsNotExist(err) {
+		oldLabel = "/dev/null"
+	} else if err != nil {
+		return fmt.Errorf("failed to read %s: %w", file.Target, err)
+	}
+
+	state := file.State
+	if file.Detail != "" {
+		state += ": " + file.Detail
+	}
+	fmt.Printf("%s (%s)\n", file.Target, state)
+
+	switch {
+	case bytes.Equal(oldContent, newContent):
+		fmt.Println("Content is unchanged")
+	case bytes.IndexByte(oldContent, 0) >= 0 || bytes.IndexByte(newContent, 0) >= 0:
+		fmt.Println("Binary files differ")
+	default:
+		fmt.Print(diff.Unified(oldLabel, newLabel, string(oldContent), string(newContent), diffContext))
+	}
+	fmt.Println()
+	return nil
+}
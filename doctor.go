@@ -0,0 +1,623 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Severities of doctor findings
+const (
+	severityInfo = iota
+	severityWarning
+	severityError
+)
+
+var severityLabels = map[int]string{
+	severityInfo:    "ℹ info",
+	severityWarning: "⚠ warning",
+	severityError:   "✗ error",
+}
+
+// doctorFinding is a single problem found by 'dotctl doctor'
+type doctorFinding struct {
+	Severity int
+	Check    string
+	Message  string
+	Fix      string      // Suggested command to resolve the problem
+	Repair   []Operation // Operations applied by --fix; empty when it cannot be repaired safely
+}
+
+// doctor runs every health check and prints the findings. With fix set, the
+// findings that can be repaired safely are turned into a plan and applied.
+// It returns an error when problems at error severity remain.
+func (dm *DotfilesManager) doctor(fix, dryRun bool) error {
+	fmt.Printf("Dotfiles directory: %s\n", dm.DotfilesDir)
+	fmt.Printf("Config file: %s\n", dm.ConfigFile)
+	fmt.Printf("Current system: %s\n", dm.System)
+	if dm.TargetHome != "" {
+		fmt.Printf("Target home: %s\n", dm.TargetHome)
+	}
+	fmt.Println()
+
+	var findings []doctorFinding
+	findings = append(findings, dm.checkConfig()...)
+	findings = append(findings, dm.checkLinks()...)
+	findings = append(findings, dm.checkTemplates()...)
+	findings = append(findings, dm.checkGit()...)
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].Severity > findings[j].Severity
+	})
+
+	if len(findings) == 0 {
+		fmt.Println("✓ No problems found")
+		return nil
+	}
+
+	counts := make(map[int]int)
+	var repairable []doctorFinding
+	for _, finding := range findings {
+		counts[finding.Severity]++
+		fmt.Printf("%-10s %s: %s\n", severityLabels[finding.Severity], finding.Check, finding.Message)
+		if len(finding.Repair) > 0 {
+			repairable = append(repairable, finding)
+			fmt.Printf("%-10s fix: dotctl doctor --fix\n", "")
+		} else if finding.Fix != "" {
+			fmt.Printf("%-10s fix: %s\n", "", finding.Fix)
+		}
+	}
+
+	fmt.Printf("\n%d error(s), %d warning(s), %d info\n", counts[severityError], counts[severityWarning], counts[severityInfo])
+
+	if !fix {
+		if len(repairable) > 0 {
+			fmt.Printf("%d problem(s) can be repaired automatically, run 'dotctl doctor --fix'\n", len(repairable))
+		}
+		if counts[severityError] > 0 {
+			return fmt.Errorf("found %d error(s)", counts[severityError])
+		}
+		return nil
+	}
+
+	if len(repairable) == 0 {
+		fmt.Println("Nothing can be repaired automatically")
+	} else {
+		fmt.Println()
+		if err := dm.runPlan(dm.planRepairs(repairable), dryRun, false, 0); err != nil {
+			return err
+		}
+	}
+
+	remaining := 0
+	for _, finding := range findings {
+		if finding.Severity == severityError && (dryRun || len(finding.Repair) == 0) {
+			remaining++
+		}
+	}
+	if remaining > 0 {
+		return fmt.Errorf("%d error(s) remain", remaining)
+	}
+	return nil
+}
+
+// planRepairs collects the repair operations of findings into a single plan,
+// grouped by package so each package is repaired as one unit
+func (dm *DotfilesManager) planRepairs(findings []doctorFinding) *DeploymentPlan {
+	plan := dm.newPlan("doctor")
+
+	byPackage := make(map[string][]Operation)
+	for _, finding := range findings {
+		for _, op := range finding.Repair {
+			if _, seen := byPackage[op.Package]; !seen {
+				plan.Packages = append(plan.Packages, op.Package)
+			}
+			byPackage[op.Package] = append(byPackage[op.Package], op)
+		}
+	}
+	for _, pkg := range plan.Packages {
+		for _, op := range byPackage[pkg] {
+			plan.add(op)
+		}
+	}
+	return plan
+}
+
+// checkConfig verifies that the configuration parses and every package's
+// settings are valid, and reports configured packages that do not exist
+func (dm *DotfilesManager) checkConfig() []doctorFinding {
+	var findings []doctorFinding
+
+	if data, err := os.ReadFile(dm.ConfigFile); os.IsNotExist(err) {
+		findings = append(findings, doctorFinding{
+			Severity: severityError,
+			Check:    "config",
+			Message:  fmt.Sprintf("%s does not exist", dm.ConfigFile),
+			Fix:      "dotctl init",
+		})
+		return findings
+	} else if err != nil {
+		findings = append(findings, doctorFinding{
+			Severity: severityError,
+			Check:    "config",
+			Message:  fmt.Sprintf("cannot read %s: %v", dm.ConfigFile, err),
+		})
+		return findings
+	} else {
+		var config Config
+		if strings.HasSuffix(dm.ConfigFile, ".json") {
+			err = json.Unmarshal(data, &config)
+		} else {
+			err = yaml.Unmarshal(data, &config)
+		}
+		if err != nil {
+			findings = append(findings, doctorFinding{
+				Severity: severityError,
+				Check:    "config",
+				Message:  fmt.Sprintf("%s cannot be parsed, defaults are used instead: %v", filepath.Base(dm.ConfigFile), err),
+				Fix:      "edit " + dm.ConfigFile,
+			})
+			return findings
+		}
+	}
+
+	if _, err := dm.globalExcludes(); err != nil {
+		findings = append(findings, doctorFinding{
+			Severity: severityError,
+			Check:    "config",
+			Message:  err.Error(),
+			Fix:      "edit global_excludes in " + dm.ConfigFile,
+		})
+	}
+
+	if !isValidTemplateOutput(dm.Config.TemplateOutput) {
+		findings = append(findings, doctorFinding{
+			Severity: severityError,
+			Check:    "config",
+			Message:  fmt.Sprintf("invalid template_output '%s' (use repo or target)", dm.Config.TemplateOutput),
+			Fix:      "edit template_output in " + dm.ConfigFile,
+		})
+	}
+
+	if config := dm.Config.Secrets; config != nil {
+		if _, err := dm.secretProviders(); err != nil {
+			findings = append(findings, doctorFinding{
+				Severity: severityError,
+				Check:    "config",
+				Message:  err.Error(),
+				Fix:      "edit secrets in " + dm.ConfigFile,
+			})
+		} else if config.File != "" {
+			if _, err := exec.LookPath("age"); err != nil {
+				findings = append(findings, doctorFinding{
+					Severity: severityError,
+					Check:    "config",
+					Message:  fmt.Sprintf("the age command is needed to decrypt %s", config.File),
+					Fix:      "install age, see https://age-encryption.org",
+				})
+			}
+		}
+	}
+
+	if _, err := dm.newSecretScanner(); err != nil {
+		findings = append(findings, doctorFinding{
+			Severity: severityError,
+			Check:    "config",
+			Message:  err.Error(),
+			Fix:      "edit secret_scan in " + dm.ConfigFile,
+		})
+	}
+
+	for _, pkg := range dm.getPackagesForSystem("") {
+		if !dm.hasEncrypted(pkg) {
+			continue
+		}
+		if _, err := dm.requireEncryptionKey(); err != nil {
+			findings = append(findings, doctorFinding{
+				Severity: severityError,
+				Check:    "config",
+				Message:  fmt.Sprintf("package '%s' has encrypted files: %v", pkg, err),
+				Fix:      "copy your key there, or set encryption.key in " + dm.ConfigFile,
+			})
+		} else if _, err := exec.LookPath("age"); err != nil {
+			findings = append(findings, doctorFinding{
+				Severity: severityError,
+				Check:    "config",
+				Message:  fmt.Sprintf("package '%s' has encrypted files, which need the age command", pkg),
+				Fix:      "install age, see https://age-encryption.org",
+			})
+		}
+		break
+	}
+
+	if _, err := dm.loadLocalConfig(); err != nil {
+		findings = append(findings, doctorFinding{
+			Severity: severityError,
+			Check:    "config",
+			Message:  err.Error(),
+			Fix:      "edit " + filepath.Join(dm.DotfilesDir, localConfigFile),
+		})
+	}
+
+	var packages []string
+	for pkg := range dm.Config.Packages {
+		packages = append(packages, pkg)
+	}
+	sort.Strings(packages)
+
+	for _, pkg := range packages {
+		if info, err := os.Stat(filepath.Join(dm.DotfilesDir, pkg)); err != nil || !info.IsDir() {
+			findings = append(findings, doctorFinding{
+				Severity: severityWarning,
+				Check:    "config",
+				Message:  fmt.Sprintf("package '%s' is configured but %s does not exist", pkg, filepath.Join(dm.DotfilesDir, pkg)),
+				Fix:      "dotctl remove " + pkg,
+			})
+			continue
+		}
+
+		for _, validate := range []func(string) error{
+			func(pkg string) error { _, err := dm.linkMode(pkg); return err },
+			func(pkg string) error { _, err := dm.conflictPolicy(pkg); return err },
+			func(pkg string) error { _, err := dm.packageExcludes(pkg); return err },
+			func(pkg string) error { _, err := dm.packageCopies(pkg); return err },
+			func(pkg string) error { _, err := dm.packageEncrypted(pkg); return err },
+			func(pkg string) error { _, _, err := dm.resolveTarget(pkg); return err },
+			func(pkg string) error { _, err := dm.mappedFiles(pkg); return err },
+			dm.validatePackageConditions,
+		} {
+			if err := validate(pkg); err != nil {
+				findings = append(findings, doctorFinding{
+					Severity: severityError,
+					Check:    "config",
+					Message:  fmt.Sprintf("package '%s': %v", pkg, err),
+					Fix:      "edit " + pkg + " in " + dm.ConfigFile,
+				})
+			}
+		}
+	}
+	return findings
+}
+
+// checkLinks finds dangling links into the dotfiles directory and recorded
+// links that no longer point to their package
+func (dm *DotfilesManager) checkLinks() []doctorFinding {
+	var findings []doctorFinding
+	reported := make(map[string]bool)
+
+	// Recorded links that were changed or replaced since they were deployed
+	for _, entry := range dm.State.Entries {
+		if entry.Type != stateEntryLink {
+			continue
+		}
+		info, err := os.Lstat(entry.Target)
+		if err != nil {
+			if os.IsNotExist(err) {
+				findings = append(findings, doctorFinding{
+					Severity: severityWarning,
+					Check:    "links",
+					Message:  fmt.Sprintf("%s of package '%s' is missing", entry.Target, entry.Package),
+					Fix:      "dotctl deploy " + entry.Package,
+				})
+				reported[entry.Target] = true
+			}
+			continue
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			findings = append(findings, doctorFinding{
+				Severity: severityWarning,
+				Check:    "links",
+				Message:  fmt.Sprintf("%s of package '%s' was replaced by a regular file or directory", entry.Target, entry.Package),
+				Fix:      "dotctl deploy " + entry.Package,
+			})
+			reported[entry.Target] = true
+			continue
+		}
+		if isLinkTo(entry.Target, entry.Source) {
+			continue
+		}
+
+		dest := linkDestination(entry.Target)
+		message := fmt.Sprintf("%s points to %s instead of %s", entry.Target, dest, entry.Source)
+		if other := dm.packageForPath(dest); other != "" && other != entry.Package {
+			message = fmt.Sprintf("%s points to package '%s' instead of '%s'", entry.Target, other, entry.Package)
+		}
+		finding := doctorFinding{
+			Severity: severityError,
+			Check:    "links",
+			Message:  message,
+			Fix:      "dotctl deploy " + entry.Package,
+		}
+		if _, err := os.Stat(entry.Source); err == nil {
+			finding.Repair = []Operation{
+				{Type: opUnlink, Package: entry.Package, Target: entry.Target},
+				{Type: opLink, Package: entry.Package, Source: entry.Source, Target: entry.Target},
+			}
+		}
+		findings = append(findings, finding)
+		reported[entry.Target] = true
+	}
+
+	// Package roots linked to the wrong package, including links made before
+	// dotctl recorded its deployments
+	for _, pkg := range dm.getPackagesForSystem("") {
+		if mode, err := dm.linkMode(pkg); err != nil || mode != linkModeDir {
+			continue
+		}
+		root, spread, err := dm.resolveTarget(pkg)
+		if err != nil || spread || reported[root] {
+			continue
+		}
+		info, err := os.Lstat(root)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if other := dm.packageForPath(linkDestination(root)); other != "" && other != pkg {
+			findings = append(findings, doctorFinding{
+				Severity: severityError,
+				Check:    "links",
+				Message:  fmt.Sprintf("%s points to package '%s' instead of '%s'", root, other, pkg),
+				Fix:      "dotctl deploy " + pkg,
+			})
+			reported[root] = true
+		}
+	}
+
+	// Dangling links into the dotfiles directory in the usual target directories
+	// and next to everything dotctl deployed
+	dirs := make(map[string]bool)
+	for _, resolve := range []func() (string, error){dm.homeDir, dm.configHome, dm.dataHome} {
+		if dir, err := resolve(); err == nil {
+			dirs[dir] = true
+		}
+	}
+	for _, entry := range dm.State.Entries {
+		dirs[filepath.Dir(entry.Target)] = true
+		if entry.Type == stateEntryDir {
+			dirs[entry.Target] = true
+		}
+	}
+
+	var dangling []string
+	for dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, dirEntry := range entries {
+			path := filepath.Join(dir, dirEntry.Name())
+			if dirEntry.Type()&os.ModeSymlink == 0 || reported[path] {
+				continue
+			}
+			// Missing template output is reported, and repaired, by checkTemplates
+			dest := linkDestination(path)
+			if !isWithin(dest, dm.DotfilesDir) || isTemplateOutput(dest) {
+				continue
+			}
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				dangling = append(dangling, path)
+				reported[path] = true
+			}
+		}
+	}
+
+	sort.Strings(dangling)
+	for _, path := range dangling {
+		dest := linkDestination(path)
+		pkg := dm.packageForPath(dest)
+		if entry := dm.State.find(path); entry != nil {
+			pkg = entry.Package
+		}
+		findings = append(findings, doctorFinding{
+			Severity: severityWarning,
+			Check:    "links",
+			Message:  fmt.Sprintf("%s is a dangling link to %s", path, dest),
+			Fix:      "rm " + path,
+			Repair:   []Operation{{Type: opUnlink, Package: pkg, Target: path}},
+		})
+	}
+	return findings
+}
+
+// linkDestination returns the absolute, cleaned destination of a symlink
+func linkDestination(path string) string {
+	dest, err := os.Readlink(path)
+	if err != nil {
+		return ""
+	}
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(filepath.Dir(path), dest)
+	}
+	return filepath.Clean(dest)
+}
+
+// checkTemplates finds template outputs that differ from what their template
+// renders to for this system
+func (dm *DotfilesManager) checkTemplates() []doctorFinding {
+	var findings []doctorFinding
+
+	for _, pkg := range dm.getPackagesForSystem("") {
+		packageDir := filepath.Join(dm.DotfilesDir, pkg)
+		excludes, err := dm.packageExcludes(pkg)
+		if err != nil {
+			continue // Reported by checkConfig
+		}
+
+		filepath.Walk(packageDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			relPath, _ := filepath.Rel(packageDir, path)
+			if relPath != "." && excludes.matches(relPath, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.IsDir() || !strings.HasSuffix(path, ".template") {
+				return nil
+			}
+
+			rendered, err := dm.renderTemplateFile(path)
+			if err != nil {
+				findings = append(findings, doctorFinding{
+					Severity: severityError,
+					Check:    "templates",
+					Message:  err.Error(),
+					Fix:      "edit the template at the reported line",
+				})
+				return nil
+			}
+			outputPath := dm.templateOutput(path)
+			if outputPath == "" {
+				return nil // Rendered to a target that is not deployed yet, reported by status
+			}
+
+			output, err := os.ReadFile(outputPath)
+			if err == nil && string(output) == rendered {
+				return nil
+			}
+
+			render := Operation{Type: opRender, Package: pkg, Source: path, Target: outputPath, Content: rendered, Secret: dm.templateUsesSecrets(path)}
+			switch entry := dm.State.find(outputPath); {
+			case os.IsNotExist(err):
+				findings = append(findings, doctorFinding{
+					Severity: severityWarning,
+					Check:    "templates",
+					Message:  fmt.Sprintf("%s has not been rendered", path),
+					Fix:      "dotctl deploy " + pkg,
+					Repair:   []Operation{render},
+				})
+			case err != nil:
+				return nil
+			case entry != nil && entry.Type == stateEntryTemplate && hashContent(output) == entry.Hash:
+				// The output is exactly what dotctl generated last time
+				findings = append(findings, doctorFinding{
+					Severity: severityWarning,
+					Check:    "templates",
+					Message:  fmt.Sprintf("%s is out of date with %s", outputPath, filepath.Base(path)),
+					Fix:      "dotctl deploy " + pkg,
+					Repair:   []Operation{render},
+				})
+			default:
+				findings = append(findings, doctorFinding{
+					Severity: severityWarning,
+					Check:    "templates",
+					Message:  fmt.Sprintf("%s differs from %s and has local changes", outputPath, filepath.Base(path)),
+					Fix:      "dotctl merge-check",
+				})
+			}
+			return nil
+		})
+	}
+
+	// Rendered secrets should only be readable by their owner
+	for _, entry := range dm.State.Entries {
+		if entry.Type != stateEntryTemplate || !entry.Secret {
+			continue
+		}
+		if info, err := os.Stat(entry.Target); err == nil && info.Mode().Perm()&0077 != 0 {
+			findings = append(findings, doctorFinding{
+				Severity: severityWarning,
+				Check:    "templates",
+				Message:  fmt.Sprintf("%s contains secrets but is readable by others (%04o)", entry.Target, info.Mode().Perm()),
+				Fix:      "chmod 600 " + entry.Target,
+			})
+		}
+	}
+	return findings
+}
+
+// checkGit verifies the tools sync depends on and the state of the dotfiles repository
+func (dm *DotfilesManager) checkGit() []doctorFinding {
+	var findings []doctorFinding
+
+	if _, err := exec.LookPath("git"); err != nil {
+		return append(findings, doctorFinding{
+			Severity: severityError,
+			Check:    "git",
+			Message:  "git is not installed, sync and pull will not work",
+			Fix:      "install git with your package manager",
+		})
+	}
+
+	if !dm.isGitHubCLIAvailable() {
+		findings = append(findings, doctorFinding{
+			Severity: severityInfo,
+			Check:    "git",
+			Message:  "GitHub CLI (gh) is not installed, it is required by sync",
+			Fix:      "install gh, see https://cli.github.com/",
+		})
+	} else if !dm.isGitHubAuthenticated() {
+		findings = append(findings, doctorFinding{
+			Severity: severityWarning,
+			Check:    "git",
+			Message:  "GitHub CLI is not authenticated",
+			Fix:      "gh auth login",
+		})
+	}
+
+	if _, err := os.Stat(filepath.Join(dm.DotfilesDir, ".git")); err != nil {
+		findings = append(findings, doctorFinding{
+			Severity: severityWarning,
+			Check:    "git",
+			Message:  fmt.Sprintf("%s is not a git repository", dm.DotfilesDir),
+			Fix:      "dotctl github-repo <owner/repo> && dotctl sync",
+		})
+		return findings
+	}
+
+	if dm.Config.GitHub != nil && dm.Config.GitHub.Repository != "" {
+		branch := dm.Config.GitHub.Branch
+		if branch == "" {
+			branch = "main"
+		}
+		cmd := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
+		cmd.Dir = dm.DotfilesDir
+		if output, err := cmd.Output(); err == nil {
+			if current := strings.TrimSpace(string(output)); current != branch {
+				findings = append(findings, doctorFinding{
+					Severity: severityWarning,
+					Check:    "git",
+					Message:  fmt.Sprintf("repository is on branch '%s', configured branch is '%s'", current, branch),
+					Fix:      fmt.Sprintf("git -C %s checkout %s", dm.DotfilesDir, branch),
+				})
+			}
+		}
+	}
+
+	// Machine-specific values must stay out of the repository
+	cmd := exec.Command("git", "ls-files", "--error-unmatch", localConfigFile)
+	cmd.Dir = dm.DotfilesDir
+	if cmd.Run() == nil {
+		findings = append(findings, doctorFinding{
+			Severity: severityError,
+			Check:    "git",
+			Message:  fmt.Sprintf("%s is committed to the repository", localConfigFile),
+			Fix:      fmt.Sprintf("git -C %s rm --cached %s && dotctl sync", dm.DotfilesDir, localConfigFile),
+		})
+	}
+
+	if dm.hasMergeConflicts() {
+		findings = append(findings, doctorFinding{
+			Severity: severityError,
+			Check:    "git",
+			Message:  "repository has unresolved merge conflicts",
+			Fix:      fmt.Sprintf("git -C %s status", dm.DotfilesDir),
+		})
+	} else if changed, err := dm.hasLocalChanges(); err == nil && changed {
+		findings = append(findings, doctorFinding{
+			Severity: severityInfo,
+			Check:    "git",
+			Message:  "repository has uncommitted changes",
+			Fix:      "dotctl sync",
+		})
+	}
+	return findings
+}
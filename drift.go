@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Deployment states of a single package file, besides the copy drift states
+const (
+	fileDeployed    = "deployed"
+	fileNotDeployed = "not deployed"
+	fileElsewhere   = "link points elsewhere"
+	fileBlocked     = "blocked by a real file"
+	fileStale       = "template output stale"
+	fileModified    = "template output modified"
+	fileBroken      = "template does not render"
+	fileDecrypted   = "decrypted file modified"
+)
+
+// fileStatus is the deployment state of one package file at its target
+type fileStatus struct {
+	Target    string
+	Source    string // File that is linked or copied to Target
+	Template  string // Template Source is rendered from, if any
+	Encrypted bool   // Source is encrypted with age and decrypted to Target
+	State     string
+	Detail    string // Where a link points when it points elsewhere
+}
+
+// inspectPackage compares every file a package would deploy with what is
+// actually at its target
+func (dm *DotfilesManager) inspectPackage(packageName string) ([]fileStatus, error) {
+	packageDir := filepath.Join(dm.DotfilesDir, packageName)
+	root, spread, err := dm.resolveTarget(packageName)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := dm.linkMode(packageName)
+	if err != nil {
+		return nil, err
+	}
+	excludes, err := dm.packageExcludes(packageName)
+	if err != nil {
+		return nil, err
+	}
+	copies, err := dm.packageCopies(packageName)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := dm.packageEncrypted(packageName)
+	if err != nil {
+		return nil, err
+	}
+	mapped, err := dm.mappedFiles(packageName)
+	if err != nil {
+		return nil, err
+	}
+	mappedNames := mappedSources(mapped)
+
+	// Only links inside the directory the package is placed in are its own
+	linkScope := filepath.Dir(root)
+	if spread {
+		linkScope = root
+	}
+
+	var files []fileStatus
+	err = filepath.Walk(packageDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(packageDir, path)
+		if err != nil || relPath == "." {
+			return err
+		}
+		slashPath := filepath.ToSlash(relPath)
+		if excludes.matches(relPath, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || mappedNames[slashPath] {
+			return nil
+		}
+
+		target := filepath.Join(root, relPath)
+		topLevel := !strings.Contains(slashPath, "/")
+
+		if isEncrypted(encrypted, relPath) && (!spread || topLevel) {
+			files = append(files, dm.decryptedStatus(path, decryptedName(target)))
+			return nil
+		}
+		if strings.HasSuffix(path, ".template") {
+			output := strings.TrimSuffix(path, ".template")
+			target = strings.TrimSuffix(target, ".template")
+			if (spread && topLevel) || (!spread && dm.rendersToTarget()) {
+				// The shell package renders its templates straight into place, as
+				// do all packages with template_output: target
+				files = append(files, dm.templateStatus(path, target, target))
+				return nil
+			}
+			files = append(files, dm.linkedTemplateStatus(path, output, target, linkScope, mode == linkModeCopy || copies.matches(relPath, false)))
+			return nil
+		}
+		if isTemplateOutput(path) {
+			return nil
+		}
+
+		if mode == linkModeCopy || (copies.matches(relPath, false) && (!spread || topLevel)) {
+			files = append(files, dm.copyStatus(path, target))
+		} else {
+			files = append(files, linkStatus(path, target, linkScope))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect %s: %w", packageDir, err)
+	}
+
+	for _, file := range mapped {
+		copied := mode == linkModeCopy || copies.matches(file.RelPath, false)
+		if isEncrypted(encrypted, file.RelPath) {
+			files = append(files, dm.decryptedStatus(file.Source, file.Target))
+		} else if strings.HasSuffix(file.RelPath, ".template") {
+			templatePath := filepath.Join(packageDir, filepath.FromSlash(file.RelPath))
+			if dm.rendersToTarget() {
+				files = append(files, dm.templateStatus(templatePath, file.Target, file.Target))
+				continue
+			}
+			files = append(files, dm.linkedTemplateStatus(templatePath, file.Source, file.Target, filepath.Dir(file.Target), copied))
+		} else if copied {
+			files = append(files, dm.copyStatus(file.Source, file.Target))
+		} else {
+			files = append(files, linkStatus(file.Source, file.Target, filepath.Dir(file.Target)))
+		}
+	}
+	return files, nil
+}
+
+// linkStatus checks that target resolves to source. A file inside a linked
+// directory counts as deployed; symlinks at target or its parents below scope
+// that lead anywhere else are reported.
+func linkStatus(source, target, scope string) fileStatus {
+	status := fileStatus{Target: target, Source: source, State: fileDeployed}
+
+	want, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		want = source
+	}
+	got, err := filepath.EvalSymlinks(target)
+	if err == nil && got == want {
+		return status
+	}
+
+	if link := outermostLink(target, scope); link != "" {
+		status.State = fileElsewhere
+		status.Detail = link + " -> " + linkDestination(link)
+	} else if err != nil {
+		status.State = fileNotDeployed
+	} else {
+		status.State = fileBlocked
+	}
+	return status
+}
+
+// outermostLink returns the symlink closest to scope among target and its
+// parents below scope, or "" if there is none
+func outermostLink(target, scope string) string {
+	link := ""
+	for path := target; path != scope && isWithin(path, scope); path = filepath.Dir(path) {
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			link = path
+		}
+	}
+	return link
+}
+
+// copyStatus checks a deployed copy against its package file
+func (dm *DotfilesManager) copyStatus(source, target string) fileStatus {
+	status := fileStatus{Target: target, Source: source, State: fileDeployed}
+
+	info, err := os.Lstat(target)
+	switch {
+	case os.IsNotExist(err):
+		status.State = fileNotDeployed
+		return status
+	case err == nil && info.Mode()&os.ModeSymlink != 0:
+		status.State = fileElsewhere
+		status.Detail = target + " -> " + linkDestination(target)
+		return status
+	}
+
+	entry := dm.State.find(target)
+	if entry == nil || entry.Type != stateEntryCopy {
+		if hashFile(target) != hashFile(source) {
+			status.State = fileBlocked
+		}
+		return status
+	}
+	if drift := copyDrift(entry.Hash, hashFile(source), target); drift != copyInSync {
+		status.State = drift
+	}
+	return status
+}
+
+// decryptedStatus checks a file decrypted to target against what was
+// decrypted there last, without decrypting source again
+func (dm *DotfilesManager) decryptedStatus(source, target string) fileStatus {
+	status := fileStatus{Target: target, Source: source, Encrypted: true, State: fileDeployed}
+
+	info, err := os.Lstat(target)
+	switch {
+	case os.IsNotExist(err):
+		status.State = fileNotDeployed
+		return status
+	case err == nil && info.Mode()&os.ModeSymlink != 0:
+		status.State = fileElsewhere
+		status.Detail = target + " -> " + linkDestination(target)
+		return status
+	}
+
+	entry := dm.State.find(target)
+	switch {
+	case entry == nil || entry.Type != stateEntryDecrypted || entry.Source != source:
+		status.State = fileBlocked
+	case hashFile(target) != entry.Hash:
+		status.State = fileDecrypted
+		status.Detail = "'dotctl sync' encrypts it back"
+	}
+	return status
+}
+
+// templateStatus checks that output holds what templatePath renders to.
+// target is where the output is deployed, which is output itself unless it is linked.
+func (dm *DotfilesManager) templateStatus(templatePath, output, target string) fileStatus {
+	status := fileStatus{Target: target, Source: output, Template: templatePath, State: fileDeployed}
+
+	rendered, err := dm.renderTemplateFile(templatePath)
+	if err != nil {
+		status.State = fileBroken
+		status.Detail = err.Error()
+		return status
+	}
+	content, err := os.ReadFile(output)
+	if os.IsNotExist(err) {
+		status.State = fileNotDeployed
+		return status
+	}
+	if err != nil || string(content) == rendered {
+		return status
+	}
+
+	// Output that is exactly what dotctl generated last time is merely outdated
+	status.State = fileModified
+	if entry := dm.State.find(output); entry != nil && entry.Type == stateEntryTemplate && entry.Hash == hashContent(content) {
+		status.State = fileStale
+	}
+	return status
+}
+
+// linkedTemplateStatus checks a template rendered next to itself whose output
+// is then linked or copied to target
+func (dm *DotfilesManager) linkedTemplateStatus(templatePath, output, target, scope string, copied bool) fileStatus {
+	var status fileStatus
+	if copied {
+		status = dm.copyStatus(output, target)
+	} else {
+		status = linkStatus(output, target, scope)
+	}
+	if status.State != fileDeployed {
+		status.Template = templatePath
+		return status
+	}
+	return dm.templateStatus(templatePath, output, target)
+}
+
+// summarizeFiles describes the overall state of a package from its files and
+// reports whether it has drifted from what a deployment would produce
+func summarizeFiles(files []fileStatus) (string, bool) {
+	deployed := 0
+	var problems []string
+	seen := make(map[string]bool)
+	for _, file := range files {
+		switch {
+		case file.State == fileDeployed:
+			deployed++
+		case file.State == fileNotDeployed:
+		case !seen[file.State]:
+			seen[file.State] = true
+			problems = append(problems, file.State)
+		}
+	}
+
+	switch {
+	case len(problems) > 0:
+		return "✗ " + strings.Join(problems, ", "), true
+	case deployed == len(files):
+		return "✓ deployed", false
+	case deployed == 0:
+		return "✗ not deployed", true
+	default:
+		return fmt.Sprintf("✗ partially deployed (%d/%d files)", deployed, len(files)), true
+	}
+}
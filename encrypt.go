@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// encryptedSuffix marks package files that are stored encrypted
+const encryptedSuffix = ".enc"
+
+// EncryptionConfig is the encryption section of dotctl.yaml
+type EncryptionConfig struct {
+	Key string `yaml:"key,omitempty" json:"key,omitempty"` // age identity file outside the repository, default $XDG_DATA_HOME/dotctl/key.txt
+}
+
+// sensitivePatterns are the files adopt offers to store encrypted
+var sensitivePatterns = []string{
+	".netrc", ".pgpass", "hosts.yml", "*.pem", "*.key", "*.p12", "*.kdbx",
+	"id_*", "!id_*.pub", "*credentials*", "*secret*", "*token*",
+}
+
+// packageEncrypted returns a matcher for the files a package stores encrypted
+// under their own name, besides those ending in .enc
+func (dm *DotfilesManager) packageEncrypted(packageName string) (*pathMatcher, error) {
+	matcher := &pathMatcher{}
+	if packageConfig := dm.getPackageConfig(packageName); packageConfig != nil {
+		if err := matcher.add(packageConfig.Encrypted); err != nil {
+			return nil, fmt.Errorf("encrypted patterns for %s: %w", packageName, err)
+		}
+	}
+	return matcher, nil
+}
+
+// isEncrypted reports whether a package-relative path is stored encrypted
+func isEncrypted(encrypted *pathMatcher, relPath string) bool {
+	return strings.HasSuffix(relPath, encryptedSuffix) || encrypted.matches(relPath, false)
+}
+
+// decryptedName returns the name an encrypted file is deployed under
+func decryptedName(name string) string {
+	return strings.TrimSuffix(name, encryptedSuffix)
+}
+
+// hasEncrypted reports whether a package places any encrypted file along
+// with its other files, rather than at an explicit destination
+func (dm *DotfilesManager) hasEncrypted(packageName string) bool {
+	packageDir := filepath.Join(dm.DotfilesDir, packageName)
+	excludes, err := dm.packageExcludes(packageName)
+	if err != nil {
+		return false
+	}
+	encrypted, err := dm.packageEncrypted(packageName)
+	if err != nil {
+		return false
+	}
+	mapped, err := dm.mappedFiles(packageName)
+	if err != nil {
+		return false
+	}
+	mappedNames := mappedSources(mapped)
+
+	found := false
+	filepath.Walk(packageDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || found {
+			return filepath.SkipDir
+		}
+		relPath, _ := filepath.Rel(packageDir, path)
+		if relPath != "." && excludes.matches(relPath, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		found = !info.IsDir() && isEncrypted(encrypted, relPath) && !mappedNames[filepath.ToSlash(relPath)]
+		return nil
+	})
+	return found
+}
+
+// encryptionKey returns the age identity encrypted files are decrypted with,
+// which must not be inside the dotfiles directory
+func (dm *DotfilesManager) encryptionKey() (string, error) {
+	var key string
+	if dm.Config.Encryption != nil && dm.Config.Encryption.Key != "" {
+		expanded, err := dm.expandPath(dm.Config.Encryption.Key)
+		if err != nil {
+			return "", err
+		}
+		key = expanded
+	} else {
+		dataHome, err := dm.dataHome()
+		if err != nil {
+			return "", err
+		}
+		key = filepath.Join(dataHome, "dotctl", "key.txt")
+	}
+
+	// The key would be pushed along with the files it protects
+	if isWithin(key, dm.DotfilesDir) {
+		return "", fmt.Errorf("encryption key %s must be kept outside the dotfiles directory", key)
+	}
+	return key, nil
+}
+
+// requireEncryptionKey returns the encryption key, which has to exist
+func (dm *DotfilesManager) requireEncryptionKey() (string, error) {
+	key, err := dm.encryptionKey()
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(key); os.IsNotExist(err) {
+		return "", fmt.Errorf("no encryption key at %s, create one with 'age-keygen -o %s'", key, key)
+	}
+	return key, nil
+}
+
+// ageEncrypt encrypts data with the age command to the recipient of identity
+func ageEncrypt(data []byte, identity string) ([]byte, error) {
+	if _, err := exec.LookPath("age"); err != nil {
+		return nil, fmt.Errorf("the age command is needed to encrypt files, see https://age-encryption.org")
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("age", "--encrypt", "--identity", identity)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt with %s: %s", identity, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// planDecrypt plans decrypting an encrypted package file to its target.
+// A decrypted file modified since is left alone for sync to encrypt back.
+func (dm *DotfilesManager) planDecrypt(plan *DeploymentPlan, packageName, source, target string) error {
+	decryptOp := Operation{Type: opDecrypt, Package: packageName, Source: source, Target: target}
+
+	entry := dm.State.find(target)
+	if entry == nil || entry.Type != stateEntryDecrypted || entry.Source != source {
+		proceed, err := dm.planTarget(plan, packageName, source, target)
+		if err != nil || !proceed {
+			return err
+		}
+		plan.add(decryptOp)
+		return nil
+	}
+
+	if info, err := os.Lstat(target); err == nil && (info.Mode()&os.ModeSymlink != 0 || hashFile(target) != entry.Hash) {
+		plan.add(Operation{Type: opSkip, Package: packageName, Target: target, Reason: "modified since it was decrypted, 'dotctl sync' encrypts it back"})
+		return nil
+	}
+	plan.add(decryptOp)
+	return nil
+}
+
+// applyDecrypt decrypts an encrypted package file to its target, readable by its owner only
+func (dm *DotfilesManager) applyDecrypt(op Operation) error {
+	key, err := dm.requireEncryptionKey()
+	if err != nil {
+		return err
+	}
+	data, err := ageDecrypt(op.Source, key)
+	if err != nil {
+		return err
+	}
+
+	existing, readErr := os.ReadFile(op.Target)
+	info, statErr := os.Stat(op.Target)
+	if readErr != nil || statErr != nil || string(existing) != string(data) || info.Mode().Perm() != 0600 {
+		if err := dm.writeFile(op.Target, data, 0600); err != nil {
+			return fmt.Errorf("failed to decrypt %s to %s: %w", op.Source, op.Target, err)
+		}
+		fmt.Printf("DECRYPT: %s -> %s\n", op.Source, op.Target)
+	}
+
+	dm.recordDecrypted(op.owner(), op.Source, op.Target, data)
+	return nil
+}
+
+// applyEncrypt replaces the plaintext file Source with its encrypted form Target
+func (dm *DotfilesManager) applyEncrypt(op Operation) error {
+	key, err := dm.requireEncryptionKey()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(op.Source)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", op.Source, err)
+	}
+	encrypted, err := ageEncrypt(data, key)
+	if err != nil {
+		return err
+	}
+
+	if err := dm.writeFile(op.Target, encrypted, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", op.Target, err)
+	}
+	if err := dm.removePath(op.Source); err != nil {
+		return fmt.Errorf("failed to remove plaintext %s: %w", op.Source, err)
+	}
+	fmt.Printf("ENCRYPT: %s -> %s\n", op.Source, op.Target)
+	return nil
+}
+
+// planAdoptEncryption plans storing the sensitive files of a package being
+// adopted encrypted, once the package directory has been moved to packageDir.
+// Without encrypt they are only pointed out. It returns the files, relative
+// to the package, that will be encrypted.
+func (dm *DotfilesManager) planAdoptEncryption(plan *DeploymentPlan, packageName, sourceDir, packageDir string, encrypt bool) (map[string]bool, error) {
+	sensitive := &pathMatcher{}
+	if err := sensitive.add(sensitivePatterns); err != nil {
+		return nil, err
+	}
+
+	var candidates []string
+	filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		relPath, _ := filepath.Rel(sourceDir, path)
+		if sensitive.matches(relPath, false) && !strings.HasSuffix(relPath, encryptedSuffix) {
+			candidates = append(candidates, relPath)
+		}
+		return nil
+	})
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	if !encrypt {
+		for _, relPath := range candidates {
+			fmt.Fprintf(dm.out, "Warning: %s looks sensitive, adopt with --encrypt to store it encrypted\n", filepath.Join(sourceDir, relPath))
+		}
+		return nil, nil
+	}
+	if _, err := exec.LookPath("age"); err != nil {
+		return nil, fmt.Errorf("the age command is needed to encrypt files, see https://age-encryption.org")
+	}
+	if _, err := dm.requireEncryptionKey(); err != nil {
+		return nil, err
+	}
+
+	encrypting := make(map[string]bool)
+	for _, relPath := range candidates {
+		plaintext := filepath.Join(packageDir, relPath)
+		plan.add(Operation{Type: opEncrypt, Package: packageName, Source: plaintext, Target: plaintext + encryptedSuffix})
+		encrypting[relPath] = true
+	}
+	return encrypting, nil
+}
+
+// planAdoptedFiles plans putting the files of a package adopted with encryption
+// back at sourceDir once they are in packageDir, file by file like deploy does:
+// directories without encrypted or excluded files are linked whole, and
+// encrypted files are decrypted
+func (dm *DotfilesManager) planAdoptedFiles(plan *DeploymentPlan, packageName, sourceDir, packageDir string, encrypting map[string]bool) error {
+	excludes, err := dm.globalExcludes()
+	if err != nil {
+		return err
+	}
+
+	foldable := func(relDir string) bool {
+		for relPath := range encrypting {
+			if isWithin(relPath, relDir) {
+				return false
+			}
+		}
+		foldable := true
+		filepath.Walk(filepath.Join(sourceDir, relDir), func(path string, info os.FileInfo, err error) error {
+			relPath, _ := filepath.Rel(sourceDir, path)
+			if err != nil || excludes.matches(relPath, info.IsDir()) {
+				foldable = false
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		return foldable
+	}
+
+	plan.add(Operation{Type: opMkdir, Package: packageName, Target: sourceDir})
+	return filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, _ := filepath.Rel(sourceDir, path)
+		if relPath == "." {
+			return nil
+		}
+		if excludes.matches(relPath, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		source := filepath.Join(packageDir, relPath)
+		switch {
+		case info.IsDir() && foldable(relPath):
+			plan.add(Operation{Type: opLink, Package: packageName, Source: source, Target: path})
+			return filepath.SkipDir
+		case info.IsDir():
+			plan.add(Operation{Type: opMkdir, Package: packageName, Target: path})
+		case encrypting[relPath]:
+			plan.add(Operation{Type: opDecrypt, Package: packageName, Source: source + encryptedSuffix, Target: path})
+		default:
+			plan.add(Operation{Type: opLink, Package: packageName, Source: source, Target: path})
+		}
+		return nil
+	})
+}
+
+// encryptChanges encrypts decrypted files that were modified at their targets
+// back into the repository, so sync commits the changes
+func (dm *DotfilesManager) encryptChanges(dryRun bool) error {
+	var changed []StateEntry
+	for _, entry := range dm.State.Entries {
+		if entry.Type != stateEntryDecrypted {
+			continue
+		}
+		info, err := os.Lstat(entry.Target)
+		if err != nil || !info.Mode().IsRegular() || hashFile(entry.Target) == entry.Hash {
+			continue
+		}
+		changed = append(changed, entry)
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	if dryRun {
+		for _, entry := range changed {
+			fmt.Printf("DRY RUN: Would encrypt changes to %s into %s\n", entry.Target, entry.Source)
+		}
+		return nil
+	}
+
+	key, err := dm.requireEncryptionKey()
+	if err != nil {
+		return err
+	}
+	for _, entry := range changed {
+		data, err := os.ReadFile(entry.Target)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", entry.Target, err)
+		}
+		encrypted, err := ageEncrypt(data, key)
+		if err != nil {
+			return err
+		}
+		perm := os.FileMode(0644)
+		if info, err := os.Stat(entry.Source); err == nil {
+			perm = info.Mode().Perm()
+		}
+		if err := os.WriteFile(entry.Source, encrypted, perm); err != nil {
+			return fmt.Errorf("failed to write %s: %w", entry.Source, err)
+		}
+		dm.recordDecrypted(entry.Package, entry.Source, entry.Target, data)
+		fmt.Printf("✓ Encrypted changes to %s into %s\n", entry.Target, entry.Source)
+	}
+	return dm.saveState()
+}
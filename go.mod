@@ -5,4 +5,4 @@ go 1.21
 // No external dependencies required!
 // This tool uses only Go standard library packages
 
-require gopkg.in/yaml.v3 v3.0.1 // indirect
+require gopkg.in/yaml.v3 v3.0.1
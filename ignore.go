@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ignoreFileName is the per-package file listing additional exclude patterns
+const ignoreFileName = ".dotctlignore"
+
+// globPattern is a single gitignore-style pattern
+type globPattern struct {
+	raw      string
+	regex    *regexp.Regexp
+	negate   bool // Pattern started with '!' and re-includes matching paths
+	dirOnly  bool // Pattern ended with '/' and only matches directories
+	anchored bool // Pattern contains a '/' and matches relative to the package root
+}
+
+// pathMatcher matches package-relative paths against a list of gitignore-style patterns
+type pathMatcher struct {
+	patterns []globPattern
+}
+
+// parseGlobPattern compiles a gitignore-style pattern. Blank lines and
+// comments yield nil.
+func parseGlobPattern(line string) (*globPattern, error) {
+	// Trailing spaces are dropped unless the last one is escaped
+	trimmed := strings.TrimRight(line, " \t\r")
+	if escapes := len(trimmed) - len(strings.TrimRight(trimmed, `\`)); escapes%2 == 1 && len(trimmed) < len(line) {
+		trimmed = line[:len(trimmed)+1]
+	}
+	line = trimmed
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+
+	// An escaped leading '!' or '#' is matched literally by globToRegexp
+	pattern := &globPattern{raw: line}
+	if strings.HasPrefix(line, "!") {
+		pattern.negate = true
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		pattern.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return nil, nil
+	}
+
+	regex, err := regexp.Compile("^" + globToRegexp(line) + "$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern '%s': %w", pattern.raw, err)
+	}
+	pattern.regex = regex
+	return pattern, nil
+}
+
+// globToRegexp translates glob syntax (*, ?, [...] and **) to a regular
+// expression. As in gitignore, ** spans directories only as a whole path
+// segment, elsewhere it is an ordinary *.
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' && (i == 0 || glob[i-1] == '/') && (i+2 == len(glob) || glob[i+2] == '/') {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					// "**/" matches zero or more leading directories
+					i++
+					sb.WriteString("(.*/)?")
+				} else {
+					sb.WriteString(".*")
+				}
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				sb.WriteString(regexp.QuoteMeta(string(glob[i])))
+			}
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return sb.String()
+}
+
+// add compiles patterns and appends them to the matcher; later patterns take precedence
+func (m *pathMatcher) add(patterns []string) error {
+	for _, line := range patterns {
+		pattern, err := parseGlobPattern(line)
+		if err != nil {
+			return err
+		}
+		if pattern != nil {
+			m.patterns = append(m.patterns, *pattern)
+		}
+	}
+	return nil
+}
+
+// matchOne applies the patterns to a single path, ignoring its parents
+func (m *pathMatcher) matchOne(relPath string, isDir bool) bool {
+	matched := false
+	name := relPath[strings.LastIndex(relPath, "/")+1:]
+	for _, pattern := range m.patterns {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		subject := name
+		if pattern.anchored {
+			subject = relPath
+		}
+		if pattern.regex.MatchString(subject) {
+			matched = !pattern.negate
+		}
+	}
+	return matched
+}
+
+// matches reports whether a package-relative path matches. As with git,
+// nothing inside a matched directory can be re-included.
+func (m *pathMatcher) matches(relPath string, isDir bool) bool {
+	if m == nil || len(m.patterns) == 0 {
+		return false
+	}
+
+	parts := strings.Split(filepath.ToSlash(filepath.Clean(relPath)), "/")
+	for i := range parts {
+		last := i == len(parts)-1
+		if m.matchOne(strings.Join(parts[:i+1], "/"), isDir || !last) {
+			return true
+		}
+	}
+	return false
+}
+
+// readIgnoreFile reads patterns from a .dotctlignore file, returning nil if it does not exist
+func readIgnoreFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		patterns = append(patterns, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return patterns, nil
+}
+
+// globalExcludes returns a matcher for the global_excludes configuration
+func (dm *DotfilesManager) globalExcludes() (*pathMatcher, error) {
+	matcher := &pathMatcher{}
+	if err := matcher.add(dm.Config.GlobalExcludes); err != nil {
+		return nil, fmt.Errorf("global_excludes: %w", err)
+	}
+	return matcher, nil
+}
+
+// packageExcludes combines global_excludes, the package's excludes setting and
+// its .dotctlignore file, in increasing order of precedence
+func (dm *DotfilesManager) packageExcludes(packageName string) (*pathMatcher, error) {
+	matcher, err := dm.globalExcludes()
+	if err != nil {
+		return nil, err
+	}
+	// The ignore file itself is never deployed
+	matcher.add([]string{ignoreFileName})
+
+	if packageConfig := dm.getPackageConfig(packageName); packageConfig != nil {
+		if err := matcher.add(packageConfig.Excludes); err != nil {
+			return nil, fmt.Errorf("excludes for %s: %w", packageName, err)
+		}
+	}
+
+	ignorePath := filepath.Join(dm.DotfilesDir, packageName, ignoreFileName)
+	patterns, err := readIgnoreFile(ignorePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := matcher.add(patterns); err != nil {
+		return nil, fmt.Errorf("%s: %w", ignorePath, err)
+	}
+	return matcher, nil
+}
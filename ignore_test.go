@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPathMatcher(t *testing.T) {
+	tests := []struct {
+		patterns string // One per line, as in a .dotctlignore file
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		// A pattern without a slash matches a name at any depth
+		{"*.log", "debug.log", false, true},
+		{"*.log", "logs/2024/debug.log", false, true},
+		{"*.log", "debug.log.txt", false, false},
+		{"*.swp", ".init.lua.swp", false, true},
+		{"cache", "nvim/cache", true, true},
+		{"cache", "nvim/cache/x", false, true},
+
+		// * and ? do not match a slash, character classes match one character
+		{"?.txt", "a.txt", false, true},
+		{"?.txt", "ab.txt", false, false},
+		{"doc/*.txt", "doc/notes.txt", false, true},
+		{"doc/*.txt", "doc/sub/notes.txt", false, false},
+		{"[ab].conf", "b.conf", false, true},
+		{"[ab].conf", "c.conf", false, false},
+		{"[!ab].conf", "c.conf", false, true},
+		{"[!ab].conf", "a.conf", false, false},
+		{"[a-c]x", "bx", false, true},
+		{"[a-c]x", "dx", false, false},
+
+		// A slash at the start or in the middle anchors the pattern to the root
+		{"/build", "build", true, true},
+		{"/build", "src/build", true, false},
+		{"doc/frotz", "doc/frotz", false, true},
+		{"doc/frotz", "a/doc/frotz", false, false},
+		{"/doc/frotz", "doc/frotz", false, true},
+
+		// A trailing slash matches directories and what is in them only
+		{"build/", "build", true, true},
+		{"build/", "build", false, false},
+		{"build/", "build/out.o", false, true},
+		{"build/", "src/build/out.o", false, true},
+		{"doc/build/", "doc/build/x", false, true},
+		{"doc/build/", "x/doc/build/y", false, false},
+
+		// ** matches any number of directories as a whole path segment
+		{"**/foo", "foo", false, true},
+		{"**/foo", "a/b/foo", false, true},
+		{"**/foo/bar", "foo/bar", false, true},
+		{"**/foo/bar", "x/y/foo/bar", false, true},
+		{"abc/**", "abc/x", false, true},
+		{"abc/**", "abc/x/y", false, true},
+		{"abc/**", "abc", true, false},
+		{"abc/**", "xabc/y", false, false},
+		{"a/**/b", "a/b", false, true},
+		{"a/**/b", "a/x/b", false, true},
+		{"a/**/b", "a/x/y/b", false, true},
+		{"a/**/b", "a/xb", false, false},
+		{"**", "any/thing", false, true},
+		{"a**b", "axyb", false, true},
+		{"a**b", "ax/yb", false, false},
+		{"foo**/bar", "foox/bar", false, true},
+		{"foo**/bar", "foo/x/bar", false, false},
+
+		// Later patterns win, a negation re-includes what an earlier one excluded
+		{"*.log\n!keep.log", "keep.log", false, false},
+		{"*.log\n!keep.log", "other.log", false, true},
+		{"!keep.log\n*.log", "keep.log", false, true},
+		{"/*\n!/nvim", "nvim/init.lua", false, false},
+		{"/*\n!/nvim", "zsh/.zshrc", false, true},
+
+		// Nothing inside an excluded directory can be re-included
+		{"logs/\n!logs/keep.log", "logs/keep.log", false, true},
+		{"logs\n!keep.log", "logs/keep.log", false, true},
+
+		// Comments, blank lines, escapes and trailing spaces
+		{"# comment", "# comment", false, false},
+		{"\n\n", "x", false, false},
+		{`\#notes`, "#notes", false, true},
+		{`\!important`, "!important", false, true},
+		{"!important", "!important", false, false},
+		{"notes.txt   ", "notes.txt", false, true},
+		{`name\ `, "name ", false, true},
+		{`name\ `, "name", false, false},
+		{`\*.txt`, "*.txt", false, true},
+		{`\*.txt`, "a.txt", false, false},
+	}
+	for _, test := range tests {
+		matcher := &pathMatcher{}
+		if err := matcher.add(strings.Split(test.patterns, "\n")); err != nil {
+			t.Fatalf("%q: %v", test.patterns, err)
+		}
+		if got := matcher.matches(test.path, test.isDir); got != test.want {
+			t.Errorf("%q matches %q (directory %v) = %v, want %v", test.patterns, test.path, test.isDir, got, test.want)
+		}
+	}
+}
+
+func TestPathMatcherEmpty(t *testing.T) {
+	var unset *pathMatcher
+	if unset.matches("anything", false) || (&pathMatcher{}).matches("anything", false) {
+		t.Error("a matcher without patterns matched")
+	}
+}
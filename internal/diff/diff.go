@@ -0,0 +1,285 @@
+// Package diff computes line-based differences between two texts with the
+// Myers algorithm and formats them as unified diffs.
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Kind is the type of a line in an edit script
+type Kind int
+
+const (
+	Equal  Kind = iota // Line is present in both texts
+	Delete             // Line is only present in the old text
+	Insert             // Line is only present in the new text
+)
+
+// Edit is one line of an edit script. OldLine and NewLine are the 1-based
+// line numbers in the old and new text, 0 for the side the line is not in.
+type Edit struct {
+	Kind    Kind
+	OldLine int
+	NewLine int
+	Text    string
+}
+
+// maxEditDistance bounds the work done on very different inputs. Beyond it
+// the remaining lines are reported as deleted and inserted wholesale.
+const maxEditDistance = 2000
+
+// SplitLines splits text into lines. A trailing newline does not start another line.
+func SplitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.Split(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Lines returns a shortest edit script turning a into b
+func Lines(a, b []string) []Edit {
+	// Common prefix and suffix are matched directly
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var edits []Edit
+	for i := 0; i < prefix; i++ {
+		edits = append(edits, Edit{Kind: Equal, OldLine: i + 1, NewLine: i + 1, Text: a[i]})
+	}
+	for _, edit := range myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]) {
+		if edit.OldLine > 0 {
+			edit.OldLine += prefix
+		}
+		if edit.NewLine > 0 {
+			edit.NewLine += prefix
+		}
+		edits = append(edits, edit)
+	}
+	for i := suffix; i > 0; i-- {
+		edits = append(edits, Edit{Kind: Equal, OldLine: len(a) - i + 1, NewLine: len(b) - i + 1, Text: a[len(a)-i]})
+	}
+	return edits
+}
+
+// myers finds a shortest edit script with the greedy O((N+M)D) algorithm from
+// "An O(ND) Difference Algorithm and Its Variations", keeping the frontier of
+// every round so the path can be traced back afterwards
+func myers(a, b []string) []Edit {
+	n, m := len(a), len(b)
+	limit := n + m
+	if limit > maxEditDistance {
+		limit = maxEditDistance
+	}
+
+	// v[k] is the furthest x reached on diagonal k = x - y, stored at v[k+offset]
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	var trace [][]int
+
+	for d := 0; d <= limit; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1] // Move down: insertion
+			} else {
+				x = v[offset+k-1] + 1 // Move right: deletion
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(a, b, trace, offset)
+			}
+		}
+	}
+
+	// Too different to be worth an exact answer
+	var edits []Edit
+	for i, line := range a {
+		edits = append(edits, Edit{Kind: Delete, OldLine: i + 1, Text: line})
+	}
+	for i, line := range b {
+		edits = append(edits, Edit{Kind: Insert, NewLine: i + 1, Text: line})
+	}
+	return edits
+}
+
+// backtrack walks the recorded frontiers from the end of both inputs back to
+// the start, collecting the edits along the way
+func backtrack(a, b []string, trace [][]int, offset int) []Edit {
+	var reversed []Edit
+	x, y := len(a), len(b)
+
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			reversed = append(reversed, Edit{Kind: Equal, OldLine: x, NewLine: y, Text: a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				reversed = append(reversed, Edit{Kind: Insert, NewLine: y, Text: b[y-1]})
+			} else {
+				reversed = append(reversed, Edit{Kind: Delete, OldLine: x, Text: a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	edits := make([]Edit, len(reversed))
+	for i, edit := range reversed {
+		edits[len(reversed)-1-i] = edit
+	}
+	return edits
+}
+
+// Hunk is a group of nearby changes with surrounding context lines
+type Hunk struct {
+	OldStart int
+	OldLines int
+	NewStart int
+	NewLines int
+	Edits    []Edit
+}
+
+// Hunks groups the changes of an edit script into hunks with up to context
+// unchanged lines around them. Changes separated by no more than twice the
+// context end up in the same hunk.
+func Hunks(edits []Edit, context int) []Hunk {
+	var hunks []Hunk
+
+	// Lines of each text that come before edits[i]
+	oldBefore := make([]int, len(edits)+1)
+	newBefore := make([]int, len(edits)+1)
+	for i, edit := range edits {
+		oldBefore[i+1], newBefore[i+1] = oldBefore[i], newBefore[i]
+		if edit.Kind != Insert {
+			oldBefore[i+1]++
+		}
+		if edit.Kind != Delete {
+			newBefore[i+1]++
+		}
+	}
+
+	for i := 0; i < len(edits); {
+		if edits[i].Kind == Equal {
+			i++
+			continue
+		}
+
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+
+		// Extend over changes until a run of unchanged lines is too long to bridge
+		end := i
+		for end < len(edits) {
+			if edits[end].Kind != Equal {
+				end++
+				continue
+			}
+			run := end
+			for run < len(edits) && edits[run].Kind == Equal {
+				run++
+			}
+			if run == len(edits) || run-end > 2*context {
+				end += min(context, run-end)
+				break
+			}
+			end = run
+		}
+
+		hunk := Hunk{
+			OldStart: oldBefore[start],
+			OldLines: oldBefore[end] - oldBefore[start],
+			NewStart: newBefore[start],
+			NewLines: newBefore[end] - newBefore[start],
+			Edits:    edits[start:end],
+		}
+		// An empty range is given as the line it follows
+		if hunk.OldLines > 0 {
+			hunk.OldStart++
+		}
+		if hunk.NewLines > 0 {
+			hunk.NewStart++
+		}
+		hunks = append(hunks, hunk)
+		i = end
+	}
+	return hunks
+}
+
+// Header returns the "@@ -a,b +c,d @@" line of the hunk
+func (h Hunk) Header() string {
+	return fmt.Sprintf("@@ -%s +%s @@", formatRange(h.OldStart, h.OldLines), formatRange(h.NewStart, h.NewLines))
+}
+
+func formatRange(start, lines int) string {
+	if lines == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, lines)
+}
+
+// String formats a single edit as a unified diff line
+func (e Edit) String() string {
+	switch e.Kind {
+	case Delete:
+		return "-" + e.Text
+	case Insert:
+		return "+" + e.Text
+	default:
+		return " " + e.Text
+	}
+}
+
+// Unified returns a unified diff of two texts with the given number of context
+// lines, or "" when they are identical
+func Unified(oldLabel, newLabel, oldText, newText string, context int) string {
+	if oldText == newText {
+		return ""
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", oldLabel, newLabel)
+
+	hunks := Hunks(Lines(SplitLines(oldText), SplitLines(newText)), context)
+	for _, hunk := range hunks {
+		sb.WriteString(hunk.Header() + "\n")
+		for _, edit := range hunk.Edits {
+			sb.WriteString(edit.String() + "\n")
+		}
+	}
+	if len(hunks) == 0 {
+		sb.WriteString("\\ Files differ only in the newline at end of file\n")
+	}
+	return sb.String()
+}
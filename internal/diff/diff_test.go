@@ -0,0 +1,218 @@
+package diff
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// script renders an edit script compactly, one "-", "+" or " " prefixed line per edit
+func script(edits []Edit) string {
+	var lines []string
+	for _, edit := range edits {
+		lines = append(lines, edit.String())
+	}
+	return strings.Join(lines, "|")
+}
+
+func TestSplitLines(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"", nil},
+		{"a", []string{"a"}},
+		{"a\n", []string{"a"}},
+		{"a\nb", []string{"a", "b"}},
+		{"a\n\nb\n", []string{"a", "", "b"}},
+		{"\n", []string{""}},
+	}
+
+	for _, tt := range tests {
+		if got := SplitLines(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitLines(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{"identical", "a b c", "a b c", " a| b| c"},
+		{"both empty", "", "", ""},
+		{"from empty", "", "a b", "+a|+b"},
+		{"to empty", "a b", "", "-a|-b"},
+		{"insert at top", "a b c", "x a b c", "+x| a| b| c"},
+		{"insert in middle", "a b c", "a b x c", " a| b|+x| c"},
+		{"insert at end", "a b c", "a b c x", " a| b| c|+x"},
+		{"delete at top", "a b c", "b c", "-a| b| c"},
+		{"delete in middle", "a b c d", "a d", " a|-b|-c| d"},
+		{"replace line", "a b c", "a x c", " a|-b|+x| c"},
+		{"moved line", "a b c d", "b c d a", "-a| b| c| d|+a"},
+		{"moved block", "a b c d e", "d e a b c", "+d|+e| a| b| c|-d|-e"},
+		{"nothing in common", "a b", "c d", "-a|-b|+c|+d"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := script(Lines(strings.Fields(tt.a), strings.Fields(tt.b)))
+			if got != tt.want {
+				t.Errorf("Lines(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLinesNumbering(t *testing.T) {
+	a := strings.Fields("a b c d")
+	b := strings.Fields("x a c d y")
+
+	for _, edit := range Lines(a, b) {
+		switch edit.Kind {
+		case Equal:
+			if a[edit.OldLine-1] != edit.Text || b[edit.NewLine-1] != edit.Text {
+				t.Errorf("equal %q has wrong line numbers %d/%d", edit.Text, edit.OldLine, edit.NewLine)
+			}
+		case Delete:
+			if edit.NewLine != 0 || a[edit.OldLine-1] != edit.Text {
+				t.Errorf("deleted %q has wrong line numbers %d/%d", edit.Text, edit.OldLine, edit.NewLine)
+			}
+		case Insert:
+			if edit.OldLine != 0 || b[edit.NewLine-1] != edit.Text {
+				t.Errorf("inserted %q has wrong line numbers %d/%d", edit.Text, edit.OldLine, edit.NewLine)
+			}
+		}
+	}
+}
+
+func TestLinesIsMinimal(t *testing.T) {
+	// A positional comparison would report every line after the insertion as changed
+	a := strings.Fields("1 2 3 4 5 6 7 8 9")
+	b := append([]string{"0"}, a...)
+
+	changes := 0
+	for _, edit := range Lines(a, b) {
+		if edit.Kind != Equal {
+			changes++
+		}
+	}
+	if changes != 1 {
+		t.Errorf("got %d changes for a single inserted line, want 1", changes)
+	}
+}
+
+func TestLinesTooDifferent(t *testing.T) {
+	var a, b []string
+	for i := 0; i < maxEditDistance; i++ {
+		a = append(a, "a")
+		b = append(b, "b")
+	}
+
+	edits := Lines(a, b)
+	if len(edits) != 2*maxEditDistance {
+		t.Fatalf("got %d edits, want %d", len(edits), 2*maxEditDistance)
+	}
+	for i, edit := range edits {
+		if (i < maxEditDistance) != (edit.Kind == Delete) {
+			t.Fatalf("edit %d is %q, want all deletions before all insertions", i, edit.String())
+		}
+	}
+}
+
+func TestHunks(t *testing.T) {
+	a := strings.Fields("1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 17 18 19 20")
+	tests := []struct {
+		name    string
+		b       string
+		context int
+		want    []string
+	}{
+		{
+			name:    "single change",
+			b:       "1 2 3 4 5 6 7 8 9 X 11 12 13 14 15 16 17 18 19 20",
+			context: 2,
+			want:    []string{"@@ -8,5 +8,5 @@"},
+		},
+		{
+			name:    "change at top",
+			b:       "0 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 17 18 19 20",
+			context: 3,
+			want:    []string{"@@ -1,3 +1,4 @@"},
+		},
+		{
+			name:    "deletion at end",
+			b:       "1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 17 18 19",
+			context: 3,
+			want:    []string{"@@ -17,4 +17,3 @@"},
+		},
+		{
+			name:    "nearby changes share a hunk",
+			b:       "1 2 3 4 X 6 7 8 9 Y 11 12 13 14 15 16 17 18 19 20",
+			context: 2,
+			want:    []string{"@@ -3,10 +3,10 @@"},
+		},
+		{
+			name:    "distant changes get their own hunks",
+			b:       "1 2 X 4 5 6 7 8 9 10 11 12 13 14 15 16 17 Y 19 20",
+			context: 3,
+			want:    []string{"@@ -1,6 +1,6 @@", "@@ -15,6 +15,6 @@"},
+		},
+		{
+			name:    "insertion without context",
+			b:       "1 2 3 4 5 X 6 7 8 9 10 11 12 13 14 15 16 17 18 19 20",
+			context: 0,
+			want:    []string{"@@ -5,0 +6 @@"},
+		},
+		{
+			name:    "deletion without context",
+			b:       "1 2 3 4 6 7 8 9 10 11 12 13 14 15 16 17 18 19 20",
+			context: 0,
+			want:    []string{"@@ -5 +4,0 @@"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, hunk := range Hunks(Lines(a, strings.Fields(tt.b)), tt.context) {
+				got = append(got, hunk.Header())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hunk headers = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnified(t *testing.T) {
+	oldText := "set number\nset hidden\nsyntax on\n"
+	newText := "let mapleader = ' '\nset number\nsyntax on\n"
+
+	want := `--- old
++++ new
+@@ -1,3 +1,3 @@
++let mapleader = ' '
+ set number
+-set hidden
+ syntax on
+`
+	if got := Unified("old", "new", oldText, newText, 3); got != want {
+		t.Errorf("Unified() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestUnifiedIdentical(t *testing.T) {
+	if got := Unified("old", "new", "a\nb\n", "a\nb\n", 3); got != "" {
+		t.Errorf("Unified() of identical texts = %q, want empty", got)
+	}
+}
+
+func TestUnifiedTrailingNewline(t *testing.T) {
+	got := Unified("old", "new", "a\nb", "a\nb\n", 3)
+	if !strings.Contains(got, "newline at end of file") {
+		t.Errorf("Unified() = %q, want a note about the trailing newline", got)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"os/user"
@@ -12,18 +13,29 @@ import (
 	"strings"
 	"time"
 
+	"github.com/yourusername/dotctl/internal/diff"
 	"gopkg.in/yaml.v3"
 )
 
 type PackageConfig struct {
-	Systems     []string `yaml:"systems,omitempty" json:"systems,omitempty"`
-	Description string   `yaml:"description,omitempty" json:"description,omitempty"`
-	Home        bool     `yaml:"home,omitempty" json:"home,omitempty"`
+	Systems     []string          `yaml:"systems,omitempty" json:"systems,omitempty"`
+	When        []string          `yaml:"when,omitempty" json:"when,omitempty"`
+	Description string            `yaml:"description,omitempty" json:"description,omitempty"`
+	Home        bool              `yaml:"home,omitempty" json:"home,omitempty"`
+	Target      string            `yaml:"target,omitempty" json:"target,omitempty"`
+	Files       map[string]string `yaml:"files,omitempty" json:"files,omitempty"`
+	Conflict    string            `yaml:"conflict,omitempty" json:"conflict,omitempty"`
+	Excludes    []string          `yaml:"excludes,omitempty" json:"excludes,omitempty"`
+	LinkMode    string            `yaml:"link_mode,omitempty" json:"link_mode,omitempty"`
+	Copy        []string          `yaml:"copy,omitempty" json:"copy,omitempty"`
+	Encrypted   []string          `yaml:"encrypted,omitempty" json:"encrypted,omitempty"`
 }
 
 type GitHubConfig struct {
 	Repository string `yaml:"repository,omitempty" json:"repository,omitempty"`
 	Branch     string `yaml:"branch,omitempty" json:"branch,omitempty"`
+
+	CommitPerPackage bool `yaml:"commit_per_package,omitempty" json:"commit_per_package,omitempty"` // Commit the changes to each package separately
 }
 
 type Config struct {
@@ -31,16 +43,33 @@ type Config struct {
 	GlobalExcludes []string               `yaml:"global_excludes" json:"global_excludes"`
 	StowOptions    []string               `yaml:"stow_options" json:"stow_options"`
 	GitHub         *GitHubConfig          `yaml:"github,omitempty" json:"github,omitempty"`
+	ConflictPolicy string                 `yaml:"conflict_policy,omitempty" json:"conflict_policy,omitempty"`
+	TemplateOutput string                 `yaml:"template_output,omitempty" json:"template_output,omitempty"`
+	Variables      *VariablesConfig       `yaml:"variables,omitempty" json:"variables,omitempty"`
+	Secrets        *SecretsConfig         `yaml:"secrets,omitempty" json:"secrets,omitempty"`
+	Encryption     *EncryptionConfig      `yaml:"encryption,omitempty" json:"encryption,omitempty"`
+	SecretScan     *SecretScanConfig      `yaml:"secret_scan,omitempty" json:"secret_scan,omitempty"`
 }
 
 type DotfilesManager struct {
 	DotfilesDir string
 	ConfigFile  string
+	TargetHome  string // Deploy into this directory instead of $HOME
 	System      string
 	Config      *Config
+	StateFile   string
+	State       *DeploymentState
+
+	out         io.Writer // Where messages are printed, stderr when stdout carries a plan
+	backupRunID string
+	tx          *deployTransaction
+	variables   map[string]string // Template variables, resolved on first use
+	secrets     *secretStore      // Secret providers, set up on first use
 }
 
-func NewDotfilesManager(dotfilesDir string) (*DotfilesManager, error) {
+// NewDotfilesManager sets up the manager for a dotfiles directory, printing
+// messages for the user to out
+func NewDotfilesManager(dotfilesDir, targetHome string, out io.Writer) (*DotfilesManager, error) {
 	if dotfilesDir == "" {
 		// First, check if we're already in a dotfiles directory (contains config file)
 		if cwd, err := os.Getwd(); err == nil {
@@ -50,10 +79,10 @@ func NewDotfilesManager(dotfilesDir string) (*DotfilesManager, error) {
 
 			if _, err := os.Stat(yamlConfigPath); err == nil {
 				dotfilesDir = cwd
-				fmt.Printf("Debug: Found dotctl.yaml in current directory: %s\n", yamlConfigPath)
+				fmt.Fprintf(out, "Debug: Found dotctl.yaml in current directory: %s\n", yamlConfigPath)
 			} else if _, err := os.Stat(jsonConfigPath); err == nil {
 				dotfilesDir = cwd
-				fmt.Printf("Debug: Found dotctl.json in current directory: %s\n", jsonConfigPath)
+				fmt.Fprintf(out, "Debug: Found dotctl.json in current directory: %s\n", jsonConfigPath)
 			}
 		}
 
@@ -64,10 +93,15 @@ func NewDotfilesManager(dotfilesDir string) (*DotfilesManager, error) {
 				return nil, fmt.Errorf("failed to get current user: %w", err)
 			}
 			dotfilesDir = filepath.Join(usr.HomeDir, ".dotfiles")
-			fmt.Printf("Debug: Using default dotfiles directory: %s\n", dotfilesDir)
+			fmt.Fprintf(out, "Debug: Using default dotfiles directory: %s\n", dotfilesDir)
 		}
 	} else {
-		fmt.Printf("Debug: Using specified dotfiles directory: %s\n", dotfilesDir)
+		fmt.Fprintf(out, "Debug: Using specified dotfiles directory: %s\n", dotfilesDir)
+	}
+
+	// State entries and symlinks need an absolute dotfiles path
+	if absDir, err := filepath.Abs(dotfilesDir); err == nil {
+		dotfilesDir = absDir
 	}
 
 	// Determine config file path (prefer YAML, fallback to JSON)
@@ -79,10 +113,20 @@ func NewDotfilesManager(dotfilesDir string) (*DotfilesManager, error) {
 		}
 	}
 
+	if targetHome != "" {
+		absHome, err := filepath.Abs(targetHome)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target home %s: %w", targetHome, err)
+		}
+		targetHome = absHome
+	}
+
 	manager := &DotfilesManager{
 		DotfilesDir: dotfilesDir,
 		ConfigFile:  configFile,
+		TargetHome:  targetHome,
 		System:      detectSystem(),
+		out:         out,
 	}
 
 	config, err := manager.loadConfig()
@@ -91,6 +135,19 @@ func NewDotfilesManager(dotfilesDir string) (*DotfilesManager, error) {
 	}
 	manager.Config = config
 
+	stateFile, err := manager.defaultStateFile()
+	if err != nil {
+		return nil, err
+	}
+	manager.StateFile = stateFile
+
+	state, err := manager.loadState()
+	if err != nil {
+		fmt.Fprintf(out, "Warning: %v\n", err)
+		state = &DeploymentState{Version: deploymentStateVersion}
+	}
+	manager.State = state
+
 	return manager, nil
 }
 
@@ -128,9 +185,9 @@ func detectLinuxDistro() string {
 }
 
 func (dm *DotfilesManager) loadConfig() (*Config, error) {
-	usr, err := user.Current()
+	homeDir, err := dm.homeDir()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get current user: %w", err)
+		return nil, err
 	}
 
 	defaultConfig := &Config{
@@ -146,7 +203,7 @@ func (dm *DotfilesManager) loadConfig() (*Config, error) {
 
 	data, err := os.ReadFile(dm.ConfigFile)
 	if err != nil {
-		fmt.Printf("Warning: Could not read config file %s: %v\n", dm.ConfigFile, err)
+		fmt.Fprintf(dm.out, "Warning: Could not read config file %s: %v\n", dm.ConfigFile, err)
 		return defaultConfig, nil
 	}
 
@@ -157,21 +214,21 @@ func (dm *DotfilesManager) loadConfig() (*Config, error) {
 
 	if isYAML {
 		if err := yaml.Unmarshal(data, &config); err != nil {
-			fmt.Printf("Error parsing YAML config: %v\n", err)
-			fmt.Printf("Config file content: %s\n", string(data))
+			fmt.Fprintf(dm.out, "Error parsing YAML config: %v\n", err)
+			fmt.Fprintf(dm.out, "Config file content: %s\n", string(data))
 			return defaultConfig, nil
 		}
 	} else {
 		// JSON parsing
 		if err := json.Unmarshal(data, &config); err != nil {
-			fmt.Printf("Error parsing JSON config: %v\n", err)
-			fmt.Printf("Config file content: %s\n", string(data))
+			fmt.Fprintf(dm.out, "Error parsing JSON config: %v\n", err)
+			fmt.Fprintf(dm.out, "Config file content: %s\n", string(data))
 			return defaultConfig, nil
 		}
 
 		// If we successfully loaded a JSON config, migrate it to YAML
 		if err := dm.migrateJSONToYAML(&config); err != nil {
-			fmt.Printf("Warning: Failed to migrate JSON config to YAML: %v\n", err)
+			fmt.Fprintf(dm.out, "Warning: Failed to migrate JSON config to YAML: %v\n", err)
 		} else {
 			// Migration successful, reload the config from the new YAML file
 			return dm.loadConfig()
@@ -191,7 +248,7 @@ func (dm *DotfilesManager) loadConfig() (*Config, error) {
 
 	// Always ensure the target directory in stow options matches the current user's home directory
 	// This fixes issues when moving configs between different systems (macOS vs Linux)
-	config.StowOptions = updateStowTargetOption(config.StowOptions, usr.HomeDir)
+	config.StowOptions = updateStowTargetOption(config.StowOptions, homeDir)
 
 	return &config, nil
 }
@@ -233,7 +290,7 @@ func (dm *DotfilesManager) migrateJSONToYAML(config *Config) error {
 	jsonPath := dm.ConfigFile
 	yamlPath := strings.TrimSuffix(jsonPath, ".json") + ".yaml"
 
-	fmt.Printf("Migrating configuration from JSON to YAML...\n")
+	fmt.Fprintf(dm.out, "Migrating configuration from JSON to YAML...\n")
 
 	// Update the config file path to YAML
 	dm.ConfigFile = yamlPath
@@ -245,9 +302,9 @@ func (dm *DotfilesManager) migrateJSONToYAML(config *Config) error {
 
 	// Remove the old JSON file
 	if err := os.Remove(jsonPath); err != nil {
-		fmt.Printf("Warning: Could not remove old JSON config file: %v\n", err)
+		fmt.Fprintf(dm.out, "Warning: Could not remove old JSON config file: %v\n", err)
 	} else {
-		fmt.Printf("✓ Successfully migrated config from %s to %s\n",
+		fmt.Fprintf(dm.out, "✓ Successfully migrated config from %s to %s\n",
 			filepath.Base(jsonPath), filepath.Base(yamlPath))
 	}
 
@@ -276,7 +333,7 @@ func (dm *DotfilesManager) getPackagesForSystem(system string) []string {
 
 	var packages []string
 	for packageName, packageConfig := range dm.Config.Packages {
-		if shouldDeployPackage(packageConfig, system) {
+		if dm.shouldDeployPackage(packageConfig, system) {
 			packages = append(packages, packageName)
 		}
 	}
@@ -285,29 +342,25 @@ func (dm *DotfilesManager) getPackagesForSystem(system string) []string {
 	return packages
 }
 
-func shouldDeployPackage(packageConfig interface{}, system string) bool {
+// shouldDeployPackage reports whether a package is meant for this machine when
+// it runs system. Both its systems and its when conditions must match, each
+// by at least one entry.
+func (dm *DotfilesManager) shouldDeployPackage(packageConfig interface{}, system string) bool {
 	switch config := packageConfig.(type) {
 	case string:
-		return config == "all" || config == system
+		return dm.matchesAnyCondition([]string{config}, system)
 	case map[string]interface{}:
-		systemsInterface, exists := config["systems"]
-		if !exists {
-			return true // Default to all systems
-		}
-
-		systemsSlice, ok := systemsInterface.([]interface{})
-		if !ok {
-			return false
-		}
-
-		for _, sys := range systemsSlice {
-			if sysStr, ok := sys.(string); ok {
-				if sysStr == "all" || sysStr == system {
-					return true
-				}
+		for _, key := range []string{"systems", "when"} {
+			value, exists := config[key]
+			if !exists {
+				continue // Default to all systems
+			}
+			conditions, ok := conditionList(value)
+			if !ok || !dm.matchesAnyCondition(conditions, system) {
+				return false
 			}
 		}
-		return false
+		return true
 	default:
 		return false
 	}
@@ -330,13 +383,11 @@ func (dm *DotfilesManager) getPackageConfig(packageName string) *PackageConfig {
 		packageConfig := &PackageConfig{}
 
 		if systemsInterface, exists := config["systems"]; exists {
-			if systemsSlice, ok := systemsInterface.([]interface{}); ok {
-				for _, sys := range systemsSlice {
-					if sysStr, ok := sys.(string); ok {
-						packageConfig.Systems = append(packageConfig.Systems, sysStr)
-					}
-				}
-			}
+			packageConfig.Systems, _ = conditionList(systemsInterface)
+		}
+
+		if whenInterface, exists := config["when"]; exists {
+			packageConfig.When, _ = conditionList(whenInterface)
 		}
 
 		if descInterface, exists := config["description"]; exists {
@@ -351,6 +402,65 @@ func (dm *DotfilesManager) getPackageConfig(packageName string) *PackageConfig {
 			}
 		}
 
+		if targetInterface, exists := config["target"]; exists {
+			if target, ok := targetInterface.(string); ok {
+				packageConfig.Target = target
+			}
+		}
+
+		if filesInterface, exists := config["files"]; exists {
+			if filesMap, ok := filesInterface.(map[string]interface{}); ok {
+				packageConfig.Files = make(map[string]string)
+				for source, destination := range filesMap {
+					if destinationStr, ok := destination.(string); ok {
+						packageConfig.Files[source] = destinationStr
+					}
+				}
+			}
+		}
+
+		if conflictInterface, exists := config["conflict"]; exists {
+			if conflict, ok := conflictInterface.(string); ok {
+				packageConfig.Conflict = conflict
+			}
+		}
+
+		if linkModeInterface, exists := config["link_mode"]; exists {
+			if linkMode, ok := linkModeInterface.(string); ok {
+				packageConfig.LinkMode = linkMode
+			}
+		}
+
+		if copyInterface, exists := config["copy"]; exists {
+			if copySlice, ok := copyInterface.([]interface{}); ok {
+				for _, pattern := range copySlice {
+					if patternStr, ok := pattern.(string); ok {
+						packageConfig.Copy = append(packageConfig.Copy, patternStr)
+					}
+				}
+			}
+		}
+
+		if encryptedInterface, exists := config["encrypted"]; exists {
+			if encryptedSlice, ok := encryptedInterface.([]interface{}); ok {
+				for _, pattern := range encryptedSlice {
+					if patternStr, ok := pattern.(string); ok {
+						packageConfig.Encrypted = append(packageConfig.Encrypted, patternStr)
+					}
+				}
+			}
+		}
+
+		if excludesInterface, exists := config["excludes"]; exists {
+			if excludesSlice, ok := excludesInterface.([]interface{}); ok {
+				for _, exclude := range excludesSlice {
+					if excludeStr, ok := exclude.(string); ok {
+						packageConfig.Excludes = append(packageConfig.Excludes, excludeStr)
+					}
+				}
+			}
+		}
+
 		return packageConfig
 	default:
 		return nil
@@ -369,10 +479,18 @@ func (dm *DotfilesManager) scanPackages() ([]string, error) {
 		return nil, fmt.Errorf("failed to read dotfiles directory: %w", err)
 	}
 
+	excludes, err := dm.globalExcludes()
+	if err != nil {
+		return nil, err
+	}
+
 	for _, entry := range entries {
 		name := entry.Name()
-		// Skip git directory, config files, and cache directories
-		if name == ".git" || name == "dotctl.json" || name == "__pycache__" || strings.HasSuffix(name, ".tmp") {
+		// Skip git directory, config files, partials, and cache directories
+		if name == ".git" || name == "dotctl.json" || name == partialsDir || name == "__pycache__" || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		if excludes.matches(name, entry.IsDir()) {
 			continue
 		}
 
@@ -416,131 +534,21 @@ func (dm *DotfilesManager) deployPackage(packageName string, dryRun bool) error
 }
 
 func (dm *DotfilesManager) deployPackageWithOptions(packageName string, dryRun bool, interactive bool) error {
-	packageDir := filepath.Join(dm.DotfilesDir, packageName)
-
-	if _, err := os.Stat(packageDir); os.IsNotExist(err) {
-		return fmt.Errorf("package '%s' not found at %s", packageName, packageDir)
-	}
-
-	// Determine target directory and symlink path
-	usr, err := user.Current()
-	if err != nil {
-		return fmt.Errorf("failed to get current user: %w", err)
-	}
-
-	var targetDir string
-	var symlinkPath string
-
-	// Check if package has home setting enabled
-	packageConfig := dm.getPackageConfig(packageName)
-	if packageConfig != nil && packageConfig.Home {
-		// Home setting enabled - symlink to $HOME directory
-		targetDir = usr.HomeDir
-		symlinkPath = filepath.Join(targetDir, packageName)
-	} else if isConfigPackage(packageName) {
-		// Config packages go to ~/.config/PACKAGE_NAME
-		targetDir = filepath.Join(usr.HomeDir, ".config")
-		symlinkPath = filepath.Join(targetDir, packageName)
-	} else {
-		// Home packages: handle special cases
-		if packageName == "shell" {
-			// Shell package contents go directly to home directory
-			return dm.deployShellPackageWithOptions(packageDir, usr.HomeDir, dryRun, interactive)
-		} else {
-			// Other home packages (like .oh-my-zsh) go to ~/PACKAGE_NAME
-			targetDir = usr.HomeDir
-			symlinkPath = filepath.Join(targetDir, packageName)
-		}
-	}
-
-	// Ensure target directory exists
-	if err := os.MkdirAll(targetDir, 0755); err != nil {
-		return fmt.Errorf("failed to create target directory %s: %w", targetDir, err)
-	}
-
-	if dryRun {
-		fmt.Printf("DRY RUN: Would create symlink %s -> %s\n", symlinkPath, packageDir)
-		return nil
-	}
-
-	fmt.Printf("Deploying %s...\n", packageName)
-
-	// Check if symlink already exists
-	if _, err := os.Lstat(symlinkPath); err == nil {
-		// Remove existing symlink or file
-		if err := os.Remove(symlinkPath); err != nil {
-			return fmt.Errorf("failed to remove existing %s: %w", symlinkPath, err)
-		}
-	}
-
-	// Check if package contains templates
-	if err := dm.processPackageTemplatesWithOptions(packageDir, dryRun, interactive); err != nil {
-		return fmt.Errorf("failed to process templates in %s: %w", packageName, err)
-	}
-
-	// Create the symlink
-	relativePackageDir, err := filepath.Rel(targetDir, packageDir)
-	if err != nil {
-		return fmt.Errorf("failed to calculate relative path: %w", err)
-	}
-
-	if err := os.Symlink(relativePackageDir, symlinkPath); err != nil {
-		return fmt.Errorf("failed to create symlink %s -> %s: %w", symlinkPath, relativePackageDir, err)
+	plan := dm.newPlan("deploy")
+	plan.Packages = []string{packageName}
+	if err := dm.planPackageDeploy(plan, packageName, interactive && !dryRun); err != nil {
+		return err
 	}
-
-	fmt.Printf("✓ Successfully deployed %s\n", packageName)
-	fmt.Printf("LINK: %s -> %s\n", symlinkPath, relativePackageDir)
-
-	return nil
+	return dm.runPlan(plan, dryRun, false, 0)
 }
 
 func (dm *DotfilesManager) undeployPackage(packageName string, dryRun bool) error {
-	// Determine target directory and symlink path
-	usr, err := user.Current()
-	if err != nil {
-		return fmt.Errorf("failed to get current user: %w", err)
-	}
-
-	var symlinkPath string
-
-	// Check if package has home setting enabled
-	packageConfig := dm.getPackageConfig(packageName)
-	if packageConfig != nil && packageConfig.Home {
-		// Home setting enabled - symlink is in $HOME directory
-		symlinkPath = filepath.Join(usr.HomeDir, packageName)
-	} else if isConfigPackage(packageName) {
-		// Config packages are at ~/.config/PACKAGE_NAME
-		symlinkPath = filepath.Join(usr.HomeDir, ".config", packageName)
-	} else {
-		if packageName == "shell" {
-			// Shell package: remove individual files from home directory
-			return dm.undeployShellPackage(filepath.Join(dm.DotfilesDir, packageName), usr.HomeDir, dryRun)
-		} else {
-			// Other home packages are at ~/PACKAGE_NAME
-			symlinkPath = filepath.Join(usr.HomeDir, packageName)
-		}
-	}
-
-	if dryRun {
-		fmt.Printf("DRY RUN: Would remove symlink %s\n", symlinkPath)
-		return nil
-	}
-
-	fmt.Printf("Undeploying %s...\n", packageName)
-
-	// Check if symlink exists
-	if _, err := os.Lstat(symlinkPath); os.IsNotExist(err) {
-		fmt.Printf("✓ %s is not deployed\n", packageName)
-		return nil
-	}
-
-	// Remove the symlink
-	if err := os.Remove(symlinkPath); err != nil {
-		return fmt.Errorf("failed to remove symlink %s: %w", symlinkPath, err)
+	plan := dm.newPlan("undeploy")
+	plan.Packages = []string{packageName}
+	if err := dm.planPackageUndeploy(plan, packageName); err != nil {
+		return err
 	}
-
-	fmt.Printf("✓ Successfully undeployed %s\n", packageName)
-	return nil
+	return dm.runPlan(plan, dryRun, false, 0)
 }
 func (dm *DotfilesManager) deployAll(packages []string, dryRun bool) {
 	dm.deployAllWithOptions(packages, dryRun, false)
@@ -553,23 +561,19 @@ func (dm *DotfilesManager) deployAllWithOptions(packages []string, dryRun bool,
 
 	if len(packages) == 0 {
 		fmt.Printf("No packages configured for system '%s'\n", dm.System)
-		fmt.Printf("\nTo diagnose this issue, run: dotctl debug\n")
+		fmt.Printf("\nTo diagnose this issue, run: dotctl doctor\n")
 		fmt.Printf("Or check your configuration with: dotctl status\n")
 		return
 	}
 
 	fmt.Printf("Deploying packages for %s: %s\n", dm.System, strings.Join(packages, ", "))
 
-	successCount := 0
-	for _, pkg := range packages {
-		if err := dm.deployPackageWithOptions(pkg, dryRun, interactive); err != nil {
-			fmt.Printf("✗ %v\n", err)
-		} else {
-			successCount++
-		}
+	plan, planErrors := dm.planDeploy(packages, interactive && !dryRun)
+	for _, err := range planErrors {
+		fmt.Printf("✗ %v\n", err)
 	}
 
-	fmt.Printf("\nDeployment complete: %d/%d packages successful\n", successCount, len(packages))
+	dm.runPlan(plan, dryRun, false, len(planErrors))
 }
 
 func (dm *DotfilesManager) undeployAll(packages []string, dryRun bool) {
@@ -584,19 +588,17 @@ func (dm *DotfilesManager) undeployAll(packages []string, dryRun bool) {
 
 	fmt.Printf("Undeploying packages: %s\n", strings.Join(packages, ", "))
 
-	successCount := 0
-	for _, pkg := range packages {
-		if err := dm.undeployPackage(pkg, dryRun); err != nil {
-			fmt.Printf("✗ %v\n", err)
-		} else {
-			successCount++
-		}
+	plan, planErrors := dm.planUndeploy(packages)
+	for _, err := range planErrors {
+		fmt.Printf("✗ %v\n", err)
 	}
 
-	fmt.Printf("\nUndeployment complete: %d/%d packages successful\n", successCount, len(packages))
+	dm.runPlan(plan, dryRun, false, len(planErrors))
 }
 
-func (dm *DotfilesManager) status() error {
+// status prints the configuration and deployment state of every package. It
+// reports whether any deployable package has drifted from what deploy would produce.
+func (dm *DotfilesManager) status(verbose bool) (bool, error) {
 	fmt.Printf("Dotfiles directory: %s\n", dm.DotfilesDir)
 	fmt.Printf("Current system: %s\n", dm.System)
 	// GNU stow no longer required - using native symlinks
@@ -614,7 +616,7 @@ func (dm *DotfilesManager) status() error {
 
 	allPackages, err := dm.scanPackages()
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	configuredPackages := make(map[string]bool)
@@ -627,19 +629,66 @@ func (dm *DotfilesManager) status() error {
 		deployablePackages[pkg] = true
 	}
 
+	drifted := false
 	fmt.Println("Package status:")
 	for _, pkg := range allPackages {
 		var statusParts []string
+		var files []fileStatus
 		if configuredPackages[pkg] {
 			if deployablePackages[pkg] {
 				statusParts = append(statusParts, "✓ deployable")
+
+				files, err = dm.inspectPackage(pkg)
+				if err != nil {
+					statusParts = append(statusParts, fmt.Sprintf("✗ %v", err))
+					drifted = true
+				} else {
+					summary, packageDrifted := summarizeFiles(files)
+					statusParts = append(statusParts, summary)
+					drifted = drifted || packageDrifted
+				}
 			} else {
 				statusParts = append(statusParts, "- not for this system")
 			}
 		} else {
 			statusParts = append(statusParts, "? not configured")
 		}
+		if !deployablePackages[pkg] {
+			if entries := dm.State.entriesForPackage(pkg); len(entries) > 0 {
+				statusParts = append(statusParts, fmt.Sprintf("deployed (%d entries)", len(entries)))
+			}
+		}
 		fmt.Printf("  %s: %s\n", pkg, strings.Join(statusParts, ", "))
+
+		// Files of a package that is not deployed at all are only listed on request
+		notDeployed := true
+		for _, file := range files {
+			notDeployed = notDeployed && file.State == fileNotDeployed
+		}
+		for _, file := range files {
+			switch {
+			case file.State == fileDeployed:
+				if verbose {
+					fmt.Printf("    ✓ %s\n", file.Target)
+				}
+			case file.Detail != "":
+				fmt.Printf("    ✗ %s: %s (%s)\n", file.Target, file.State, file.Detail)
+			case verbose || !notDeployed:
+				fmt.Printf("    ✗ %s: %s\n", file.Target, file.State)
+			}
+		}
+	}
+
+	// Show deployments recorded for packages that no longer exist in config
+	var staleDeployments []string
+	for _, pkg := range dm.State.packages() {
+		if !configuredPackages[pkg] {
+			staleDeployments = append(staleDeployments, pkg)
+		}
+	}
+	if len(staleDeployments) > 0 {
+		fmt.Printf("\nDeployed but no longer configured: %s\n", strings.Join(staleDeployments, ", "))
+		fmt.Println("Run 'dotctl cleanup' to remove their links")
 	}
 
 	// Show orphaned config entries
@@ -662,7 +711,10 @@ func (dm *DotfilesManager) status() error {
 		fmt.Printf("\nOrphaned config entries: %s\n", strings.Join(orphaned, ", "))
 	}
 
-	return nil
+	if drifted {
+		fmt.Println("\nDeployment drift detected, run 'dotctl deploy' to bring packages up to date")
+	}
+	return drifted, nil
 }
 
 func (dm *DotfilesManager) addPackage(packageName string, systems []string) error {
@@ -701,16 +753,27 @@ func (dm *DotfilesManager) removePackage(packageName string) error {
 	return nil
 }
 
-func (dm *DotfilesManager) adoptConfigDirectories(dryRun bool, args []string) error {
-	usr, err := user.Current()
-	if err != nil {
-		return fmt.Errorf("failed to get current user: %w", err)
+func (dm *DotfilesManager) adoptConfigDirectories(dryRun bool, encrypt bool, args []string) error {
+	plan, err := dm.planAdopt(args, encrypt)
+	if err != nil || plan == nil {
+		return err
 	}
 
-	configDir := filepath.Join(usr.HomeDir, ".config")
+	fmt.Println()
+	return dm.runPlan(plan, dryRun, false, 0)
+}
+
+// planAdopt finds unmanaged directories in $XDG_CONFIG_HOME and plans moving
+// them into the dotfiles directory. With encrypt, sensitive files in them are
+// stored encrypted. It returns a nil plan when there is nothing to adopt.
+func (dm *DotfilesManager) planAdopt(args []string, encrypt bool) (*DeploymentPlan, error) {
+	configDir, err := dm.configHome()
+	if err != nil {
+		return nil, err
+	}
 	if _, err := os.Stat(configDir); os.IsNotExist(err) {
-		fmt.Println("No ~/.config directory found")
-		return nil
+		fmt.Fprintf(dm.out, "No %s directory found\n", configDir)
+		return nil, nil
 	}
 
 	// Parse arguments: first arg might be package name, rest are systems
@@ -743,6 +806,11 @@ func (dm *DotfilesManager) adoptConfigDirectories(dryRun bool, args []string) er
 		}
 	}
 
+	excludes, err := dm.globalExcludes()
+	if err != nil {
+		return nil, err
+	}
+
 	var newPackages []string
 
 	if len(targetPackages) > 0 {
@@ -750,20 +818,25 @@ func (dm *DotfilesManager) adoptConfigDirectories(dryRun bool, args []string) er
 		for _, packageName := range targetPackages {
 			// Skip if already managed
 			if managedPackages[packageName] {
-				fmt.Printf("Package '%s' is already managed\n", packageName)
+				fmt.Fprintf(dm.out, "Package '%s' is already managed\n", packageName)
 				continue
 			}
 
 			// Check if it's already a symlink
 			configPath := filepath.Join(configDir, packageName)
 			if info, err := os.Lstat(configPath); err == nil && info.Mode()&os.ModeSymlink != 0 {
-				fmt.Printf("Package '%s' is already a symlink\n", packageName)
+				fmt.Fprintf(dm.out, "Package '%s' is already a symlink\n", packageName)
 				continue
 			}
 
 			// Check if directory exists
 			if _, err := os.Stat(configPath); os.IsNotExist(err) {
-				fmt.Printf("Package '%s' not found in ~/.config\n", packageName)
+				fmt.Fprintf(dm.out, "Package '%s' not found in %s\n", packageName, configDir)
+				continue
+			}
+
+			if excludes.matches(packageName, true) {
+				fmt.Fprintf(dm.out, "Package '%s' matches global_excludes\n", packageName)
 				continue
 			}
 
@@ -773,7 +846,7 @@ func (dm *DotfilesManager) adoptConfigDirectories(dryRun bool, args []string) er
 		// Adopt all unmanaged packages
 		entries, err := os.ReadDir(configDir)
 		if err != nil {
-			return fmt.Errorf("failed to read ~/.config directory: %w", err)
+			return nil, fmt.Errorf("failed to read %s: %w", configDir, err)
 		}
 
 		for _, entry := range entries {
@@ -789,7 +862,7 @@ func (dm *DotfilesManager) adoptConfigDirectories(dryRun bool, args []string) er
 			}
 
 			// Skip common non-package directories
-			if shouldSkipDirectory(packageName) {
+			if shouldSkipDirectory(packageName) || excludes.matches(packageName, true) {
 				continue
 			}
 
@@ -805,81 +878,47 @@ func (dm *DotfilesManager) adoptConfigDirectories(dryRun bool, args []string) er
 
 	if len(newPackages) == 0 {
 		if len(targetPackages) > 0 {
-			fmt.Println("No specified packages available to adopt")
+			fmt.Fprintln(dm.out, "No specified packages available to adopt")
 		} else {
-			fmt.Println("No new config directories found to adopt")
+			fmt.Fprintln(dm.out, "No new config directories found to adopt")
 		}
-		return nil
+		return nil, nil
 	}
 
 	if len(targetPackages) > 0 {
-		fmt.Printf("Adopting specific package(s): %s\n", strings.Join(newPackages, ", "))
+		fmt.Fprintf(dm.out, "Adopting specific package(s): %s\n", strings.Join(newPackages, ", "))
 	} else {
-		fmt.Printf("Found %d new config directories to adopt:\n", len(newPackages))
+		fmt.Fprintf(dm.out, "Found %d new config directories to adopt:\n", len(newPackages))
 		for _, pkg := range newPackages {
-			fmt.Printf("  - %s\n", pkg)
+			fmt.Fprintf(dm.out, "  - %s\n", pkg)
 		}
 	}
 
-	if dryRun {
-		fmt.Printf("\nDRY RUN: Would adopt these packages for systems: %s\n", strings.Join(systems, ", "))
-		return nil
-	}
-
-	fmt.Printf("\nAdopting packages for systems: %s\n", strings.Join(systems, ", "))
-
-	// Adopt each package
-	adoptedCount := 0
+	plan := dm.newPlan("adopt")
+	plan.Packages = newPackages
 	for _, packageName := range newPackages {
-		if err := dm.adoptSinglePackage(packageName, systems, configDir); err != nil {
-			fmt.Printf("✗ Failed to adopt %s: %v\n", packageName, err)
-		} else {
-			adoptedCount++
-			fmt.Printf("✓ Adopted %s\n", packageName)
-		}
-	}
-
-	// Save updated configuration
-	if err := dm.saveConfig(nil); err != nil {
-		return fmt.Errorf("failed to save configuration: %w", err)
-	}
-
-	fmt.Printf("\nSuccessfully adopted %d/%d packages\n", adoptedCount, len(newPackages))
-	return nil
-}
-func (dm *DotfilesManager) adoptSinglePackage(packageName string, systems []string, configDir string) error {
-	sourcePath := filepath.Join(configDir, packageName)
-	targetPath := filepath.Join(dm.DotfilesDir, packageName)
+		sourcePath := filepath.Join(configDir, packageName)
+		targetPath := filepath.Join(dm.DotfilesDir, packageName)
 
-	// Move the directory from ~/.config to ~/.dotfiles
-	if err := os.Rename(sourcePath, targetPath); err != nil {
-		return fmt.Errorf("failed to move %s to dotfiles: %w", packageName, err)
-	}
-
-	// Create symlink back to ~/.config
-	relativeTargetPath, err := filepath.Rel(configDir, targetPath)
-	if err != nil {
-		return fmt.Errorf("failed to calculate relative path: %w", err)
-	}
-
-	if err := os.Symlink(relativeTargetPath, sourcePath); err != nil {
-		// Try to move back if symlink fails
-		os.Rename(targetPath, sourcePath)
-		return fmt.Errorf("failed to create symlink: %w", err)
-	}
-
-	// Add to configuration
-	if len(systems) == 1 && isSimpleSystem(systems[0]) {
-		dm.Config.Packages[packageName] = systems[0]
-	} else {
-		dm.Config.Packages[packageName] = map[string]interface{}{
-			"systems": systems,
+		// Move the directory from ~/.config to ~/.dotfiles and symlink it back
+		plan.add(Operation{Type: opMove, Package: packageName, Source: sourcePath, Target: targetPath})
+		encrypting, err := dm.planAdoptEncryption(plan, packageName, sourcePath, targetPath, encrypt)
+		if err != nil {
+			return nil, err
+		}
+		if len(encrypting) > 0 {
+			// Linking the directory would expose the encrypted files, so they are placed file by file
+			if err := dm.planAdoptedFiles(plan, packageName, sourcePath, targetPath, encrypting); err != nil {
+				return nil, err
+			}
+		} else {
+			plan.add(Operation{Type: opLink, Package: packageName, Source: targetPath, Target: sourcePath})
 		}
+		plan.add(Operation{Type: opAdopt, Package: packageName, Systems: systems})
 	}
 
-	return nil
+	return plan, nil
 }
-
 func shouldSkipDirectory(name string) bool {
 	// Skip common directories that shouldn't be managed
 	skipDirs := []string{
@@ -898,6 +937,11 @@ func shouldSkipDirectory(name string) bool {
 }
 
 func isKnownSystem(name string) bool {
+	// Host, user and CPU conditions can stand in for a system
+	if strings.Contains(name, ":") {
+		return validateAtom(name) == nil
+	}
+
 	knownSystems := []string{"all", "linux", "macos", "arch", "ubuntu", "debian", "fedora", "windows"}
 	for _, system := range knownSystems {
 		if name == system {
@@ -907,60 +951,6 @@ func isKnownSystem(name string) bool {
 	return false
 }
 
-func (dm *DotfilesManager) processTemplate(templatePath, outputPath string) error {
-	return dm.processTemplateWithOptions(templatePath, outputPath, false)
-}
-
-func (dm *DotfilesManager) processTemplateWithOptions(templatePath, outputPath string, interactive bool) error {
-	// Read template file
-	templateContent, err := os.ReadFile(templatePath)
-	if err != nil {
-		return fmt.Errorf("failed to read template file: %w", err)
-	}
-
-	// Process template with current system
-	processedContent := dm.processTemplateContent(string(templateContent))
-
-	// Check if output file already exists
-	if existingContent, err := os.ReadFile(outputPath); err == nil {
-		// File exists - check if content differs
-		if string(existingContent) == processedContent {
-			// Content is identical, no need to overwrite
-			return nil
-		}
-
-		// Content differs - handle based on mode
-		if interactive {
-			// Show diff and ask user
-			shouldOverwrite, err := dm.promptForTemplateOverwrite(templatePath, outputPath, string(existingContent), processedContent)
-			if err != nil {
-				return fmt.Errorf("failed to prompt for overwrite: %w", err)
-			}
-			if !shouldOverwrite {
-				fmt.Printf("TEMPLATE: Skipped %s (user declined overwrite)\n", outputPath)
-				return nil
-			}
-		} else {
-			// Non-interactive mode: always overwrite with warning
-			fmt.Printf("TEMPLATE: Overwriting existing file %s (template takes precedence)\n", outputPath)
-		}
-	}
-
-	// Track template overwrite for commit marking (before writing)
-	if existingContent, err := os.ReadFile(outputPath); err == nil {
-		if string(existingContent) != processedContent {
-			dm.trackTemplateOverwrite(outputPath)
-		}
-	}
-
-	// Write processed content to output file
-	if err := os.WriteFile(outputPath, []byte(processedContent), 0644); err != nil {
-		return fmt.Errorf("failed to write processed template: %w", err)
-	}
-
-	return nil
-}
-
 // Track template overwrites for commit marking
 var templateOverwrites []string
 
@@ -980,6 +970,7 @@ type TemplateMergeConflict struct {
 	LocalContent   string // Current local content of base file
 	RemoteBase     string // Remote version of base file (if exists)
 	RemoteTemplate string // Remote version of template file
+	LastRendered   string // Template output written at the last deploy (if recorded)
 }
 
 // detectTemplateMergeConflicts scans for conflicts between templates and base files
@@ -1003,10 +994,10 @@ func (dm *DotfilesManager) detectTemplateMergeConflicts() ([]TemplateMergeConfli
 
 		// Check if this is a template file
 		if strings.HasSuffix(info.Name(), ".template") {
-			basePath := strings.TrimSuffix(path, ".template")
+			basePath := dm.templateOutput(path)
 
 			// Check if base file exists
-			if _, err := os.Stat(basePath); err == nil {
+			if _, err := os.Stat(basePath); basePath != "" && err == nil {
 				// Base file exists - check for conflicts
 				localContent, err := os.ReadFile(basePath)
 				if err != nil {
@@ -1014,11 +1005,10 @@ func (dm *DotfilesManager) detectTemplateMergeConflicts() ([]TemplateMergeConfli
 				}
 
 				// Process template to see what it would generate
-				templateContent, err := os.ReadFile(path)
+				processedTemplate, err := dm.renderTemplateFile(path)
 				if err != nil {
-					return fmt.Errorf("failed to read template %s: %w", path, err)
+					return err
 				}
-				processedTemplate := dm.processTemplateContent(string(templateContent))
 
 				// If content differs, we have a potential merge conflict
 				if string(localContent) != processedTemplate {
@@ -1027,20 +1017,23 @@ func (dm *DotfilesManager) detectTemplateMergeConflicts() ([]TemplateMergeConfli
 						BasePath:     basePath,
 						LocalContent: string(localContent),
 					}
+					conflict.LastRendered, _ = dm.renderedBase(basePath)
 
 					// Try to get remote versions if in git repo
 					relBasePath, _ := filepath.Rel(dm.DotfilesDir, basePath)
 					relTemplatePath, _ := filepath.Rel(dm.DotfilesDir, path)
 
-					// Get remote base file content
-					cmd := exec.Command("git", "show", "origin/main:"+relBasePath)
-					cmd.Dir = dm.DotfilesDir
-					if output, err := cmd.Output(); err == nil {
-						conflict.RemoteBase = string(output)
+					// Get remote base file content, unless it is rendered outside the repository
+					if isWithin(basePath, dm.DotfilesDir) {
+						cmd := exec.Command("git", "show", "origin/main:"+relBasePath)
+						cmd.Dir = dm.DotfilesDir
+						if output, err := cmd.Output(); err == nil {
+							conflict.RemoteBase = string(output)
+						}
 					}
 
 					// Get remote template content
-					cmd = exec.Command("git", "show", "origin/main:"+relTemplatePath)
+					cmd := exec.Command("git", "show", "origin/main:"+relTemplatePath)
 					cmd.Dir = dm.DotfilesDir
 					if output, err := cmd.Output(); err == nil {
 						conflict.RemoteTemplate = string(output)
@@ -1065,8 +1058,10 @@ func (dm *DotfilesManager) promptForTemplateMerge(conflict TemplateMergeConflict
 	fmt.Println()
 
 	// Process current template to show what it would generate
-	templateContent, _ := os.ReadFile(conflict.TemplatePath)
-	newTemplateOutput := dm.processTemplateContent(string(templateContent))
+	newTemplateOutput, err := dm.renderTemplateFile(conflict.TemplatePath)
+	if err != nil {
+		return "", err
+	}
 
 	fmt.Println("Options:")
 	fmt.Println("  1. Keep local changes in base file (ignore template)")
@@ -1101,8 +1096,7 @@ func (dm *DotfilesManager) promptForTemplateMerge(conflict TemplateMergeConflict
 			return dm.promptForTemplateMerge(conflict)
 		}
 		// After updating template, regenerate base file
-		templateContent, _ := os.ReadFile(conflict.TemplatePath)
-		return dm.processTemplateContent(string(templateContent)), nil
+		return dm.renderMergedTemplate(conflict)
 
 	case "4":
 		// Merge base changes into template interactively
@@ -1111,8 +1105,7 @@ func (dm *DotfilesManager) promptForTemplateMerge(conflict TemplateMergeConflict
 			return dm.promptForTemplateMerge(conflict)
 		}
 		// After updating template, regenerate base file
-		templateContent, _ := os.ReadFile(conflict.TemplatePath)
-		return dm.processTemplateContent(string(templateContent)), nil
+		return dm.renderMergedTemplate(conflict)
 
 	case "5":
 		// Show diff
@@ -1144,46 +1137,26 @@ func (dm *DotfilesManager) promptForTemplateMerge(conflict TemplateMergeConflict
 	}
 }
 
-// showDiff displays a side-by-side comparison of two contents
-func (dm *DotfilesManager) showDiff(content1, content2, label1, label2 string) {
-	fmt.Printf("\n=== DIFF: %s vs %s ===\n", label1, label2)
-
-	lines1 := strings.Split(content1, "\n")
-	lines2 := strings.Split(content2, "\n")
-
-	fmt.Printf("--- %s\n", label1)
-	fmt.Printf("+++ %s\n\n", label2)
-
-	maxLines := len(lines1)
-	if len(lines2) > maxLines {
-		maxLines = len(lines2)
+// renderMergedTemplate renders a template changes were just merged into,
+// asking again how to resolve the conflict if it no longer renders
+func (dm *DotfilesManager) renderMergedTemplate(conflict TemplateMergeConflict) (string, error) {
+	output, err := dm.renderTemplateFile(conflict.TemplatePath)
+	if err != nil {
+		fmt.Printf("Error: the updated template does not render: %v\n", err)
+		return dm.promptForTemplateMerge(conflict)
 	}
+	return output, nil
+}
 
-	diffCount := 0
-	for i := 0; i < maxLines && diffCount < 20; i++ {
-		var line1, line2 string
-		if i < len(lines1) {
-			line1 = lines1[i]
-		}
-		if i < len(lines2) {
-			line2 = lines2[i]
-		}
-
-		if line1 != line2 {
-			if line1 != "" {
-				fmt.Printf("-%s\n", line1)
-			}
-			if line2 != "" {
-				fmt.Printf("+%s\n", line2)
-			}
-			diffCount++
-		}
-	}
+// showDiff displays a unified diff between two contents
+func (dm *DotfilesManager) showDiff(content1, content2, label1, label2 string) {
+	fmt.Printf("\n=== DIFF: %s vs %s ===\n", label1, label2)
 
-	if diffCount >= 20 {
-		fmt.Println("... (showing first 20 differences)")
+	output := diff.Unified(label1, label2, content1, content2, diffContext)
+	if output == "" {
+		fmt.Println("(no differences)")
 	}
-	fmt.Println()
+	fmt.Println(output)
 }
 
 // showThreeWayDiff shows local, remote base, and template output
@@ -1193,12 +1166,19 @@ func (dm *DotfilesManager) showThreeWayDiff(conflict TemplateMergeConflict) {
 	// Process remote template if available
 	var remoteTemplateOutput string
 	if conflict.RemoteTemplate != "" {
-		remoteTemplateOutput = dm.processTemplateContent(conflict.RemoteTemplate)
+		relPath, _ := filepath.Rel(dm.DotfilesDir, conflict.TemplatePath)
+		output, err := dm.processTemplateContent("origin/main:"+relPath, conflict.RemoteTemplate)
+		if err != nil {
+			fmt.Printf("Warning: remote template does not render: %v\n", err)
+		}
+		remoteTemplateOutput = output
 	}
 
 	// Process current local template
-	templateContent, _ := os.ReadFile(conflict.TemplatePath)
-	currentTemplateOutput := dm.processTemplateContent(string(templateContent))
+	currentTemplateOutput, err := dm.renderTemplateFile(conflict.TemplatePath)
+	if err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
 
 	fmt.Println("\n[1] LOCAL CHANGES (current base file):")
 	fmt.Println("---")
@@ -1260,12 +1240,21 @@ func (dm *DotfilesManager) resolveTemplateConflicts(conflicts []TemplateMergeCon
 			return err
 		}
 
-		// Write resolved content to base file
-		if err := os.WriteFile(conflict.BasePath, []byte(resolvedContent), 0644); err != nil {
+		// Write resolved content to base file, keeping its permissions
+		perm := os.FileMode(0644)
+		if info, err := os.Stat(conflict.BasePath); err == nil {
+			perm = info.Mode().Perm()
+		}
+		if err := os.WriteFile(conflict.BasePath, []byte(resolvedContent), perm); err != nil {
 			return fmt.Errorf("failed to write resolved content to %s: %w", conflict.BasePath, err)
 		}
 
-		// Stage the resolved file
+		// Stage the resolved file, unless it is rendered outside the repository
+		if !isWithin(conflict.BasePath, dm.DotfilesDir) {
+			fmt.Printf("✓ Resolved %s\n", conflict.BasePath)
+			resolvedCount++
+			continue
+		}
 		relPath, _ := filepath.Rel(dm.DotfilesDir, conflict.BasePath)
 		if err := dm.runGitCommand("add", relPath); err != nil {
 			return fmt.Errorf("failed to stage resolved file: %w", err)
@@ -1286,215 +1275,143 @@ func (dm *DotfilesManager) resolveTemplateConflicts(conflicts []TemplateMergeCon
 	return nil
 }
 
-// LineDiff represents a difference between template output and base file
-type LineDiff struct {
-	Type            string // "added", "removed", "modified"
-	BaseLineNum     int    // Line number in base file (0 if removed)
-	TemplateLineNum int    // Line number in template output (0 if added)
-	BaseContent     string // Content in base file
-	TemplateContent string // Content in template output
-}
-
 // TemplateSection represents a section in the template file
 type TemplateSection struct {
-	Type         string   // "conditional", "common"
-	System       string   // System name for conditional sections (empty for common)
-	StartLine    int      // Starting line in template
-	EndLine      int      // Ending line in template
-	Content      []string // Lines in this section
-	MatchedLines []string // Lines from base file that matched this section
-}
-
-// computeLineDiff compares base file with template output line by line
-func computeLineDiff(baseContent, templateOutput string) []LineDiff {
-	baseLines := strings.Split(baseContent, "\n")
-	templateLines := strings.Split(templateOutput, "\n")
-
-	var diffs []LineDiff
-
-	// Simple line-by-line comparison for now
-	// This can be enhanced with a proper diff algorithm (Myers, etc.)
-	maxLen := len(baseLines)
-	if len(templateLines) > maxLen {
-		maxLen = len(templateLines)
-	}
-
-	for i := 0; i < maxLen; i++ {
-		var baseLine, templateLine string
-		if i < len(baseLines) {
-			baseLine = baseLines[i]
-		}
-		if i < len(templateLines) {
-			templateLine = templateLines[i]
-		}
-
-		if baseLine != templateLine {
-			if baseLine == "" {
-				// Line was removed from base
-				diffs = append(diffs, LineDiff{
-					Type:            "removed",
-					TemplateLineNum: i + 1,
-					TemplateContent: templateLine,
-				})
-			} else if templateLine == "" {
-				// Line was added to base
-				diffs = append(diffs, LineDiff{
-					Type:        "added",
-					BaseLineNum: i + 1,
-					BaseContent: baseLine,
-				})
-			} else {
-				// Line was modified
-				diffs = append(diffs, LineDiff{
-					Type:            "modified",
-					BaseLineNum:     i + 1,
-					TemplateLineNum: i + 1,
-					BaseContent:     baseLine,
-					TemplateContent: templateLine,
-				})
-			}
-		}
-	}
-
-	return diffs
+	Type      string   // "conditional", "common"
+	Condition string   // Enclosing blocks of a conditional section, outermost first
+	StartLine int      // First line of the section in the template
+	EndLine   int      // Last line of the section in the template
+	Content   []string // Lines in this section
 }
 
-// parseTemplateSections breaks down a template into sections
-func parseTemplateSections(templateContent string) []TemplateSection {
-	lines := strings.Split(templateContent, "\n")
-	var sections []TemplateSection
-	var currentSection *TemplateSection
-
-	// Start with a common section
-	currentSection = &TemplateSection{
-		Type:      "common",
-		StartLine: 1,
-		Content:   []string{},
+// parseTemplateSections breaks down a template into runs of content lines
+// that sit in the same conditional blocks
+func parseTemplateSections(name, templateContent string) ([]TemplateSection, error) {
+	lines, err := parseTemplate(name, templateContent)
+	if err != nil {
+		return nil, err
 	}
 
+	var sections []TemplateSection
+	var current *TemplateSection
 	for i, line := range lines {
-		trimmed := strings.TrimSpace(line)
-
-		// Check for conditional start
-		if strings.HasPrefix(trimmed, "{{#if ") && strings.HasSuffix(trimmed, "}}") {
-			// Save current section if it has content
-			if len(currentSection.Content) > 0 {
-				currentSection.EndLine = i
-				sections = append(sections, *currentSection)
-			}
-
-			// Start new conditional section
-			system := strings.TrimSpace(trimmed[6 : len(trimmed)-2])
-			currentSection = &TemplateSection{
-				Type:      "conditional",
-				System:    system,
-				StartLine: i + 1,
-				Content:   []string{},
-			}
+		if line.Kind != tagText {
+			current = nil
 			continue
 		}
 
-		// Check for conditional end
-		if trimmed == "{{/if}}" {
-			// Save current conditional section
-			currentSection.EndLine = i
-			sections = append(sections, *currentSection)
-
-			// Start new common section
-			currentSection = &TemplateSection{
-				Type:      "common",
-				StartLine: i + 1,
-				Content:   []string{},
+		condition := strings.Join(line.Blocks, " > ")
+		if current == nil || current.Condition != condition {
+			sections = append(sections, TemplateSection{Type: "common", Condition: condition, StartLine: i + 1})
+			current = &sections[len(sections)-1]
+			if condition != "" {
+				current.Type = "conditional"
 			}
-			continue
 		}
-
-		// Add line to current section
-		currentSection.Content = append(currentSection.Content, line)
+		current.EndLine = i + 1
+		current.Content = append(current.Content, line.Text)
 	}
 
-	// Save final section
-	if len(currentSection.Content) > 0 {
-		currentSection.EndLine = len(lines)
-		sections = append(sections, *currentSection)
-	}
-
-	return sections
+	return sections, nil
 }
 
-// smartMergeIntoTemplate intelligently merges base file changes into template
+// smartMergeIntoTemplate carries the edits made to a base file back into its
+// template with a three-way merge against the output rendered at deploy time
 func (dm *DotfilesManager) smartMergeIntoTemplate(conflict TemplateMergeConflict) error {
 	// Read template
 	templateContent, err := os.ReadFile(conflict.TemplatePath)
 	if err != nil {
 		return fmt.Errorf("failed to read template: %w", err)
 	}
-
-	// Check if template has conditionals
-	hasConditionals := strings.Contains(string(templateContent), "{{#if")
-
-	if !hasConditionals {
-		// No conditionals - simple replacement
-		fmt.Println("Template has no conditional blocks. Using direct replacement.")
-		return dm.replaceTemplateSimple(conflict)
+	lines, err := parseTemplate(conflict.TemplatePath, string(templateContent))
+	if err != nil {
+		return err
 	}
-
-	// Parse template into sections
-	sections := parseTemplateSections(string(templateContent))
+	templateLines := strings.Split(string(templateContent), "\n")
 
 	// Process template to get what it would generate for current system
-	templateOutput := dm.processTemplateContent(string(templateContent))
-
-	// Compute differences
-	diffs := computeLineDiff(conflict.LocalContent, templateOutput)
+	templateOutput, origins, err := dm.renderTemplate(conflict.TemplatePath, string(templateContent))
+	if err != nil {
+		return err
+	}
 
-	if len(diffs) == 0 {
-		fmt.Println("No differences detected between base file and template output.")
+	base := conflict.LastRendered
+	if base == "" {
+		fmt.Println("Note: the output rendered at deploy time was not recorded, comparing against the current template output instead.")
+		base = templateOutput
+	}
+	if conflict.LocalContent == base {
+		fmt.Println("No local changes to the base file since it was rendered.")
 		return nil
 	}
 
-	fmt.Printf("\n=== SMART MERGE ANALYSIS ===\n")
-	fmt.Printf("Found %d difference(s) between base file and template output\n", len(diffs))
-	fmt.Printf("Template has %d section(s):\n", len(sections))
-	for _, sec := range sections {
-		if sec.Type == "conditional" {
-			fmt.Printf("  - Conditional block for '%s' (%d lines)\n", sec.System, len(sec.Content))
-		} else {
-			fmt.Printf("  - Common section (%d lines)\n", len(sec.Content))
+	merge := mergeOutputIntoTemplate(templateLines, base, conflict.LocalContent, templateOutput, origins)
+
+	// Keep variable references in lines that were edited around them
+	variables, err := dm.templateVariables()
+	if err != nil {
+		return err
+	}
+	for i, edit := range merge.Edits {
+		if edit.Kind == templateModify {
+			line := restoreVariables(edit.Old, edit.Lines[0], variables)
+			merge.Edits[i].Lines[0] = restoreSecrets(edit.Old, line, dm.secretsInUse())
 		}
 	}
-	fmt.Println()
 
-	// Analyze where changes should go
-	analysis := dm.analyzeChangePlacement(diffs, sections, templateOutput)
+	// Secret values must never end up in the template, which is committed
+	var withheld []string
+	merge.Edits, withheld = withholdSecrets(merge.Edits, dm.secretsInUse())
 
-	// Show analysis and ask for confirmation
-	fmt.Println("Change placement analysis:")
-	for i, change := range analysis {
+	fmt.Printf("\n=== SMART MERGE ANALYSIS ===\n")
+	fmt.Printf("Found %d change(s) to carry into the template", len(merge.Edits))
+	if len(merge.Conflicts) > 0 {
+		fmt.Printf(" and %d conflict(s)", len(merge.Conflicts))
+	}
+	fmt.Println()
+	fmt.Println()
+
+	for i := range merge.Edits {
+		edit := &merge.Edits[i]
 		fmt.Printf("%d. ", i+1)
-		if change.Type == "added" {
-			fmt.Printf("ADD: %s\n", truncate(change.BaseContent, 60))
-		} else if change.Type == "modified" {
-			fmt.Printf("MODIFY: %s -> %s\n",
-				truncate(change.TemplateContent, 30),
-				truncate(change.BaseContent, 30))
-		} else {
-			fmt.Printf("REMOVE: %s\n", truncate(change.TemplateContent, 60))
+		switch edit.Kind {
+		case templateModify:
+			fmt.Printf("MODIFY template %s: %s -> %s\n", describeTemplateLine(lines, edit.Line), truncate(edit.Old, 30), truncate(edit.Lines[0], 30))
+		case templateRemove:
+			fmt.Printf("REMOVE template %s: %s\n", describeTemplateLine(lines, edit.Line), truncate(edit.Old, 60))
+		case templateAdd:
+			for _, line := range edit.Lines {
+				fmt.Printf("ADD: %s\n   ", truncate(line, 60))
+			}
+			if len(edit.Candidates) > 0 {
+				edit.Line = dm.promptForInsertion(lines, edit.Candidates)
+			}
+			fmt.Printf("→ %s\n", describeInsertion(lines, edit.Line))
 		}
+	}
 
-		if change.RecommendedSection != nil {
-			if change.RecommendedSection.Type == "conditional" {
-				fmt.Printf("   → Suggested: Add to conditional block for '%s'\n", change.RecommendedSection.System)
-			} else {
-				fmt.Printf("   → Suggested: Add to common section\n")
-			}
+	for _, c := range merge.Conflicts {
+		if c.Partial != "" {
+			fmt.Printf("CONFLICT at base file line %d: these lines come from %s, which other templates may include too\n", c.BaseLine, c.Partial)
 		} else {
-			fmt.Printf("   → Suggested: Add to common section (default)\n")
+			fmt.Printf("CONFLICT at base file line %d: changed locally and in the template since the last deploy\n", c.BaseLine)
 		}
+		for _, line := range c.Base {
+			fmt.Printf("   - %s\n", truncate(line, 60))
+		}
+		for _, line := range c.Ours {
+			fmt.Printf("   + %s\n", truncate(line, 60))
+		}
+	}
+	if len(merge.Conflicts) > 0 {
+		fmt.Println("Conflicting changes are not merged automatically, edit the template or partial manually to include them.")
+	}
+	for _, warning := range withheld {
+		fmt.Printf("Warning: %s\n", warning)
 	}
 
 	fmt.Println("\nOptions:")
-	fmt.Println("  1. Auto-merge (apply all suggestions)")
+	fmt.Println("  1. Apply the merge")
 	fmt.Println("  2. Manual edit (I'll help you place changes)")
 	fmt.Println("  3. Cancel")
 	fmt.Print("\nChoice [1-3]: ")
@@ -1504,7 +1421,7 @@ func (dm *DotfilesManager) smartMergeIntoTemplate(conflict TemplateMergeConflict
 
 	switch strings.TrimSpace(choice) {
 	case "1":
-		return dm.autoMergeTemplate(conflict, sections, analysis)
+		return dm.applyTemplateMerge(conflict, templateLines, merge)
 	case "2":
 		return dm.editTemplateManually(conflict)
 	case "3", "":
@@ -1513,114 +1430,39 @@ func (dm *DotfilesManager) smartMergeIntoTemplate(conflict TemplateMergeConflict
 		fmt.Println("Invalid choice")
 		return dm.smartMergeIntoTemplate(conflict)
 	}
-}
-
-// ChangePlacement represents where a change should go in the template
-type ChangePlacement struct {
-	LineDiff
-	RecommendedSection *TemplateSection
-	Confidence         string // "high", "medium", "low"
-}
-
-// analyzeChangePlacement determines where each change should go in the template
-func (dm *DotfilesManager) analyzeChangePlacement(diffs []LineDiff, sections []TemplateSection, templateOutput string) []ChangePlacement {
-	var placements []ChangePlacement
-
-	templateLines := strings.Split(templateOutput, "\n")
-
-	for _, diff := range diffs {
-		placement := ChangePlacement{
-			LineDiff:   diff,
-			Confidence: "medium",
-		}
-
-		// Find which section this line is in (in the template output)
-		if diff.TemplateLineNum > 0 && diff.TemplateLineNum <= len(templateLines) {
-			// Find the corresponding section
-			lineNum := diff.TemplateLineNum
-			cumulativeLine := 0
-
-			for i := range sections {
-				sectionLen := len(sections[i].Content)
-				if lineNum <= cumulativeLine+sectionLen {
-					placement.RecommendedSection = &sections[i]
-					placement.Confidence = "high"
-					break
-				}
-				cumulativeLine += sectionLen
-			}
-		}
-
-		// If we couldn't determine section (e.g., new line), default to common
-		if placement.RecommendedSection == nil {
-			// Find the last common section
-			for i := len(sections) - 1; i >= 0; i-- {
-				if sections[i].Type == "common" {
-					placement.RecommendedSection = &sections[i]
-					placement.Confidence = "low"
-					break
-				}
-			}
-		}
-
-		placements = append(placements, placement)
-	}
-
-	return placements
-}
-
-// autoMergeTemplate automatically applies changes to the template
-func (dm *DotfilesManager) autoMergeTemplate(conflict TemplateMergeConflict, sections []TemplateSection, placements []ChangePlacement) error {
-	// Read template
-	templateContent, err := os.ReadFile(conflict.TemplatePath)
-	if err != nil {
-		return fmt.Errorf("failed to read template: %w", err)
-	}
-
-	templateLines := strings.Split(string(templateContent), "\n")
-
-	// Apply changes section by section
-	for _, placement := range placements {
-		if placement.Type == "added" {
-			// Find where to insert this line in the template
-			if placement.RecommendedSection != nil {
-				// Insert at end of recommended section
-				insertPos := placement.RecommendedSection.EndLine
-
-				// Handle conditional sections - insert before {{/if}}
-				if placement.RecommendedSection.Type == "conditional" {
-					insertPos-- // Insert before the {{/if}} line
-				}
-
-				// Insert the new line
-				templateLines = insertLine(templateLines, insertPos, placement.BaseContent)
-
-				// Update section end lines for subsequent sections
-				for i := range sections {
-					if sections[i].StartLine > insertPos {
-						sections[i].StartLine++
-						sections[i].EndLine++
-					} else if sections[i].EndLine >= insertPos {
-						sections[i].EndLine++
-					}
-				}
-			}
-		} else if placement.Type == "modified" {
-			// Find and replace the line in the template
-			// This requires mapping from template output line to template file line
-			// For now, we'll search for the content
-			for i, line := range templateLines {
-				if strings.TrimSpace(line) == strings.TrimSpace(placement.TemplateContent) {
-					templateLines[i] = placement.BaseContent
-					break
-				}
-			}
+}
+
+// promptForInsertion asks where new lines go when more than one template
+// position would render them in the same place
+func (dm *DotfilesManager) promptForInsertion(lines []templateLine, candidates []int) int {
+	fmt.Println("This position is ambiguous in the template:")
+	for i, candidate := range candidates {
+		fmt.Printf("     %d. %s\n", i+1, describeInsertion(lines, candidate))
+	}
+	fmt.Printf("   Choice [1-%d]: ", len(candidates))
+
+	var choice string
+	fmt.Scanln(&choice)
+	for i := range candidates {
+		if strings.TrimSpace(choice) == fmt.Sprint(i+1) {
+			return candidates[i]
 		}
-		// "removed" type: we don't remove lines from template, user can do that manually
 	}
+	fmt.Println("   Using the first option")
+	return candidates[0]
+}
+
+// describeInsertion describes the place new lines are inserted at
+func describeInsertion(lines []templateLine, line int) string {
+	if line == 0 {
+		return "at the top of the template"
+	}
+	return "after template " + describeTemplateLine(lines, line-1)
+}
 
-	// Write updated template
-	newTemplateContent := strings.Join(templateLines, "\n")
+// applyTemplateMerge writes the merged template and stages it
+func (dm *DotfilesManager) applyTemplateMerge(conflict TemplateMergeConflict, templateLines []string, merge templateMerge) error {
+	newTemplateContent := strings.Join(applyTemplateEdits(templateLines, merge.Edits), "\n")
 	if err := os.WriteFile(conflict.TemplatePath, []byte(newTemplateContent), 0644); err != nil {
 		return fmt.Errorf("failed to write template: %w", err)
 	}
@@ -1631,19 +1473,13 @@ func (dm *DotfilesManager) autoMergeTemplate(conflict TemplateMergeConflict, sec
 		fmt.Printf("Warning: Failed to stage template file: %v\n", err)
 	}
 
-	fmt.Printf("✓ Auto-merged changes into template: %s\n", conflict.TemplatePath)
-	return nil
-}
-
-// insertLine inserts a line at the specified position
-func insertLine(lines []string, pos int, content string) []string {
-	if pos >= len(lines) {
-		return append(lines, content)
+	fmt.Printf("✓ Merged changes into template: %s\n", conflict.TemplatePath)
+	if rendered, err := dm.processTemplateContent(conflict.TemplatePath, newTemplateContent); err != nil {
+		fmt.Printf("Warning: the merged template does not render: %v\n", err)
+	} else if rendered != conflict.LocalContent {
+		fmt.Println("Note: the template does not render exactly to the base file, review it before deploying.")
 	}
-
-	lines = append(lines[:pos+1], lines[pos:]...)
-	lines[pos] = content
-	return lines
+	return nil
 }
 
 // truncate truncates a string to maxLen characters
@@ -1694,8 +1530,16 @@ func (dm *DotfilesManager) mergeIntoTemplateInteractive(conflict TemplateMergeCo
 	fmt.Println("while preserving conditional blocks.")
 	fmt.Println()
 
+	sections, err := parseTemplateSections(conflict.TemplatePath, string(templateContent))
+	if err != nil {
+		return err
+	}
+
 	// Check if template has conditional blocks
-	hasConditionals := strings.Contains(string(templateContent), "{{#if")
+	hasConditionals := false
+	for _, section := range sections {
+		hasConditionals = hasConditionals || section.Type == "conditional"
+	}
 
 	if !hasConditionals {
 		fmt.Println("Template has no conditional blocks. Using direct replacement.")
@@ -1703,7 +1547,7 @@ func (dm *DotfilesManager) mergeIntoTemplateInteractive(conflict TemplateMergeCo
 	}
 
 	fmt.Println("Template structure:")
-	dm.analyzeTemplateStructure(string(templateContent))
+	dm.analyzeTemplateStructure(sections)
 	fmt.Println()
 
 	fmt.Println("Options:")
@@ -1744,35 +1588,19 @@ func (dm *DotfilesManager) mergeIntoTemplateInteractive(conflict TemplateMergeCo
 }
 
 // analyzeTemplateStructure shows the structure of a template file
-func (dm *DotfilesManager) analyzeTemplateStructure(templateContent string) {
-	lines := strings.Split(templateContent, "\n")
-	inConditional := false
-	currentSystem := ""
-	conditionalLines := 0
+func (dm *DotfilesManager) analyzeTemplateStructure(sections []TemplateSection) {
 	commonLines := 0
 
-	for _, line := range lines {
-		trimmed := strings.TrimSpace(line)
-
-		if strings.HasPrefix(trimmed, "{{#if ") && strings.HasSuffix(trimmed, "}}") {
-			currentSystem = strings.TrimSpace(trimmed[6 : len(trimmed)-2])
-			inConditional = true
-			conditionalLines = 0
+	for _, section := range sections {
+		if section.Type == "conditional" {
+			fmt.Printf("  - %d lines in %s (lines %d-%d)\n", len(section.Content), section.Condition, section.StartLine, section.EndLine)
 			continue
 		}
-
-		if trimmed == "{{/if}}" {
-			if inConditional {
-				fmt.Printf("  - %d lines for system: %s\n", conditionalLines, currentSystem)
+		for _, line := range section.Content {
+			trimmed := strings.TrimSpace(line)
+			if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+				commonLines++
 			}
-			inConditional = false
-			continue
-		}
-
-		if inConditional {
-			conditionalLines++
-		} else if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
-			commonLines++
 		}
 	}
 
@@ -1846,8 +1674,10 @@ func (dm *DotfilesManager) manualEditMerge(conflict TemplateMergeConflict) (stri
 	tempFile := conflict.BasePath + ".merge"
 
 	// Get template output
-	templateContent, _ := os.ReadFile(conflict.TemplatePath)
-	templateOutput := dm.processTemplateContent(string(templateContent))
+	templateOutput, err := dm.renderTemplateFile(conflict.TemplatePath)
+	if err != nil {
+		return "", err
+	}
 
 	// Create merge file with conflict markers
 	mergeContent := fmt.Sprintf(`<<<<<<< LOCAL (your changes)
@@ -1907,23 +1737,6 @@ func (dm *DotfilesManager) manualEditMerge(conflict TemplateMergeConflict) (stri
 	return string(resolvedContent), nil
 }
 
-func (dm *DotfilesManager) getTemplateOverwriteMessage() string {
-	if len(templateOverwrites) == 0 {
-		return ""
-	}
-
-	message := fmt.Sprintf("\n\n[TEMPLATE-OVERWRITES] The following files were regenerated from templates:\n")
-	for _, file := range templateOverwrites {
-		message += fmt.Sprintf("  - %s\n", file)
-	}
-	message += "\nTo revert template changes, use: git log --grep=\"TEMPLATE-OVERWRITES\" --oneline"
-
-	// Clear the list after generating message
-	templateOverwrites = nil
-
-	return message
-}
-
 func (dm *DotfilesManager) showTemplateHistory() error {
 	// Check if we're in a git repository
 	gitDir := filepath.Join(dm.DotfilesDir, ".git")
@@ -1935,27 +1748,26 @@ func (dm *DotfilesManager) showTemplateHistory() error {
 	fmt.Println("Commits with template overwrites:")
 	fmt.Println("=================================")
 
-	// Search for commits with template overwrite markers
-	cmd := exec.Command("git", "log", "--grep=TEMPLATE-OVERWRITES", "--oneline", "--reverse")
-	cmd.Dir = dm.DotfilesDir
-	output, err := cmd.Output()
+	entries, err := dm.templateHistory()
 	if err != nil {
-		return fmt.Errorf("failed to search git history: %w", err)
+		return err
 	}
 
-	if len(output) == 0 {
+	if len(entries) == 0 {
 		fmt.Println("No template overwrites found in git history.")
-		fmt.Println("\nTemplate overwrites are marked in commit messages when templates")
-		fmt.Println("regenerate existing files during deployment.")
+		fmt.Println("\nTemplate overwrites are recorded in Template-Overwrite trailers of commit")
+		fmt.Println("messages when templates regenerate existing files during deployment.")
 		return nil
 	}
 
-	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
-	for i, line := range lines {
-		fmt.Printf("%d. %s\n", i+1, line)
+	for i, entry := range entries {
+		fmt.Printf("%d. %s %s %s\n", i+1, entry.Hash, entry.Date, entry.Subject)
+		for _, file := range entry.Files {
+			fmt.Printf("     %s\n", file)
+		}
 	}
 
-	fmt.Printf("\nFound %d commits with template overwrites.\n", len(lines))
+	fmt.Printf("\nFound %d commits with template overwrites.\n", len(entries))
 	fmt.Println("\nTo see details of a specific commit:")
 	fmt.Println("  git show <commit-hash>")
 	fmt.Println("\nTo revert a specific commit:")
@@ -1967,53 +1779,17 @@ func (dm *DotfilesManager) showTemplateHistory() error {
 }
 
 func (dm *DotfilesManager) promptForTemplateOverwrite(templatePath, outputPath, existingContent, newContent string) (bool, error) {
-	fmt.Printf("\n⚠️  Template output file already exists: %s\n", outputPath)
-	fmt.Printf("Template: %s\n", templatePath)
-	fmt.Printf("System: %s\n\n", dm.System)
-
-	// Show diff using a simple line-by-line comparison
-	fmt.Println("Differences found:")
-	fmt.Println("--- Existing file")
-	fmt.Println("+++ Template output")
-
-	existingLines := strings.Split(existingContent, "\n")
-	newLines := strings.Split(newContent, "\n")
-
-	maxLines := len(existingLines)
-	if len(newLines) > maxLines {
-		maxLines = len(newLines)
-	}
-
-	diffCount := 0
-	for i := 0; i < maxLines && diffCount < 10; i++ {
-		var existingLine, newLine string
-		if i < len(existingLines) {
-			existingLine = existingLines[i]
-		}
-		if i < len(newLines) {
-			newLine = newLines[i]
-		}
-
-		if existingLine != newLine {
-			if existingLine != "" {
-				fmt.Printf("-%s\n", existingLine)
-			}
-			if newLine != "" {
-				fmt.Printf("+%s\n", newLine)
-			}
-			diffCount++
-		}
-	}
+	fmt.Fprintf(dm.out, "\n⚠️  Template output file already exists: %s\n", outputPath)
+	fmt.Fprintf(dm.out, "Template: %s\n", templatePath)
+	fmt.Fprintf(dm.out, "System: %s\n\n", dm.System)
 
-	if diffCount >= 10 {
-		fmt.Println("... (showing first 10 differences)")
-	}
+	showContentDiff(dm.out, "Existing file", "Template output", existingContent, newContent)
 
-	fmt.Printf("\nOptions:\n")
-	fmt.Printf("  y - Overwrite with template output (recommended)\n")
-	fmt.Printf("  n - Keep existing file\n")
-	fmt.Printf("  d - Show full diff\n")
-	fmt.Printf("Choice [y/n/d]: ")
+	fmt.Fprintf(dm.out, "\nOptions:\n")
+	fmt.Fprintf(dm.out, "  y - Overwrite with template output (recommended)\n")
+	fmt.Fprintf(dm.out, "  n - Keep existing file\n")
+	fmt.Fprintf(dm.out, "  d - Show full diff\n")
+	fmt.Fprintf(dm.out, "Choice [y/n/d]: ")
 
 	var response string
 	fmt.Scanln(&response)
@@ -2022,16 +1798,8 @@ func (dm *DotfilesManager) promptForTemplateOverwrite(templatePath, outputPath,
 	switch response {
 	case "d":
 		// Show full diff and ask again
-		fmt.Println("\n=== FULL DIFF ===")
-		fmt.Println("--- Existing file")
-		for i, line := range existingLines {
-			fmt.Printf("%3d: %s\n", i+1, line)
-		}
-		fmt.Println("\n+++ Template output")
-		for i, line := range newLines {
-			fmt.Printf("%3d: %s\n", i+1, line)
-		}
-		fmt.Printf("\nOverwrite with template output? [y/n]: ")
+		showFullContentDiff(dm.out, "Existing file", "Template output", existingContent, newContent)
+		fmt.Fprintf(dm.out, "\nOverwrite with template output? [y/n]: ")
 		fmt.Scanln(&response)
 		return strings.ToLower(strings.TrimSpace(response)) == "y", nil
 	case "n":
@@ -2039,99 +1807,38 @@ func (dm *DotfilesManager) promptForTemplateOverwrite(templatePath, outputPath,
 	case "y", "":
 		return true, nil
 	default:
-		fmt.Printf("Invalid choice '%s', defaulting to 'y'\n", response)
+		fmt.Fprintf(dm.out, "Invalid choice '%s', defaulting to 'y'\n", response)
 		return true, nil
 	}
 }
 
-func (dm *DotfilesManager) processTemplateContent(content string) string {
-	// Simple template processing for {{#if system}} blocks
-	lines := strings.Split(content, "\n")
-	var result []string
-	var skipBlock bool
-
-	for _, line := range lines {
-		trimmed := strings.TrimSpace(line)
+// contentDiffPreviewLines limits the diff shown before asking how to proceed
+const contentDiffPreviewLines = 20
 
-		// Check for {{#if system}} blocks
-		if strings.HasPrefix(trimmed, "{{#if ") && strings.HasSuffix(trimmed, "}}") {
-			// Extract condition
-			condition := strings.TrimSpace(trimmed[6 : len(trimmed)-2])
-
-			// Check if condition matches current system
-			skipBlock = !dm.matchesCondition(condition)
-			continue
-		}
-
-		// Check for {{/if}} end blocks
-		if trimmed == "{{/if}}" {
-			skipBlock = false
-			continue
-		}
-		// Add line if not in a skipped block
-		if !skipBlock {
-			result = append(result, line)
-		}
+// showContentDiff prints the start of the unified diff between two versions of a file
+func showContentDiff(w io.Writer, oldLabel, newLabel, oldContent, newContent string) {
+	lines := diff.SplitLines(diff.Unified(oldLabel, newLabel, oldContent, newContent, diffContext))
+	if len(lines) == 0 {
+		fmt.Fprintln(w, "No differences found")
+		return
 	}
 
-	return strings.Join(result, "\n")
-}
-
-func (dm *DotfilesManager) matchesCondition(condition string) bool {
-	switch condition {
-	case "macos":
-		return dm.System == "macos"
-	case "linux":
-		return dm.System == "arch" || dm.System == "ubuntu" || dm.System == "debian" || dm.System == "fedora" || dm.System == "linux"
-	case "arch":
-		return dm.System == "arch"
-	case "ubuntu":
-		return dm.System == "ubuntu"
-	case "debian":
-		return dm.System == "debian"
-	case "fedora":
-		return dm.System == "fedora"
-	default:
-		return dm.System == condition
+	fmt.Fprintln(w, "Differences found:")
+	for i, line := range lines {
+		if i == contentDiffPreviewLines {
+			fmt.Fprintf(w, "... (%d more lines, choose 'd' for the full diff)\n", len(lines)-i)
+			break
+		}
+		fmt.Fprintln(w, line)
 	}
 }
 
-func (dm *DotfilesManager) processPackageTemplates(packageDir string, dryRun bool) error {
-	return dm.processPackageTemplatesWithOptions(packageDir, dryRun, false)
+// showFullContentDiff prints the complete unified diff between two versions of a file
+func showFullContentDiff(w io.Writer, oldLabel, newLabel, oldContent, newContent string) {
+	fmt.Fprintln(w, "\n=== FULL DIFF ===")
+	fmt.Fprint(w, diff.Unified(oldLabel, newLabel, oldContent, newContent, diffContext))
 }
 
-func (dm *DotfilesManager) processPackageTemplatesWithOptions(packageDir string, dryRun bool, interactive bool) error {
-	// Walk through package directory and process any .template files
-	return filepath.Walk(packageDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// Skip directories
-		if info.IsDir() {
-			return nil
-		}
-
-		// Check if this is a template file
-		if strings.HasSuffix(info.Name(), ".template") {
-			outputPath := strings.TrimSuffix(path, ".template")
-
-			if dryRun {
-				fmt.Printf("DRY RUN: Would process template %s -> %s\n", path, outputPath)
-				return nil
-			}
-
-			// Process the template with interactive option
-			if err := dm.processTemplateWithOptions(path, outputPath, interactive); err != nil {
-				return fmt.Errorf("failed to process template %s: %w", path, err)
-			}
-
-			fmt.Printf("TEMPLATE: %s -> %s\n", path, outputPath)
-		}
-
-		return nil
-	})
-}
 func (dm *DotfilesManager) initializeConfig(dryRun bool) error {
 	// Check if config already exists
 	if _, err := os.Stat(dm.ConfigFile); err == nil {
@@ -2170,9 +1877,8 @@ func (dm *DotfilesManager) initializeConfig(dryRun bool) error {
 	}
 
 	// Set target directory
-	usr, err := user.Current()
-	if err == nil {
-		newConfig.StowOptions = append(newConfig.StowOptions, "--target="+usr.HomeDir)
+	if homeDir, err := dm.homeDir(); err == nil {
+		newConfig.StowOptions = append(newConfig.StowOptions, "--target="+homeDir)
 	}
 
 	// Add all detected packages for current system
@@ -2277,7 +1983,7 @@ func (dm *DotfilesManager) bootstrapFromGitHub(repository, branch string, dryRun
 	return nil
 }
 
-func (dm *DotfilesManager) syncToGitHub(dryRun bool) error {
+func (dm *DotfilesManager) syncToGitHub(dryRun bool, interactive bool, message string) error {
 	if dm.Config.GitHub == nil || dm.Config.GitHub.Repository == "" {
 		return fmt.Errorf("no GitHub repository configured. Use 'dotctl github-repo <owner/repo>' first")
 	}
@@ -2317,14 +2023,38 @@ func (dm *DotfilesManager) syncToGitHub(dryRun bool) error {
 		branch = "main"
 	}
 
+	// Decrypted files edited in place are committed in their encrypted form
+	if err := dm.encryptChanges(dryRun); err != nil {
+		return err
+	}
+
 	if dryRun {
 		fmt.Printf("DRY RUN: Would fetch from upstream\n")
 		fmt.Printf("DRY RUN: Would check for local changes\n")
 		fmt.Printf("DRY RUN: Would stash local changes if needed\n")
 		fmt.Printf("DRY RUN: Would pull upstream changes\n")
 		fmt.Printf("DRY RUN: Would restore local changes and merge\n")
-		fmt.Printf("DRY RUN: Would add all files to git\n")
-		fmt.Printf("DRY RUN: Would commit changes\n")
+		var commits []syncCommit
+		fmt.Printf("DRY RUN: Would stage the files of configured packages and %s\n", filepath.Base(dm.ConfigFile))
+		if _, err := os.Stat(gitDir); err == nil {
+			synced, skipped, err := dm.syncChanges()
+			if err != nil {
+				return err
+			}
+			if len(synced) > 0 {
+				fmt.Println("Changes to sync:")
+				printChanges(synced)
+				commits = dm.planCommits(synced, message)
+			}
+			printSkippedChanges(skipped)
+		}
+		fmt.Printf("DRY RUN: Would scan the changes for secrets\n")
+		if len(commits) == 0 {
+			fmt.Printf("DRY RUN: Would commit changes\n")
+		}
+		for _, commit := range commits {
+			fmt.Printf("DRY RUN: Would commit %s\n", firstLine(commit.Message))
+		}
 		fmt.Printf("DRY RUN: Would push to %s:%s\n", dm.Config.GitHub.Repository, branch)
 		return nil
 	}
@@ -2435,9 +2165,20 @@ func (dm *DotfilesManager) syncToGitHub(dryRun bool) error {
 		}
 	}
 
-	// Step 7: Add all files (including any resolved conflicts or new changes)
-	if err := dm.runGitCommand("add", "."); err != nil {
-		return fmt.Errorf("failed to add files: %w", err)
+	// Step 7: Stage the files of configured packages (including any resolved conflicts)
+	if err := dm.ensureLocalConfigIgnored(); err != nil {
+		return err
+	}
+	if dm.rendersToTarget() {
+		if err := dm.updateIgnoredOutputs(); err != nil {
+			return err
+		}
+	}
+	if err := dm.protectSecretOutputs(); err != nil {
+		return err
+	}
+	if err := dm.stageChanges(interactive); err != nil {
+		return err
 	}
 
 	// Step 8: Check if there are changes to commit
@@ -2448,17 +2189,14 @@ func (dm *DotfilesManager) syncToGitHub(dryRun bool) error {
 		return nil
 	}
 
-	// Step 9: Commit changes
-	commitMsg := fmt.Sprintf("Update dotfiles - %s", getCurrentTimestamp())
-
-	// Add template overwrite information if any templates were processed
-	templateMsg := dm.getTemplateOverwriteMessage()
-	if templateMsg != "" {
-		commitMsg += templateMsg
+	// Step 8.5: Never push secrets that slipped into the changes
+	if err := dm.checkStagedSecrets(); err != nil {
+		return err
 	}
 
-	if err := dm.runGitCommand("commit", "-m", commitMsg); err != nil {
-		return fmt.Errorf("failed to commit changes: %w", err)
+	// Step 9: Commit changes, summarizing what changed in each package
+	if err := dm.commitChanges(message); err != nil {
+		return err
 	}
 
 	// Step 10: Push to GitHub
@@ -2645,143 +2383,6 @@ func isConfigPackage(packageName string) bool {
 	return true
 }
 
-func (dm *DotfilesManager) deployShellPackage(packageDir, homeDir string, dryRun bool) error {
-	return dm.deployShellPackageWithOptions(packageDir, homeDir, dryRun, false)
-}
-
-func (dm *DotfilesManager) deployShellPackageWithOptions(packageDir, homeDir string, dryRun bool, interactive bool) error {
-	// For shell package, symlink each file directly to home directory
-	entries, err := os.ReadDir(packageDir)
-	if err != nil {
-		return fmt.Errorf("failed to read shell package directory: %w", err)
-	}
-
-	for _, entry := range entries {
-		fileName := entry.Name()
-		sourcePath := filepath.Join(packageDir, fileName)
-		targetPath := filepath.Join(homeDir, fileName)
-
-		if entry.IsDir() {
-			if dryRun {
-				fmt.Printf("DRY RUN: Would create symlink %s -> %s\n", targetPath, sourcePath)
-				continue
-			}
-
-			if _, err := os.Lstat(targetPath); err == nil {
-				if err := os.Remove(targetPath); err != nil {
-					return fmt.Errorf("failed to remove existing %s: %w", targetPath, err)
-				}
-			}
-
-			relativeSourcePath, err := filepath.Rel(homeDir, sourcePath)
-			if err != nil {
-				return fmt.Errorf("failed to calculate relative path: %w", err)
-			}
-
-			if err := os.Symlink(relativeSourcePath, targetPath); err != nil {
-				return fmt.Errorf("failed to create symlink %s -> %s: %w", targetPath, relativeSourcePath, err)
-			}
-
-			fmt.Printf("LINK: %s -> %s\n", targetPath, relativeSourcePath)
-			continue
-		}
-
-		// Check if this is a template file
-		if strings.HasSuffix(fileName, ".template") {
-			// Process template
-			outputFileName := strings.TrimSuffix(fileName, ".template")
-			targetPath := filepath.Join(homeDir, outputFileName)
-
-			if dryRun {
-				fmt.Printf("DRY RUN: Would process template %s -> %s\n", sourcePath, targetPath)
-				continue
-			}
-
-			// Process template with interactive option
-			if err := dm.processTemplateWithOptions(sourcePath, targetPath, interactive); err != nil {
-				return fmt.Errorf("failed to process template %s: %w", fileName, err)
-			}
-
-			fmt.Printf("TEMPLATE: %s -> %s\n", sourcePath, targetPath)
-		} else {
-			// Regular file - create symlink
-			targetPath := filepath.Join(homeDir, fileName)
-
-			if dryRun {
-				fmt.Printf("DRY RUN: Would create symlink %s -> %s\n", targetPath, sourcePath)
-				continue
-			}
-
-			// Check if target already exists
-			if _, err := os.Lstat(targetPath); err == nil {
-				// Remove existing symlink or file
-				if err := os.Remove(targetPath); err != nil {
-					return fmt.Errorf("failed to remove existing %s: %w", targetPath, err)
-				}
-			}
-
-			// Create relative path for symlink
-			relativeSourcePath, err := filepath.Rel(homeDir, sourcePath)
-			if err != nil {
-				return fmt.Errorf("failed to calculate relative path: %w", err)
-			}
-
-			// Create the symlink
-			if err := os.Symlink(relativeSourcePath, targetPath); err != nil {
-				return fmt.Errorf("failed to create symlink %s -> %s: %w", targetPath, relativeSourcePath, err)
-			}
-
-			fmt.Printf("LINK: %s -> %s\n", targetPath, relativeSourcePath)
-		}
-	}
-
-	return nil
-}
-
-func (dm *DotfilesManager) undeployShellPackage(packageDir, homeDir string, dryRun bool) error {
-	// For shell package, remove each symlinked file from home directory
-	entries, err := os.ReadDir(packageDir)
-	if err != nil {
-		return fmt.Errorf("failed to read shell package directory: %w", err)
-	}
-
-	for _, entry := range entries {
-		targetName := entry.Name()
-		if strings.HasSuffix(targetName, ".template") {
-			targetName = strings.TrimSuffix(targetName, ".template")
-		}
-		targetPath := filepath.Join(homeDir, targetName)
-
-		if dryRun {
-			fmt.Printf("DRY RUN: Would remove symlink %s\n", targetPath)
-			continue
-		}
-
-		// Check if symlink exists
-		if _, err := os.Lstat(targetPath); os.IsNotExist(err) {
-			continue // Skip if doesn't exist
-		}
-
-		info, err := os.Lstat(targetPath)
-		if err != nil {
-			return fmt.Errorf("failed to inspect %s: %w", targetPath, err)
-		}
-		if info.IsDir() && info.Mode()&os.ModeSymlink == 0 {
-			fmt.Printf("SKIP: %s exists as a real directory (not a symlink)\n", targetPath)
-			continue
-		}
-
-		// Remove the symlink
-		if err := os.Remove(targetPath); err != nil {
-			return fmt.Errorf("failed to remove symlink %s: %w", targetPath, err)
-		}
-
-		fmt.Printf("UNLINK: %s\n", targetPath)
-	}
-
-	return nil
-}
-
 func boolToCheckmark(b bool) string {
 	if b {
 		return "✓"
@@ -2823,9 +2424,16 @@ Commands:
   deploy [packages...]    Deploy packages (default: all for current system)
   undeploy [packages...]  Undeploy packages (default: all for current system)
   status                  Show current status
+  diff [packages...]      Show how deploy would change the files at each target
+  doctor                  Check configuration, links, templates and the repository for problems
+  cleanup                 Remove links of packages that are no longer configured or whose files are gone
+  plan [command] [args...] Show the operations deploy, undeploy, adopt or cleanup would perform
+  apply <plan.json>       Execute a plan saved with 'plan --output' ('-' reads it from stdin)
   add <package> [systems...] Add package to configuration
   remove <package>        Remove package from configuration
   adopt [package] [systems...]  Adopt config directories from ~/.config (default: all packages, all systems)
+  template explain <file> Show the template line each line of a rendered file came from
+  template migrate        Render templates at their targets instead of into the repository
   template-history        Show commits where template files were overwritten
   merge-check             Check for template merge conflicts without syncing
   merge-resolve           Interactively resolve template merge conflicts
@@ -2835,8 +2443,15 @@ Commands:
 
 Options:
   --dotfiles-dir <path>   Path to dotfiles directory (default: ~/.dotfiles)
+  --target-home <path>   Deploy into this directory instead of $HOME
   --dry-run              Show what would be done without executing
-  --interactive, -i      Prompt before overwriting template output files
+  --interactive, -i      Prompt before overwriting template output files, or choose what sync commits
+  --atomic               Deploy all packages or none, rolling back on the first failure
+  --fix                  Let doctor repair the problems it can fix safely
+  --encrypt              Store sensitive files encrypted when adopting
+  --verbose              List the state of every file in status, and show the target home
+  --output, -o <path>    Save the plan as JSON instead of printing it ('-' for stdout, other output goes to stderr)
+  --message, -m <text>   Commit message for sync instead of the generated summary
   --help                 Show this help message
 
 Examples:
@@ -2846,6 +2461,7 @@ Examples:
   dotctl deploy vim tmux           # Deploy specific packages
   dotctl undeploy shell            # Undeploy specific package
   dotctl status                    # Show current status
+  dotctl --dry-run cleanup         # Preview removal of stale links
   dotctl add vim linux macos      # Add vim package for Linux and macOS
   dotctl add shell all             # Add shell package for all systems
   dotctl remove vim                # Remove vim from configuration
@@ -2854,14 +2470,21 @@ Examples:
   dotctl adopt new-app             # Adopt specific package for all systems
   dotctl adopt new-app arch        # Adopt specific package for specific systems
   dotctl --dry-run adopt           # Preview what would be adopted
+  dotctl template explain ~/.zshrc # Show where each line of a rendered file came from
+  dotctl --dry-run template migrate # Preview moving rendered files out of the repository
   dotctl template-history          # Show commits with template overwrites
   dotctl merge-check               # Check for template conflicts
   dotctl merge-resolve             # Resolve template conflicts interactively
   dotctl github-repo user/dotfiles # Set GitHub repository
   dotctl sync                      # Push dotfiles to GitHub (auto-detects merges)
+  dotctl sync -m "Switch to zsh"   # Sync with your own commit message
   dotctl pull                      # Pull dotfiles from GitHub
   dotctl --dry-run deploy          # Show what would be deployed
   dotctl --interactive deploy      # Deploy with prompts for template conflicts
+  dotctl --atomic deploy           # Deploy everything or roll back on failure
+  dotctl plan deploy vim           # Show what deploying vim would do
+  dotctl plan undeploy -o plan.json # Save an undeploy plan for review
+  dotctl apply plan.json           # Execute a saved plan
 
 Template Merging:
   When base config files are manually edited and template files are updated,
@@ -2882,11 +2505,11 @@ Template Merging:
   8. Skip individual files
   
   Option 3 intelligently:
-  - Parses template sections (conditional blocks vs common sections)
-  - Detects added/modified/removed lines
-  - Determines where each change belongs
-  - Can auto-merge or let you review placements
-  - Preserves all {{#if system}} conditional blocks`)
+  - Merges three ways against the output rendered at the last deploy
+  - Puts modified and removed lines on the template lines they came from
+  - Asks where new lines go only when the template leaves it ambiguous
+  - Reports lines changed both locally and in the template as conflicts
+  - Preserves all {{#if}}/{{else}}/{{#unless}} conditional blocks`)
 }
 
 func main() {
@@ -2896,8 +2519,15 @@ func main() {
 	}
 
 	var dotfilesDir string
+	var targetHome string
 	var dryRun bool
 	var interactive bool
+	var atomic bool
+	var fix bool
+	var verbose bool
+	var encrypt bool
+	var planOutput string
+	var message string
 	var args []string
 
 	// Simple argument parsing
@@ -2911,6 +2541,14 @@ func main() {
 			dryRun = true
 		case arg == "--interactive" || arg == "-i":
 			interactive = true
+		case arg == "--atomic":
+			atomic = true
+		case arg == "--fix":
+			fix = true
+		case arg == "--verbose":
+			verbose = true
+		case arg == "--encrypt":
+			encrypt = true
 		case arg == "--dotfiles-dir":
 			if i+1 < len(os.Args) {
 				dotfilesDir = os.Args[i+1]
@@ -2921,6 +2559,36 @@ func main() {
 			}
 		case strings.HasPrefix(arg, "--dotfiles-dir="):
 			dotfilesDir = strings.TrimPrefix(arg, "--dotfiles-dir=")
+		case arg == "--target-home":
+			if i+1 < len(os.Args) {
+				targetHome = os.Args[i+1]
+				i++ // Skip next argument
+			} else {
+				fmt.Println("Error: --target-home requires a path")
+				os.Exit(1)
+			}
+		case strings.HasPrefix(arg, "--target-home="):
+			targetHome = strings.TrimPrefix(arg, "--target-home=")
+		case arg == "--output" || arg == "-o":
+			if i+1 < len(os.Args) {
+				planOutput = os.Args[i+1]
+				i++ // Skip next argument
+			} else {
+				fmt.Println("Error: --output requires a path")
+				os.Exit(1)
+			}
+		case strings.HasPrefix(arg, "--output="):
+			planOutput = strings.TrimPrefix(arg, "--output=")
+		case arg == "--message" || arg == "-m":
+			if i+1 < len(os.Args) {
+				message = os.Args[i+1]
+				i++ // Skip next argument
+			} else {
+				fmt.Println("Error: --message requires a commit message")
+				os.Exit(1)
+			}
+		case strings.HasPrefix(arg, "--message="):
+			message = strings.TrimPrefix(arg, "--message=")
 		default:
 			args = append(args, arg)
 		}
@@ -2934,11 +2602,20 @@ func main() {
 	command := args[0]
 	commandArgs := args[1:]
 
-	manager, err := NewDotfilesManager(dotfilesDir)
+	// A plan written to stdout has to be the only thing there
+	out := io.Writer(os.Stdout)
+	if command == "plan" && planOutput == "-" {
+		out = os.Stderr
+	}
+
+	manager, err := NewDotfilesManager(dotfilesDir, targetHome, out)
 	if err != nil {
-		fmt.Printf("Error initializing dotfiles manager: %v\n", err)
+		fmt.Fprintf(out, "Error initializing dotfiles manager: %v\n", err)
 		os.Exit(1)
 	}
+	if verbose && manager.TargetHome != "" {
+		fmt.Fprintf(os.Stderr, "Deploying into target home: %s\n", manager.TargetHome)
+	}
 
 	switch command {
 	case "init":
@@ -2948,16 +2625,27 @@ func main() {
 		}
 
 	case "deploy":
-		manager.deployAllWithOptions(commandArgs, dryRun, interactive)
+		if atomic && !dryRun {
+			if err := manager.deployAllAtomic(commandArgs, interactive); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		} else {
+			manager.deployAllWithOptions(commandArgs, dryRun, interactive)
+		}
 
 	case "undeploy":
 		manager.undeployAll(commandArgs, dryRun)
 
 	case "status":
-		if err := manager.status(); err != nil {
+		drifted, err := manager.status(verbose)
+		if err != nil {
 			fmt.Printf("Error getting status: %v\n", err)
 			os.Exit(1)
 		}
+		if drifted {
+			os.Exit(1)
+		}
 
 	case "add":
 		if len(commandArgs) == 0 {
@@ -2982,17 +2670,64 @@ func main() {
 		}
 
 	case "adopt":
-		if err := manager.adoptConfigDirectories(dryRun, commandArgs); err != nil {
+		if err := manager.adoptConfigDirectories(dryRun, encrypt, commandArgs); err != nil {
 			fmt.Printf("Error adopting config directories: %v\n", err)
 			os.Exit(1)
 		}
 
+	case "cleanup":
+		plan, err := manager.planCleanup()
+		if err != nil {
+			fmt.Printf("Error cleaning up deployment state: %v\n", err)
+			os.Exit(1)
+		}
+		if len(plan.Packages) == 0 {
+			fmt.Println("✓ Deployment state is clean")
+			break
+		}
+		if err := manager.runPlan(plan, dryRun, atomic, 0); err != nil {
+			fmt.Printf("Error cleaning up deployment state: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "plan":
+		if err := manager.writePlan(commandArgs, interactive, encrypt, planOutput); err != nil {
+			fmt.Fprintf(out, "Error planning: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "apply":
+		if len(commandArgs) == 0 {
+			fmt.Println("Error: apply command requires a plan file")
+			os.Exit(1)
+		}
+		if err := manager.applyPlanFile(commandArgs[0], dryRun, atomic); err != nil {
+			fmt.Printf("Error applying plan: %v\n", err)
+			os.Exit(1)
+		}
+
 	case "template-history":
 		if err := manager.showTemplateHistory(); err != nil {
 			fmt.Printf("Error showing template history: %v\n", err)
 			os.Exit(1)
 		}
 
+	case "template":
+		var err error
+		switch {
+		case len(commandArgs) == 2 && commandArgs[0] == "explain":
+			err = manager.explainTemplate(commandArgs[1])
+		case len(commandArgs) == 1 && commandArgs[0] == "migrate":
+			err = manager.migrateTemplateOutputs(dryRun)
+		default:
+			fmt.Println("Error: usage: dotctl template explain <file> | dotctl template migrate")
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
 	case "merge-check":
 		conflicts, err := manager.detectTemplateMergeConflicts()
 		if err != nil {
@@ -3009,8 +2744,7 @@ func main() {
 				fmt.Printf("   Template: %s\n", conflict.TemplatePath)
 
 				// Show brief summary of differences
-				templateContent, _ := os.ReadFile(conflict.TemplatePath)
-				templateOutput := manager.processTemplateContent(string(templateContent))
+				templateOutput, _ := manager.renderTemplateFile(conflict.TemplatePath)
 
 				localLines := len(strings.Split(conflict.LocalContent, "\n"))
 				templateLines := len(strings.Split(templateOutput, "\n"))
@@ -3056,7 +2790,7 @@ func main() {
 		}
 
 	case "sync":
-		if err := manager.syncToGitHub(dryRun); err != nil {
+		if err := manager.syncToGitHub(dryRun, interactive, message); err != nil {
 			fmt.Printf("Error syncing to GitHub: %v\n", err)
 			os.Exit(1)
 		}
@@ -3082,82 +2816,22 @@ func main() {
 			os.Exit(1)
 		}
 
-	case "debug":
-		// Debug command to test package filtering and filesystem operations
-		fmt.Printf("=== FILESYSTEM DEBUG ===\n")
-		cwd, err := os.Getwd()
+	case "diff":
+		changed, err := manager.showDeployDiff(commandArgs)
 		if err != nil {
-			fmt.Printf("Error getting current directory: %v\n", err)
-		} else {
-			fmt.Printf("Current working directory: %s\n", cwd)
-		}
-
-		fmt.Printf("Dotfiles directory: %s\n", manager.DotfilesDir)
-		fmt.Printf("Config file path: %s\n", manager.ConfigFile)
-
-		// Check if dotfiles directory exists
-		if stat, err := os.Stat(manager.DotfilesDir); err != nil {
-			fmt.Printf("Dotfiles directory error: %v\n", err)
-		} else {
-			fmt.Printf("Dotfiles directory exists: %t, is dir: %t\n", true, stat.IsDir())
-		}
-
-		// Check if config file exists
-		if stat, err := os.Stat(manager.ConfigFile); err != nil {
-			fmt.Printf("Config file error: %v\n", err)
-		} else {
-			fmt.Printf("Config file exists: %t, size: %d bytes\n", true, stat.Size())
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
 		}
-
-		// Try to read config file directly
-		if data, err := os.ReadFile(manager.ConfigFile); err != nil {
-			fmt.Printf("Error reading config file: %v\n", err)
-		} else {
-			fmt.Printf("Config file content length: %d bytes\n", len(data))
-			if len(data) > 0 {
-				previewLen := 200
-				if len(data) < previewLen {
-					previewLen = len(data)
-				}
-				fmt.Printf("Config file preview (first %d chars): %s\n", previewLen, string(data[:previewLen]))
-			}
+		if changed {
+			os.Exit(1)
 		}
 
-		fmt.Printf("\n=== SYSTEM DETECTION ===\n")
-		fmt.Printf("Runtime GOOS: %s\n", runtime.GOOS)
-		fmt.Printf("Detected system: %s\n", manager.System)
-
-		// Check /etc/os-release on Linux systems
-		if runtime.GOOS == "linux" {
-			if data, err := os.ReadFile("/etc/os-release"); err != nil {
-				fmt.Printf("Error reading /etc/os-release: %v\n", err)
-			} else {
-				fmt.Printf("/etc/os-release content:\n%s\n", string(data))
-			}
+	case "doctor":
+		if err := manager.doctor(fix, dryRun); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
 		}
 
-		fmt.Printf("\n=== PACKAGE ANALYSIS ===\n")
-		fmt.Printf("Total packages in config: %d\n", len(manager.Config.Packages))
-
-		if len(manager.Config.Packages) > 0 {
-			fmt.Println("\nPackage analysis:")
-			for pkgName, pkgConfig := range manager.Config.Packages {
-				deployable := shouldDeployPackage(pkgConfig, manager.System)
-				fmt.Printf("  %s: %+v -> deployable for %s: %t\n", pkgName, pkgConfig, manager.System, deployable)
-			}
-
-			// Test with different systems
-			testSystems := []string{"arch", "linux", "macos", "ubuntu"}
-			for _, testSys := range testSystems {
-				packages := manager.getPackagesForSystem(testSys)
-				fmt.Printf("\nPackages for %s: %d packages\n", testSys, len(packages))
-				if len(packages) > 0 {
-					fmt.Printf("  %s\n", strings.Join(packages, ", "))
-				}
-			}
-		} else {
-			fmt.Println("No packages found in configuration - this suggests config loading failed")
-		}
 	default:
 		fmt.Printf("Unknown command: %s\n", command)
 		printUsage()
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/yourusername/dotctl/internal/diff"
+)
+
+// Kinds of change merged back into a template
+const (
+	templateModify = "modify" // Replace the template line an output line came from
+	templateRemove = "remove" // Delete the template line an output line came from
+	templateAdd    = "add"    // Insert new lines into the template
+)
+
+// templateEdit is one change to a template file. Line is the 0-based template
+// line that is modified or removed, or the one new lines are inserted before.
+type templateEdit struct {
+	Kind       string
+	Line       int
+	Old        string
+	Lines      []string
+	Candidates []int // Insertion points to choose from when the placement is ambiguous
+}
+
+// templateMergeConflict is a change to output lines the template has changed
+// too, or to lines that came from a partial
+type templateMergeConflict struct {
+	BaseLine int // 1-based line in the last rendered output
+	Base     []string
+	Ours     []string
+	Partial  string // File the changed lines were included from, if any
+}
+
+// templateMerge is the result of merging edited output back into its template
+type templateMerge struct {
+	Edits     []templateEdit
+	Conflicts []templateMergeConflict
+}
+
+// mergeOutputIntoTemplate works out how to carry the edits made to rendered
+// output back into the template. base is the output as last rendered, ours the
+// edited output and theirs what the template renders to now, with origins
+// giving the template line each line of theirs came from.
+func mergeOutputIntoTemplate(templateLines []string, base, ours, theirs string, origins []lineOrigin) templateMerge {
+	baseLines := strings.Split(base, "\n")
+	oursLines := strings.Split(ours, "\n")
+
+	// Base lines the template still renders unchanged map to their template
+	// line, which for included lines is the line that includes them
+	baseOrigins := make([]int, len(baseLines))
+	basePartials := make([]string, len(baseLines))
+	for i := range baseOrigins {
+		baseOrigins[i] = -1
+	}
+	for _, edit := range diff.Lines(baseLines, strings.Split(theirs, "\n")) {
+		if edit.Kind == diff.Equal {
+			origin := origins[edit.NewLine-1]
+			baseOrigins[edit.OldLine-1] = origin.Line - 1
+			basePartials[edit.OldLine-1] = origin.Partial
+		}
+	}
+
+	var merge templateMerge
+	var removed []int // 0-based base lines
+	var added []string
+	lastBase := -1
+
+	flush := func(nextBase int) {
+		if len(removed) == 0 && len(added) == 0 {
+			return
+		}
+		defer func() { removed, added = nil, nil }()
+
+		conflict := func(partial string) {
+			conflict := templateMergeConflict{BaseLine: nextBase + 1, Ours: added, Partial: partial}
+			if len(removed) > 0 {
+				conflict.BaseLine = removed[0] + 1
+			}
+			for _, line := range removed {
+				conflict.Base = append(conflict.Base, baseLines[line])
+			}
+			merge.Conflicts = append(merge.Conflicts, conflict)
+		}
+
+		// Lines from partials are shared with other templates, so changes to
+		// them are left to the partial rather than merged into this template
+		for _, line := range removed {
+			if baseOrigins[line] < 0 || basePartials[line] != "" {
+				conflict(basePartials[line])
+				return
+			}
+		}
+		if len(removed) == 0 && lastBase >= 0 && nextBase < len(baseLines) &&
+			basePartials[lastBase] != "" && basePartials[nextBase] != "" && baseOrigins[lastBase] == baseOrigins[nextBase] {
+			conflict(basePartials[nextBase])
+			return
+		}
+
+		// Changed lines land on the template lines that produced them
+		for i, line := range removed {
+			origin := baseOrigins[line]
+			if i < len(added) {
+				merge.Edits = append(merge.Edits, templateEdit{Kind: templateModify, Line: origin, Old: templateLines[origin], Lines: []string{added[i]}})
+			} else {
+				merge.Edits = append(merge.Edits, templateEdit{Kind: templateRemove, Line: origin, Old: templateLines[origin]})
+			}
+		}
+		if len(added) <= len(removed) {
+			return
+		}
+		extra := added[len(removed):]
+		if len(removed) > 0 {
+			merge.Edits = append(merge.Edits, templateEdit{Kind: templateAdd, Line: baseOrigins[removed[len(removed)-1]] + 1, Lines: extra})
+			return
+		}
+
+		// New lines go between the template lines of their neighbours, which is
+		// only ambiguous when template lines that were not rendered lie in between
+		after := 0
+		for line := lastBase; line >= 0; line-- {
+			if baseOrigins[line] >= 0 {
+				after = baseOrigins[line] + 1
+				break
+			}
+		}
+		before := len(templateLines)
+		for line := nextBase; line < len(baseLines); line++ {
+			if baseOrigins[line] >= 0 {
+				before = baseOrigins[line]
+				break
+			}
+		}
+		edit := templateEdit{Kind: templateAdd, Line: after, Lines: extra}
+		if before > after {
+			edit.Candidates = []int{after, before}
+		}
+		merge.Edits = append(merge.Edits, edit)
+	}
+
+	for _, edit := range diff.Lines(baseLines, oursLines) {
+		switch edit.Kind {
+		case diff.Delete:
+			removed = append(removed, edit.OldLine-1)
+		case diff.Insert:
+			added = append(added, edit.Text)
+		default:
+			flush(edit.OldLine - 1)
+			lastBase = edit.OldLine - 1
+		}
+	}
+	flush(len(baseLines))
+
+	return merge
+}
+
+// applyTemplateEdits returns the template lines with all edits applied
+func applyTemplateEdits(templateLines []string, edits []templateEdit) []string {
+	// Work from the bottom up so earlier line numbers stay valid. Of two edits
+	// at the same line the later one goes first, leaving the earlier one on top.
+	order := make([]int, len(edits))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		if edits[order[i]].Line != edits[order[j]].Line {
+			return edits[order[i]].Line > edits[order[j]].Line
+		}
+		return order[i] > order[j]
+	})
+
+	lines := append([]string(nil), templateLines...)
+	for _, i := range order {
+		edit := edits[i]
+		switch edit.Kind {
+		case templateModify:
+			lines[edit.Line] = edit.Lines[0]
+		case templateRemove:
+			lines = append(lines[:edit.Line], lines[edit.Line+1:]...)
+		case templateAdd:
+			lines = append(lines[:edit.Line], append(append([]string(nil), edit.Lines...), lines[edit.Line:]...)...)
+		}
+	}
+	return lines
+}
+
+// describeTemplateLine names a template line and the blocks it is in
+func describeTemplateLine(lines []templateLine, line int) string {
+	return lineOrigin{Line: line + 1, Blocks: lines[line].Blocks}.String()
+}
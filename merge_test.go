@@ -0,0 +1,214 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// mergeTestTemplate renders on arch to the lines
+//
+//	0 # zshrc                 template line 0
+//	1 alias ll='ls -l'        template line 1, from _partials/aliases
+//	2 alias la='ls -a'        template line 1, from _partials/aliases
+//	3 alias pac=pacman        template line 3
+//	4 export EDITOR=vim       template line 8
+//	5 export TOKEN=abc123     template line 9
+//	6 echo "{{ editor }}"     template line 10
+var mergeTestTemplate = []string{
+	`# zshrc`,
+	`{{> aliases}}`,
+	`{{#if arch}}`,
+	`alias pac=pacman`,
+	`{{/if}}`,
+	`{{#if macos}}`,
+	`alias b=brew`,
+	`{{/if}}`,
+	`export EDITOR={{ editor }}`,
+	`export TOKEN={{secret "gh"}}`,
+	`echo "\{{ editor }}"`,
+}
+
+func TestMergeOutputIntoTemplate(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, partialsDir, "aliases"), "alias ll='ls -l'\nalias la='ls -a'\n")
+	dm := &DotfilesManager{
+		DotfilesDir: dir,
+		System:      "arch",
+		variables:   map[string]string{"editor": "vim"},
+		secrets:     &secretStore{values: map[string]string{"gh": "abc123"}},
+	}
+	templatePath := filepath.Join(dir, "shell", ".zshrc.template")
+	rendered, origins, err := dm.renderTemplate(templatePath, strings.Join(mergeTestTemplate, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	renderedLines := strings.Split(rendered, "\n")
+	if len(renderedLines) != 7 || len(origins) != 7 {
+		t.Fatalf("rendered %q with origins %v", rendered, origins)
+	}
+
+	// edit returns the rendered lines with lines from at up to to replaced
+	edit := func(at, to int, lines ...string) string {
+		edited := append(append(append([]string(nil), renderedLines[:at]...), lines...), renderedLines[to:]...)
+		return strings.Join(edited, "\n")
+	}
+	// template returns the template lines with lines from at up to to replaced
+	template := func(at, to int, lines ...string) []string {
+		return append(append(append([]string(nil), mergeTestTemplate[:at]...), lines...), mergeTestTemplate[to:]...)
+	}
+
+	tests := []struct {
+		name       string
+		base       string // Output as last rendered, the current output if empty
+		ours       string
+		want       []string
+		candidates [][]int
+		conflicts  []templateMergeConflict
+	}{
+		{
+			name: "modified line",
+			ours: edit(3, 4, `alias pac='sudo pacman'`),
+			want: template(3, 4, `alias pac='sudo pacman'`),
+		},
+		{
+			name: "removed line",
+			ours: edit(3, 4),
+			want: template(3, 4),
+		},
+		{
+			name: "added line between template lines",
+			ours: edit(5, 5, `export PAGER=less`),
+			want: template(9, 9, `export PAGER=less`),
+		},
+		{
+			name: "added line at the top",
+			ours: edit(0, 0, `# vim: ft=zsh`),
+			want: template(0, 0, `# vim: ft=zsh`),
+		},
+		{
+			name:       "added line after a block, before the next block",
+			ours:       edit(4, 4, `alias yay=paru`),
+			want:       template(4, 4, `alias yay=paru`),
+			candidates: [][]int{{4, 8}},
+		},
+		{
+			name: "modified and added lines",
+			ours: edit(4, 5, `export EDITOR=nvim`, `export VISUAL=nvim`),
+			want: template(8, 9, `export EDITOR=nvim`, `export VISUAL=nvim`),
+		},
+		{
+			name: "intact variable value",
+			ours: edit(4, 5, `export EDITOR=vim # default`),
+			want: template(8, 9, `export EDITOR={{ editor }} # default`),
+		},
+		{
+			name: "intact secret value",
+			ours: edit(5, 6, `export TOKEN=abc123 # github`),
+			want: template(9, 10, `export TOKEN={{secret "gh"}} # github`),
+		},
+		{
+			name: "escaped reference",
+			ours: edit(6, 7, `echo "{{ editor }}" >&2`),
+			want: template(10, 11, `echo "\{{ editor }}" >&2`),
+		},
+		{
+			name: "line after a multi-line include",
+			ours: edit(3, 4, `alias pac=yay`),
+			want: template(3, 4, `alias pac=yay`),
+		},
+		{
+			name:      "modified line of a partial",
+			ours:      edit(2, 3, `alias la='ls -A'`),
+			want:      mergeTestTemplate,
+			conflicts: []templateMergeConflict{{BaseLine: 3, Base: []string{`alias la='ls -a'`}, Ours: []string{`alias la='ls -A'`}, Partial: filepath.Join(partialsDir, "aliases")}},
+		},
+		{
+			name:      "added line inside a partial",
+			ours:      edit(2, 2, `alias l=ls`),
+			want:      mergeTestTemplate,
+			conflicts: []templateMergeConflict{{BaseLine: 3, Ours: []string{`alias l=ls`}, Partial: filepath.Join(partialsDir, "aliases")}},
+		},
+		{
+			name:      "line the template changed too",
+			base:      edit(3, 4, `alias pac=pacman -S`),
+			ours:      edit(3, 4, `alias pac=pacman -Syu`),
+			want:      mergeTestTemplate,
+			conflicts: []templateMergeConflict{{BaseLine: 4, Base: []string{`alias pac=pacman -S`}, Ours: []string{`alias pac=pacman -Syu`}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := test.base
+			if base == "" {
+				base = rendered
+			}
+			merge := mergeOutputIntoTemplate(mergeTestTemplate, base, test.ours, rendered, origins)
+
+			// As smartMergeIntoTemplate does
+			var candidates [][]int
+			for i, edit := range merge.Edits {
+				if edit.Kind == templateModify {
+					line := restoreVariables(edit.Old, edit.Lines[0], dm.variables)
+					merge.Edits[i].Lines[0] = restoreSecrets(edit.Old, line, dm.secretsInUse())
+				}
+				if edit.Candidates != nil {
+					candidates = append(candidates, edit.Candidates)
+				}
+			}
+
+			if got := applyTemplateEdits(mergeTestTemplate, merge.Edits); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("merged template:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+			if !reflect.DeepEqual(candidates, test.candidates) {
+				t.Errorf("insertion candidates %v, want %v", candidates, test.candidates)
+			}
+			if !reflect.DeepEqual(merge.Conflicts, test.conflicts) {
+				t.Errorf("conflicts %+v, want %+v", merge.Conflicts, test.conflicts)
+			}
+		})
+	}
+}
+
+func TestApplyTemplateEdits(t *testing.T) {
+	lines := []string{"a", "b", "c"}
+	tests := []struct {
+		name  string
+		edits []templateEdit
+		want  []string
+	}{
+		{"nothing", nil, []string{"a", "b", "c"}},
+		{"modify", []templateEdit{{Kind: templateModify, Line: 1, Old: "b", Lines: []string{"B"}}}, []string{"a", "B", "c"}},
+		{"remove", []templateEdit{{Kind: templateRemove, Line: 0, Old: "a"}}, []string{"b", "c"}},
+		{"add at the end", []templateEdit{{Kind: templateAdd, Line: 3, Lines: []string{"d", "e"}}}, []string{"a", "b", "c", "d", "e"}},
+		{
+			"line numbers refer to the original template",
+			[]templateEdit{
+				{Kind: templateRemove, Line: 0, Old: "a"},
+				{Kind: templateAdd, Line: 1, Lines: []string{"x"}},
+				{Kind: templateModify, Line: 2, Old: "c", Lines: []string{"C"}},
+			},
+			[]string{"x", "b", "C"},
+		},
+		{
+			"edits at the same line keep their order",
+			[]templateEdit{
+				{Kind: templateAdd, Line: 1, Lines: []string{"x"}},
+				{Kind: templateAdd, Line: 1, Lines: []string{"y"}},
+			},
+			[]string{"a", "x", "y", "b", "c"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := applyTemplateEdits(lines, test.edits); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+	if !reflect.DeepEqual(lines, []string{"a", "b", "c"}) {
+		t.Errorf("the template lines were changed in place: %q", lines)
+	}
+}
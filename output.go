@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Where rendered template output is written
+const (
+	templateOutputRepo   = "repo"   // Next to the template in the dotfiles repository, then linked (default)
+	templateOutputTarget = "target" // Straight to where it is deployed, never into the repository
+)
+
+func isValidTemplateOutput(mode string) bool {
+	switch mode {
+	case "", templateOutputRepo, templateOutputTarget:
+		return true
+	}
+	return false
+}
+
+// rendersToTarget reports whether templates are rendered straight to their targets
+func (dm *DotfilesManager) rendersToTarget() bool {
+	return dm.Config.TemplateOutput == templateOutputTarget
+}
+
+// templateOutput returns the file a template is rendered to, or "" if it
+// renders to a target and has not been deployed yet
+func (dm *DotfilesManager) templateOutput(templatePath string) string {
+	for _, entry := range dm.State.Entries {
+		// Output left in the repository from before a migration is not deployed anymore
+		if entry.Type == stateEntryTemplate && entry.Source == templatePath && !(dm.rendersToTarget() && isWithin(entry.Target, dm.DotfilesDir)) {
+			return entry.Target
+		}
+	}
+	if dm.rendersToTarget() {
+		return ""
+	}
+	return strings.TrimSuffix(templatePath, ".template")
+}
+
+// hasTemplates reports whether a package places any template along with its
+// other files, rather than at an explicit destination
+func (dm *DotfilesManager) hasTemplates(packageName string) bool {
+	packageDir := filepath.Join(dm.DotfilesDir, packageName)
+	excludes, err := dm.packageExcludes(packageName)
+	if err != nil {
+		return false
+	}
+	mapped, err := dm.mappedFiles(packageName)
+	if err != nil {
+		return false
+	}
+	mappedNames := mappedSources(mapped)
+
+	found := false
+	filepath.Walk(packageDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || found {
+			return filepath.SkipDir
+		}
+		relPath, _ := filepath.Rel(packageDir, path)
+		if relPath != "." && excludes.matches(relPath, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		found = !info.IsDir() && strings.HasSuffix(path, ".template") && !mappedNames[filepath.ToSlash(relPath)]
+		return nil
+	})
+	return found
+}
+
+// repoTemplates returns every template in the dotfiles repository, relative to it
+func (dm *DotfilesManager) repoTemplates() ([]string, error) {
+	var templates []string
+	err := filepath.Walk(dm.DotfilesDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && (info.Name() == ".git" || path == filepath.Join(dm.DotfilesDir, partialsDir)) {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && strings.HasSuffix(path, ".template") {
+			relPath, _ := filepath.Rel(dm.DotfilesDir, path)
+			templates = append(templates, filepath.ToSlash(relPath))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan for templates: %w", err)
+	}
+	sort.Strings(templates)
+	return templates, nil
+}
+
+// updateIgnoredOutputs rewrites the section of .gitignore that lists the
+// output of every template, so rendered files are never committed
+func (dm *DotfilesManager) updateIgnoredOutputs() error {
+	templates, err := dm.repoTemplates()
+	if err != nil {
+		return err
+	}
+	var outputs []string
+	for _, template := range templates {
+		outputs = append(outputs, strings.TrimSuffix(template, ".template"))
+	}
+	return dm.updateIgnoreSection("template outputs", outputs)
+}
+
+// updateIgnoreSection rewrites a section of .gitignore that dotctl generates,
+// listing paths relative to the dotfiles directory. Everything outside the
+// section is left as it is.
+func (dm *DotfilesManager) updateIgnoreSection(name string, paths []string) error {
+	begin := "# BEGIN dotctl " + name + " (generated, do not edit)"
+	end := "# END dotctl " + name
+
+	ignorePath := filepath.Join(dm.DotfilesDir, ".gitignore")
+	data, err := os.ReadFile(ignorePath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %w", ignorePath, err)
+	}
+
+	var kept []string
+	inSection := false
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		switch {
+		case line == begin:
+			inSection = true
+		case line == end:
+			inSection = false
+		case !inSection && (line != "" || len(kept) > 0):
+			kept = append(kept, line)
+		}
+	}
+	for len(kept) > 0 && kept[len(kept)-1] == "" {
+		kept = kept[:len(kept)-1]
+	}
+
+	if len(paths) > 0 {
+		if len(kept) > 0 {
+			kept = append(kept, "")
+		}
+		kept = append(kept, begin)
+		for _, path := range paths {
+			kept = append(kept, "/"+path)
+		}
+		kept = append(kept, end)
+	}
+
+	content := strings.Join(kept, "\n")
+	if content != "" {
+		content += "\n"
+	}
+	if content == string(data) {
+		return nil
+	}
+	if err := os.WriteFile(ignorePath, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to update %s: %w", ignorePath, err)
+	}
+	fmt.Printf("✓ Updated the %s listed in .gitignore (%d)\n", name, len(paths))
+	return nil
+}
+
+// migrateTemplateOutputs switches an existing repository to rendering
+// templates straight to their targets. Outputs committed next to their
+// templates are untracked and deleted, and the packages are deployed again.
+func (dm *DotfilesManager) migrateTemplateOutputs(dryRun bool) error {
+	templates, err := dm.repoTemplates()
+	if err != nil {
+		return err
+	}
+
+	// Local edits would be lost with the output, so they have to be merged first
+	var outputs, edited []string
+	for _, template := range templates {
+		templatePath := filepath.Join(dm.DotfilesDir, filepath.FromSlash(template))
+		outputPath := strings.TrimSuffix(templatePath, ".template")
+		content, err := os.ReadFile(outputPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", outputPath, err)
+		}
+		outputs = append(outputs, outputPath)
+
+		rendered, err := dm.renderTemplateFile(templatePath)
+		if err != nil {
+			return err
+		}
+		entry := dm.State.find(outputPath)
+		generated := entry != nil && entry.Type == stateEntryTemplate && entry.Hash == hashContent(content)
+		if string(content) != rendered && !generated {
+			edited = append(edited, outputPath)
+		}
+	}
+	if len(edited) > 0 {
+		fmt.Println("These template outputs have local changes:")
+		for _, path := range edited {
+			fmt.Printf("  %s\n", path)
+		}
+		return fmt.Errorf("merge them into their templates with 'dotctl merge-resolve' before migrating")
+	}
+
+	if dryRun {
+		fmt.Printf("DRY RUN: Would set template_output: %s in %s\n", templateOutputTarget, dm.ConfigFile)
+		fmt.Println("DRY RUN: Would list template outputs in .gitignore")
+		for _, path := range outputs {
+			fmt.Printf("DRY RUN: Would untrack and remove %s\n", path)
+		}
+		fmt.Println("DRY RUN: Would deploy packages again to render templates at their targets")
+		return nil
+	}
+
+	dm.Config.TemplateOutput = templateOutputTarget
+	if err := dm.saveConfig(nil); err != nil {
+		return fmt.Errorf("failed to save configuration: %w", err)
+	}
+	fmt.Printf("✓ Set template_output: %s\n", templateOutputTarget)
+
+	if err := dm.updateIgnoredOutputs(); err != nil {
+		return err
+	}
+
+	isRepo := false
+	if _, err := os.Stat(filepath.Join(dm.DotfilesDir, ".git")); err == nil {
+		isRepo = true
+	}
+	for _, path := range outputs {
+		relPath, _ := filepath.Rel(dm.DotfilesDir, path)
+		if isRepo {
+			if err := dm.runGitCommand("rm", "--cached", "--quiet", "--ignore-unmatch", relPath); err != nil {
+				return fmt.Errorf("failed to untrack %s: %w", relPath, err)
+			}
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+		fmt.Printf("✓ Removed %s from the repository\n", relPath)
+	}
+
+	fmt.Println()
+	dm.deployAll(nil, false)
+	fmt.Println("\nRun 'dotctl sync' to commit the migration")
+	return nil
+}
@@ -0,0 +1,1171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Operation types that make up a deployment plan
+const (
+	opMkdir    = "mkdir"     // Create directory Target
+	opLink     = "link"      // Create a symlink at Target pointing to Source
+	opUnlink   = "unlink"    // Remove the symlink or generated file at Target
+	opRender   = "render"    // Write Content rendered from template Source to Target
+	opBackup   = "backup"    // Move Target out of the way to backup location Source
+	opRestore  = "restore"   // Move backup Source back to Target
+	opRemove   = "remove"    // Delete Target (conflict policy: overwrite)
+	opRmdir    = "rmdir"     // Remove directory Target if it is empty
+	opMove     = "move"      // Move Source to Target
+	opAdopt    = "adopt"     // Add Package to the configuration for Systems
+	opForget   = "forget"    // Drop Target from the deployment state without touching it
+	opSkip     = "skip"      // Leave Target alone, see Reason
+	opCopy     = "copy"      // Copy package file Source to Target
+	opCopyBack = "copy-back" // Copy the modified deployed file Target back over package file Source
+	opDecrypt  = "decrypt"   // Decrypt encrypted package file Source to Target
+	opEncrypt  = "encrypt"   // Encrypt plaintext file Source to Target and remove Source
+)
+
+const deploymentPlanVersion = 1
+
+// Operation is a single typed step of a deployment plan
+type Operation struct {
+	Type    string   `json:"type"`
+	Package string   `json:"package"`
+	Source  string   `json:"source,omitempty"`
+	Target  string   `json:"target,omitempty"`
+	Content string   `json:"content,omitempty"`
+	Systems []string `json:"systems,omitempty"`
+	Reason  string   `json:"reason,omitempty"`
+	Owner   string   `json:"owner,omitempty"`  // Package recorded in the state when it differs from Package
+	Secret  bool     `json:"secret,omitempty"` // Rendered Content contains secrets, and is left out of saved plans
+}
+
+// DeploymentPlan is the full list of operations a command will perform
+type DeploymentPlan struct {
+	Version     int         `json:"version"`
+	Command     string      `json:"command"`
+	System      string      `json:"system"`
+	DotfilesDir string      `json:"dotfiles_dir"`
+	TargetHome  string      `json:"target_home,omitempty"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Packages    []string    `json:"packages"`
+	Operations  []Operation `json:"operations"`
+
+	dirs  map[string]bool      // Directories already planned for creation
+	links map[string]Operation // Links already planned, by target
+	gone  map[string]bool      // Targets already planned for removal
+
+	removing map[string]bool       // Packages being removed entirely by this plan
+	deferred map[string]StateEntry // Directories left for the package whose removal empties them
+}
+
+func (dm *DotfilesManager) newPlan(command string) *DeploymentPlan {
+	return &DeploymentPlan{
+		Version:     deploymentPlanVersion,
+		Command:     command,
+		System:      dm.System,
+		DotfilesDir: dm.DotfilesDir,
+		TargetHome:  dm.TargetHome,
+		CreatedAt:   time.Now(),
+		dirs:        make(map[string]bool),
+		links:       make(map[string]Operation),
+		gone:        make(map[string]bool),
+	}
+}
+
+func (p *DeploymentPlan) add(op Operation) {
+	p.Operations = append(p.Operations, op)
+
+	// Later planning sees the filesystem as earlier operations will leave it
+	switch {
+	case p.dirs == nil:
+	case op.Type == opMkdir:
+		p.dirs[op.Target] = true
+	case op.Type == opLink:
+		p.links[op.Target] = op
+		delete(p.gone, op.Target)
+	case op.Type == opUnlink || op.Type == opRmdir:
+		delete(p.links, op.Target)
+		p.gone[op.Target] = true
+	}
+}
+
+// contentHash returns the hash path will have once the plan's renders have run
+func (p *DeploymentPlan) contentHash(path string) string {
+	for i := len(p.Operations) - 1; i >= 0; i-- {
+		if op := p.Operations[i]; op.Type == opRender && op.Target == path {
+			return hashContent([]byte(op.Content))
+		}
+	}
+	return hashFile(path)
+}
+
+// discard drops the operations from index onwards, e.g. after planning a package failed
+func (p *DeploymentPlan) discard(from int) {
+	for _, op := range p.Operations[from:] {
+		switch op.Type {
+		case opMkdir:
+			delete(p.dirs, op.Target)
+		case opLink:
+			delete(p.links, op.Target)
+		case opUnlink, opRmdir:
+			delete(p.gone, op.Target)
+		}
+	}
+	p.Operations = p.Operations[:from]
+}
+
+// owner returns the package the result of the operation belongs to
+func (op Operation) owner() string {
+	if op.Owner != "" {
+		return op.Owner
+	}
+	return op.Package
+}
+
+func (op Operation) String() string {
+	var detail string
+	switch op.Type {
+	case opLink:
+		detail = fmt.Sprintf("%s -> %s", op.Target, op.Source)
+		if op.Owner != "" {
+			detail += " (for " + op.Owner + ")"
+		}
+	case opMove, opRender, opCopy, opDecrypt, opEncrypt:
+		detail = fmt.Sprintf("%s -> %s", op.Source, op.Target)
+	case opCopyBack:
+		detail = fmt.Sprintf("%s -> %s", op.Target, op.Source)
+	case opBackup:
+		detail = fmt.Sprintf("%s -> %s", op.Target, op.Source)
+	case opRestore:
+		detail = fmt.Sprintf("%s <- %s", op.Target, op.Source)
+	case opAdopt:
+		detail = fmt.Sprintf("%s for systems: %s", op.Package, strings.Join(op.Systems, ", "))
+	default:
+		detail = op.Target
+	}
+	if op.Reason != "" {
+		detail += " (" + op.Reason + ")"
+	}
+	return fmt.Sprintf("%-8s %s", op.Type, detail)
+}
+
+// printPlan prints the operations of a plan grouped by package
+func printPlan(w io.Writer, plan *DeploymentPlan) {
+	if len(plan.Operations) == 0 {
+		fmt.Fprintln(w, "  Nothing to do")
+		return
+	}
+
+	currentPackage := ""
+	for i, op := range plan.Operations {
+		if i == 0 || op.Package != currentPackage {
+			currentPackage = op.Package
+			fmt.Fprintf(w, "  %s:\n", currentPackage)
+		}
+		fmt.Fprintf(w, "    %s\n", op)
+	}
+}
+
+func savePlan(plan *DeploymentPlan, path string) error {
+	// Secrets are rendered again when the plan is applied rather than written to disk
+	saved := *plan
+	saved.Operations = append([]Operation(nil), plan.Operations...)
+	for i := range saved.Operations {
+		if saved.Operations[i].Secret {
+			saved.Operations[i].Content = ""
+		}
+	}
+
+	data, err := json.MarshalIndent(&saved, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal plan: %w", err)
+	}
+	data = append(data, '\n')
+
+	if path == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func loadPlan(path string) (*DeploymentPlan, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plan %s: %w", path, err)
+	}
+
+	var plan DeploymentPlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("failed to parse plan %s: %w", path, err)
+	}
+	if plan.Version != deploymentPlanVersion {
+		return nil, fmt.Errorf("unsupported plan version %d (expected %d)", plan.Version, deploymentPlanVersion)
+	}
+	return &plan, nil
+}
+
+// planDeploy builds the plan for deploying packages (default: all for current system)
+func (dm *DotfilesManager) planDeploy(packages []string, interactive bool) (*DeploymentPlan, []error) {
+	if len(packages) == 0 {
+		packages = dm.getPackagesForSystem("")
+	}
+
+	plan := dm.newPlan("deploy")
+	return plan, dm.planPackages(plan, packages, func(pkg string) error {
+		return dm.planPackageDeploy(plan, pkg, interactive)
+	})
+}
+
+// planUndeploy builds the plan for undeploying packages (default: all for current system)
+func (dm *DotfilesManager) planUndeploy(packages []string) (*DeploymentPlan, []error) {
+	if len(packages) == 0 {
+		packages = dm.getPackagesForSystem("")
+	}
+
+	plan := dm.newPlan("undeploy")
+	plan.removing = make(map[string]bool)
+	for _, pkg := range packages {
+		plan.removing[pkg] = true
+	}
+	return plan, dm.planPackages(plan, packages, func(pkg string) error {
+		return dm.planPackageUndeploy(plan, pkg)
+	})
+}
+
+// planPackages plans each package in turn. A package that fails to plan is
+// left out of the plan entirely so the remaining packages can still proceed.
+func (dm *DotfilesManager) planPackages(plan *DeploymentPlan, packages []string, planPackage func(string) error) []error {
+	var errs []error
+	for _, pkg := range packages {
+		planned := len(plan.Operations)
+		if err := planPackage(pkg); err != nil {
+			plan.discard(planned)
+			errs = append(errs, err)
+			continue
+		}
+		plan.Packages = append(plan.Packages, pkg)
+	}
+	return errs
+}
+
+// planPackageDeploy appends the operations needed to deploy a single package
+func (dm *DotfilesManager) planPackageDeploy(plan *DeploymentPlan, packageName string, interactive bool) error {
+	packageDir := filepath.Join(dm.DotfilesDir, packageName)
+
+	if _, err := os.Stat(packageDir); os.IsNotExist(err) {
+		return fmt.Errorf("package '%s' not found at %s", packageName, packageDir)
+	}
+
+	root, spread, err := dm.resolveTarget(packageName)
+	if err != nil {
+		return err
+	}
+	mode, err := dm.linkMode(packageName)
+	if err != nil {
+		return err
+	}
+	mapped, err := dm.mappedFiles(packageName)
+	if err != nil {
+		return err
+	}
+
+	if spread || mode != linkModeDir {
+		if mode != linkModeDir {
+			err = dm.planTreeDeploy(plan, packageName, packageDir, root, mapped, interactive)
+		} else {
+			err = dm.planShellPackage(plan, packageName, packageDir, root, mapped, interactive)
+		}
+		if err != nil {
+			return err
+		}
+		return dm.planMappedFiles(plan, packageName, mapped, interactive)
+	}
+
+	mappedTargets := make(map[string]bool)
+	for _, file := range mapped {
+		mappedTargets[file.Target] = true
+	}
+
+	// Links recorded for this package at another location (e.g. after flipping
+	// the home setting) would otherwise be left dangling, as would a tree
+	// deployed with link_mode: files
+	var stale []StateEntry
+	targetFree := false
+	for _, entry := range dm.State.entriesForPackage(packageName) {
+		switch {
+		case mappedTargets[entry.Target]:
+			continue
+		case (entry.Type == stateEntryLink || entry.Type == stateEntryCopy || entry.Type == stateEntryDecrypted) && entry.Target != root:
+			stale = append(stale, entry)
+		case entry.Type == stateEntryDir && (entry.Target == root || strings.HasPrefix(entry.Target, root+string(filepath.Separator))):
+			stale = append(stale, entry)
+			targetFree = targetFree || entry.Target == root
+		}
+	}
+	if err := dm.planRemoveEntries(plan, stale); err != nil {
+		return err
+	}
+
+	dm.planMissingDirs(plan, packageName, filepath.Dir(root))
+
+	excludes, err := dm.packageExcludes(packageName)
+	if err != nil {
+		return err
+	}
+
+	// Move whatever already sits at the symlink path out of the way
+	if !targetFree {
+		proceed, err := dm.planTarget(plan, packageName, packageDir, root)
+		if err != nil || !proceed {
+			return err
+		}
+	}
+
+	// Check if package contains templates
+	if err := dm.planPackageTemplates(plan, packageName, packageDir, excludes, mappedSources(mapped), interactive); err != nil {
+		return fmt.Errorf("failed to process templates in %s: %w", packageName, err)
+	}
+
+	plan.add(Operation{Type: opLink, Package: packageName, Source: packageDir, Target: root})
+	return dm.planMappedFiles(plan, packageName, mapped, interactive)
+}
+
+// planShellPackage links each file of the shell package directly into the home directory
+func (dm *DotfilesManager) planShellPackage(plan *DeploymentPlan, packageName, packageDir, homeDir string, mapped []mappedFile, interactive bool) error {
+	entries, err := os.ReadDir(packageDir)
+	if err != nil {
+		return fmt.Errorf("failed to read shell package directory: %w", err)
+	}
+
+	excludes, err := dm.packageExcludes(packageName)
+	if err != nil {
+		return err
+	}
+
+	// Files removed from or excluded in the package leave links behind that
+	// nothing else would clean up
+	var stale []StateEntry
+	for _, entry := range dm.State.entriesForPackage(packageName) {
+		if entry.Type == stateEntryDir {
+			continue
+		}
+		info, err := os.Lstat(entry.Source)
+		if os.IsNotExist(err) {
+			stale = append(stale, entry)
+		} else if relPath, relErr := filepath.Rel(packageDir, entry.Source); err == nil && relErr == nil && excludes.matches(relPath, info.IsDir()) {
+			stale = append(stale, entry)
+		}
+	}
+	if err := dm.planRemoveEntries(plan, stale); err != nil {
+		return err
+	}
+
+	copies, err := dm.packageCopies(packageName)
+	if err != nil {
+		return err
+	}
+	encrypted, err := dm.packageEncrypted(packageName)
+	if err != nil {
+		return err
+	}
+	mappedNames := mappedSources(mapped)
+
+	for _, entry := range entries {
+		fileName := entry.Name()
+		if excludes.matches(fileName, entry.IsDir()) || mappedNames[fileName] {
+			continue
+		}
+		sourcePath := filepath.Join(packageDir, fileName)
+		targetPath := filepath.Join(homeDir, fileName)
+
+		// Check if this is a template file
+		if !entry.IsDir() && strings.HasSuffix(fileName, ".template") {
+			targetPath = filepath.Join(homeDir, strings.TrimSuffix(fileName, ".template"))
+			if err := dm.planRenderAtTarget(plan, packageName, sourcePath, targetPath, interactive); err != nil {
+				return fmt.Errorf("failed to process template %s: %w", fileName, err)
+			}
+			continue
+		}
+
+		if !entry.IsDir() && isEncrypted(encrypted, fileName) {
+			if err := dm.planDecrypt(plan, packageName, sourcePath, filepath.Join(homeDir, decryptedName(fileName))); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !entry.IsDir() && copies.matches(fileName, false) {
+			if err := dm.planCopy(plan, packageName, sourcePath, hashFile(sourcePath), targetPath, false, interactive); err != nil {
+				return err
+			}
+			continue
+		}
+
+		proceed, err := dm.planTarget(plan, packageName, sourcePath, targetPath)
+		if err != nil {
+			return err
+		}
+		if !proceed {
+			continue
+		}
+
+		plan.add(Operation{Type: opLink, Package: packageName, Source: sourcePath, Target: targetPath})
+	}
+
+	return nil
+}
+
+// planPackageTemplates renders every .template file inside a package next to its template
+func (dm *DotfilesManager) planPackageTemplates(plan *DeploymentPlan, packageName, packageDir string, excludes *pathMatcher, mapped map[string]bool, interactive bool) error {
+	return filepath.Walk(packageDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if relPath, _ := filepath.Rel(packageDir, path); relPath != "." && excludes.matches(relPath, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Skip directories
+		if info.IsDir() {
+			return nil
+		}
+
+		// Check if this is a template file; mapped templates are rendered with their file
+		if relPath, _ := filepath.Rel(packageDir, path); strings.HasSuffix(info.Name(), ".template") && !mapped[filepath.ToSlash(relPath)] {
+			outputPath := strings.TrimSuffix(path, ".template")
+			if err := dm.planRender(plan, packageName, path, outputPath, interactive); err != nil {
+				return fmt.Errorf("failed to process template %s: %w", path, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// planRender renders a template now so the plan contains exactly what will be written
+func (dm *DotfilesManager) planRender(plan *DeploymentPlan, packageName, templatePath, outputPath string, interactive bool) error {
+	// Process template with current system
+	processedContent, err := dm.renderTemplateFile(templatePath)
+	if err != nil {
+		return err
+	}
+
+	if interactive {
+		if existingContent, err := os.ReadFile(outputPath); err == nil && string(existingContent) != processedContent {
+			shouldOverwrite, err := dm.promptForTemplateOverwrite(templatePath, outputPath, string(existingContent), processedContent)
+			if err != nil {
+				return fmt.Errorf("failed to prompt for overwrite: %w", err)
+			}
+			if !shouldOverwrite {
+				plan.add(Operation{Type: opSkip, Package: packageName, Target: outputPath, Reason: "user declined overwrite"})
+				return nil
+			}
+		}
+	}
+
+	plan.add(Operation{
+		Type:    opRender,
+		Package: packageName,
+		Source:  templatePath,
+		Target:  outputPath,
+		Content: processedContent,
+		Secret:  dm.templateUsesSecrets(templatePath),
+	})
+	return nil
+}
+
+// planRenderAtTarget renders a template straight to where it is deployed
+// instead of next to the template
+func (dm *DotfilesManager) planRenderAtTarget(plan *DeploymentPlan, packageName, templatePath, targetPath string, interactive bool) error {
+	// Only files we generated ourselves go through the template overwrite flow
+	if recorded := dm.State.find(targetPath); recorded == nil || recorded.Type != stateEntryTemplate {
+		proceed, err := dm.planTarget(plan, packageName, templatePath, targetPath)
+		if err != nil || !proceed {
+			return err
+		}
+	}
+	return dm.planRender(plan, packageName, templatePath, targetPath, interactive)
+}
+
+// planMissingDirs plans the creation of dir and any missing parents
+func (dm *DotfilesManager) planMissingDirs(plan *DeploymentPlan, packageName, dir string) {
+	var missing []string
+	for current := dir; ; current = filepath.Dir(current) {
+		if _, err := os.Lstat(current); err == nil || plan.dirs[current] {
+			break
+		}
+		missing = append(missing, current)
+		if filepath.Dir(current) == current {
+			break
+		}
+	}
+
+	for i := len(missing) - 1; i >= 0; i-- {
+		plan.add(Operation{Type: opMkdir, Package: packageName, Target: missing[i]})
+	}
+}
+
+// planTarget plans clearing the way for deploying source at target according to
+// the package's conflict policy. It returns false when the target should be skipped.
+func (dm *DotfilesManager) planTarget(plan *DeploymentPlan, packageName, source, target string) (bool, error) {
+	if _, err := os.Lstat(target); os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to inspect %s: %w", target, err)
+	}
+
+	// Replacing our own previous deployment is never a conflict
+	if dm.isManagedTarget(target, source) {
+		plan.add(Operation{Type: opUnlink, Package: packageName, Target: target})
+		return true, nil
+	}
+
+	policy, err := dm.conflictPolicy(packageName)
+	if err != nil {
+		return false, err
+	}
+
+	switch policy {
+	case conflictSkip:
+		plan.add(Operation{Type: opSkip, Package: packageName, Target: target, Reason: "already exists, conflict policy: skip"})
+		return false, nil
+	case conflictFail:
+		return false, fmt.Errorf("%s already exists and is not managed by dotctl (conflict policy: fail)", target)
+	case conflictOverwrite:
+		plan.add(Operation{Type: opRemove, Package: packageName, Target: target})
+		return true, nil
+	default:
+		plan.add(Operation{Type: opBackup, Package: packageName, Source: dm.backupPathFor(target), Target: target})
+		return true, nil
+	}
+}
+
+// planRemoveEntries plans the removal of recorded state entries, files first
+// and then directories deepest first
+func (dm *DotfilesManager) planRemoveEntries(plan *DeploymentPlan, entries []StateEntry) error {
+	// Pick up directories another package left behind because they contain our files
+	for target, deferred := range plan.deferred {
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Target, target+string(filepath.Separator)) {
+				deferred.Package = entry.Package
+				entries = append(entries, deferred)
+				delete(plan.deferred, target)
+				break
+			}
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		iDir := entries[i].Type == stateEntryDir
+		jDir := entries[j].Type == stateEntryDir
+		if iDir != jDir {
+			return jDir
+		}
+		return len(entries[i].Target) > len(entries[j].Target)
+	})
+
+	removing := make(map[string]bool)
+	for _, entry := range entries {
+		removing[entry.Target] = true
+	}
+
+	for _, entry := range entries {
+		// Directories unfolded for this package fold back into the remaining package's link
+		if entry.Type == stateEntryDir && (dm.planRefold(plan, entry, removing) || dm.deferDir(plan, entry, removing)) {
+			continue
+		}
+		if err := dm.planRemoveEntry(plan, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deferDir postpones removing a directory that still holds files of another
+// package this plan removes as well
+func (dm *DotfilesManager) deferDir(plan *DeploymentPlan, entry StateEntry, removing map[string]bool) bool {
+	children, err := os.ReadDir(entry.Target)
+	if err != nil {
+		return false
+	}
+	for _, child := range children {
+		path := filepath.Join(entry.Target, child.Name())
+		if removing[path] || plan.gone[path] {
+			continue
+		}
+		if recorded := dm.State.find(path); recorded != nil && recorded.Package != entry.Package && plan.removing[recorded.Package] {
+			if plan.deferred == nil {
+				plan.deferred = make(map[string]StateEntry)
+			}
+			plan.deferred[entry.Target] = entry
+			return true
+		}
+	}
+	return false
+}
+
+// planRemoveEntry plans removing a recorded filesystem object if it is still the one dotctl created
+func (dm *DotfilesManager) planRemoveEntry(plan *DeploymentPlan, entry StateEntry) error {
+	forget := Operation{Type: opForget, Package: entry.Package, Target: entry.Target}
+
+	// A directory refolded earlier in this plan turns paths below it into package files
+	for dir := filepath.Dir(entry.Target); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if _, linked := plan.links[dir]; linked {
+			plan.add(forget)
+			return nil
+		}
+	}
+
+	info, err := os.Lstat(entry.Target)
+	if os.IsNotExist(err) {
+		plan.add(forget)
+		dm.planRestore(plan, entry.Package, entry.Target)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to inspect %s: %w", entry.Target, err)
+	}
+
+	switch entry.Type {
+	case stateEntryLink:
+		if !isLinkTo(entry.Target, entry.Source) {
+			forget.Reason = "no longer points to " + entry.Source
+			plan.add(forget)
+			return nil
+		}
+
+	case stateEntryTemplate:
+		// Generated files inside the dotfiles directory are part of the package itself
+		if dm.packageForPath(entry.Target) != "" {
+			plan.add(forget)
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 || hashFile(entry.Target) != entry.Hash {
+			forget.Reason = "modified after it was generated"
+			plan.add(forget)
+			return nil
+		}
+
+	case stateEntryCopy:
+		if info.Mode()&os.ModeSymlink != 0 || hashFile(entry.Target) != entry.Hash {
+			forget.Reason = "modified after it was copied"
+			plan.add(forget)
+			return nil
+		}
+
+	case stateEntryDecrypted:
+		if info.Mode()&os.ModeSymlink != 0 || hashFile(entry.Target) != entry.Hash {
+			forget.Reason = "modified after it was decrypted, run 'dotctl sync' to keep the changes"
+			plan.add(forget)
+			return nil
+		}
+
+	case stateEntryDir:
+		plan.add(Operation{Type: opRmdir, Package: entry.Package, Target: entry.Target})
+		return nil
+	}
+
+	plan.add(Operation{Type: opUnlink, Package: entry.Package, Target: entry.Target})
+	dm.planRestore(plan, entry.Package, entry.Target)
+	return nil
+}
+
+// planRestore plans putting back the original that was backed up for target
+func (dm *DotfilesManager) planRestore(plan *DeploymentPlan, packageName, target string) {
+	if backup := dm.State.findBackup(target); backup != nil {
+		plan.add(Operation{Type: opRestore, Package: packageName, Source: backup.Backup, Target: target})
+	}
+}
+
+// planPackageUndeploy appends the operations needed to undeploy a single package
+func (dm *DotfilesManager) planPackageUndeploy(plan *DeploymentPlan, packageName string) error {
+	// Prefer the recorded deployment over recomputing paths from the current config
+	if entries := dm.State.entriesForPackage(packageName); len(entries) > 0 {
+		return dm.planRemoveEntries(plan, entries)
+	}
+
+	root, spread, err := dm.resolveTarget(packageName)
+	if err != nil {
+		return err
+	}
+	packageDir := filepath.Join(dm.DotfilesDir, packageName)
+
+	// Files placed at explicit destinations are only removed if they still link back here
+	mapped, err := dm.mappedFiles(packageName)
+	if err != nil {
+		return err
+	}
+	for _, file := range mapped {
+		if isLinkTo(file.Target, file.Source) {
+			plan.add(Operation{Type: opUnlink, Package: packageName, Target: file.Target})
+		}
+	}
+
+	mode, err := dm.linkMode(packageName)
+	if err != nil {
+		return err
+	}
+	switch {
+	case mode != linkModeDir:
+		return dm.planTreeUndeploy(plan, packageName, packageDir, root)
+	case spread:
+		// Shell package: remove individual files from home directory
+		return dm.planShellPackageUndeploy(plan, packageName, packageDir, root)
+	}
+
+	if _, err := os.Lstat(root); os.IsNotExist(err) {
+		plan.add(Operation{Type: opSkip, Package: packageName, Target: root, Reason: "not deployed"})
+		return nil
+	}
+
+	plan.add(Operation{Type: opUnlink, Package: packageName, Target: root})
+	return nil
+}
+
+func (dm *DotfilesManager) planShellPackageUndeploy(plan *DeploymentPlan, packageName, packageDir, homeDir string) error {
+	// For shell package, remove each symlinked file from home directory
+	entries, err := os.ReadDir(packageDir)
+	if err != nil {
+		return fmt.Errorf("failed to read shell package directory: %w", err)
+	}
+
+	excludes, err := dm.packageExcludes(packageName)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if excludes.matches(entry.Name(), entry.IsDir()) {
+			continue
+		}
+		targetName := strings.TrimSuffix(entry.Name(), ".template")
+		targetPath := filepath.Join(homeDir, targetName)
+
+		info, err := os.Lstat(targetPath)
+		if os.IsNotExist(err) {
+			continue // Skip if doesn't exist
+		}
+		if err != nil {
+			return fmt.Errorf("failed to inspect %s: %w", targetPath, err)
+		}
+		if info.IsDir() && info.Mode()&os.ModeSymlink == 0 {
+			plan.add(Operation{Type: opSkip, Package: packageName, Target: targetPath, Reason: "exists as a real directory (not a symlink)"})
+			continue
+		}
+
+		plan.add(Operation{Type: opUnlink, Package: packageName, Target: targetPath})
+	}
+
+	return nil
+}
+
+// planCleanup plans removing deployments of packages that are no longer configured or whose sources are gone
+func (dm *DotfilesManager) planCleanup() (*DeploymentPlan, error) {
+	plan := dm.newPlan("cleanup")
+	plan.removing = make(map[string]bool)
+
+	var stale []StateEntry
+	for _, entry := range dm.State.Entries {
+		_, configured := dm.Config.Packages[entry.Package]
+		switch {
+		case !configured:
+			stale = append(stale, entry)
+			plan.removing[entry.Package] = true
+		case entry.Type == stateEntryDir:
+			continue
+		case entry.Source != "":
+			if _, err := os.Stat(entry.Source); os.IsNotExist(err) {
+				stale = append(stale, entry)
+				continue
+			}
+			if _, err := os.Lstat(entry.Target); os.IsNotExist(err) {
+				stale = append(stale, entry)
+			}
+		}
+	}
+
+	// Keep each package's operations together so it is applied as one unit
+	stalePackages := make(map[string][]StateEntry)
+	for _, entry := range stale {
+		if _, seen := stalePackages[entry.Package]; !seen {
+			plan.Packages = append(plan.Packages, entry.Package)
+		}
+		stalePackages[entry.Package] = append(stalePackages[entry.Package], entry)
+	}
+
+	for _, pkg := range plan.Packages {
+		if err := dm.planRemoveEntries(plan, stalePackages[pkg]); err != nil {
+			return plan, err
+		}
+	}
+	return plan, nil
+}
+
+// Progress messages for each kind of plan
+var planVerbs = map[string][3]string{
+	"deploy":   {"Deploying", "deployed", "Deployment"},
+	"undeploy": {"Undeploying", "undeployed", "Undeployment"},
+	"adopt":    {"Adopting", "adopted", "Adoption"},
+	"cleanup":  {"Cleaning up", "cleaned up", "Cleanup"},
+	"doctor":   {"Repairing", "repaired", "Repair"},
+}
+
+var defaultPlanVerbs = [3]string{"Applying", "applied", "Apply"}
+
+// runPlan prints the plan in dry-run mode and applies it otherwise.
+// planFailures counts packages that could not be planned for the summary.
+func (dm *DotfilesManager) runPlan(plan *DeploymentPlan, dryRun bool, atomic bool, planFailures int) error {
+	if dryRun {
+		fmt.Println("DRY RUN: Would apply the following plan:")
+		printPlan(dm.out, plan)
+		return nil
+	}
+
+	succeeded, err := dm.applyPlan(plan, atomic)
+	if err != nil && atomic {
+		return err
+	}
+
+	verbs, ok := planVerbs[plan.Command]
+	if !ok {
+		verbs = defaultPlanVerbs
+	}
+	fmt.Printf("\n%s complete: %d/%d packages successful\n", verbs[2], succeeded, len(plan.Packages)+planFailures)
+	return err
+}
+
+// applyPlan executes a plan verbatim and returns the number of packages that
+// were applied successfully. Each package is applied as its own transaction so
+// a failing package is left untouched; with atomic set, the whole plan is a
+// single transaction and any failure undoes everything.
+func (dm *DotfilesManager) applyPlan(plan *DeploymentPlan, atomic bool) (int, error) {
+	verbs, ok := planVerbs[plan.Command]
+	if !ok {
+		verbs = defaultPlanVerbs
+	}
+
+	failed := make(map[string]bool)
+	configChanged := false
+
+	if atomic {
+		dm.beginTransaction()
+	}
+
+	currentPackage := ""
+	for i, op := range plan.Operations {
+		if failed[op.Package] {
+			continue
+		}
+
+		if i == 0 || op.Package != currentPackage {
+			if currentPackage != "" && !atomic {
+				dm.finishPackage(currentPackage, verbs)
+			}
+			currentPackage = op.Package
+			if !atomic {
+				dm.beginTransaction()
+			}
+			fmt.Printf("%s %s...\n", verbs[0], currentPackage)
+		}
+
+		if err := dm.applyOperation(op); err != nil {
+			fmt.Printf("✗ %s: %v\n", op.Package, err)
+
+			rolledBack, rollbackErr := dm.rollbackTransaction()
+			for _, step := range rolledBack {
+				fmt.Printf("UNDO: %s\n", step)
+			}
+
+			if atomic {
+				if rollbackErr != nil {
+					return 0, fmt.Errorf("%s of %s failed and rollback was incomplete: %w", strings.ToLower(verbs[2]), op.Package, rollbackErr)
+				}
+				return 0, fmt.Errorf("%s of %s failed, rolled back %d change(s)", strings.ToLower(verbs[2]), op.Package, len(rolledBack))
+			}
+			if rollbackErr != nil {
+				fmt.Printf("Warning: %v\n", rollbackErr)
+			}
+			failed[op.Package] = true
+			currentPackage = ""
+			continue
+		}
+
+		if op.Type == opAdopt {
+			configChanged = true
+		}
+	}
+
+	if atomic {
+		dm.commitTransaction()
+	} else if currentPackage != "" {
+		dm.finishPackage(currentPackage, verbs)
+	}
+
+	if configChanged {
+		if err := dm.saveConfig(nil); err != nil {
+			return 0, fmt.Errorf("failed to save configuration: %w", err)
+		}
+	}
+	if err := dm.saveState(); err != nil {
+		fmt.Printf("Warning: Failed to save deployment state: %v\n", err)
+	}
+
+	successCount := 0
+	for _, pkg := range plan.Packages {
+		if !failed[pkg] {
+			successCount++
+		}
+	}
+	return successCount, nil
+}
+
+func (dm *DotfilesManager) finishPackage(packageName string, verbs [3]string) {
+	dm.commitTransaction()
+	fmt.Printf("✓ Successfully %s %s\n", verbs[1], packageName)
+}
+
+// applyOperation performs a single plan operation and updates the deployment state
+func (dm *DotfilesManager) applyOperation(op Operation) error {
+	switch op.Type {
+	case opMkdir:
+		if _, err := os.Lstat(op.Target); err == nil {
+			return nil
+		}
+		return dm.ensureDir(op.Package, op.Target)
+
+	case opLink:
+		relativeSource, err := filepath.Rel(filepath.Dir(op.Target), op.Source)
+		if err != nil {
+			return fmt.Errorf("failed to calculate relative path: %w", err)
+		}
+		if err := dm.createSymlink(relativeSource, op.Target); err != nil {
+			return fmt.Errorf("failed to create symlink %s -> %s: %w", op.Target, relativeSource, err)
+		}
+		dm.recordLink(op.owner(), op.Source, op.Target)
+		fmt.Printf("LINK: %s -> %s\n", op.Target, relativeSource)
+
+	case opUnlink:
+		if info, err := os.Lstat(op.Target); err == nil {
+			// Real directories are never created by dotctl in place of a link
+			if info.IsDir() {
+				return fmt.Errorf("refusing to remove %s: it is a directory, not a link", op.Target)
+			}
+			if err := dm.removePath(op.Target); err != nil {
+				return fmt.Errorf("failed to remove %s: %w", op.Target, err)
+			}
+			fmt.Printf("UNLINK: %s\n", op.Target)
+		}
+		dm.State.remove(op.Target)
+
+	case opRemove:
+		if err := dm.removePath(op.Target); err != nil {
+			return fmt.Errorf("failed to remove existing %s: %w", op.Target, err)
+		}
+		dm.State.remove(op.Target)
+		fmt.Printf("OVERWRITE: %s\n", op.Target)
+
+	case opBackup:
+		return dm.backupTarget(op.Package, op.Target, op.Source)
+
+	case opRestore:
+		return dm.restoreBackup(op.Target, op.Source)
+
+	case opRender:
+		return dm.applyRender(op)
+
+	case opCopy:
+		return dm.applyCopy(op)
+
+	case opCopyBack:
+		return dm.applyCopyBack(op)
+
+	case opDecrypt:
+		return dm.applyDecrypt(op)
+
+	case opEncrypt:
+		return dm.applyEncrypt(op)
+
+	case opRmdir:
+		// Only empty directories are removed; anything else now belongs to the user
+		if err := dm.removeEmptyDir(op.Target); err == nil {
+			fmt.Printf("RMDIR: %s\n", op.Target)
+		}
+		dm.State.remove(op.Target)
+
+	case opMove:
+		if err := dm.renamePath(op.Source, op.Target); err != nil {
+			return fmt.Errorf("failed to move %s to %s: %w", op.Source, op.Target, err)
+		}
+		fmt.Printf("MOVE: %s -> %s\n", op.Source, op.Target)
+
+	case opAdopt:
+		previous, existed := dm.Config.Packages[op.Package]
+		if len(op.Systems) == 1 && isSimpleSystem(op.Systems[0]) {
+			dm.Config.Packages[op.Package] = op.Systems[0]
+		} else {
+			dm.Config.Packages[op.Package] = map[string]interface{}{
+				"systems": op.Systems,
+			}
+		}
+		dm.journal("added "+op.Package+" to configuration", func() error {
+			if existed {
+				dm.Config.Packages[op.Package] = previous
+			} else {
+				delete(dm.Config.Packages, op.Package)
+			}
+			return nil
+		})
+
+	case opForget:
+		dm.State.remove(op.Target)
+		if op.Reason != "" {
+			fmt.Printf("SKIP: %s %s\n", op.Target, op.Reason)
+		}
+
+	case opSkip:
+		fmt.Printf("SKIP: %s (%s)\n", op.Target, op.Reason)
+
+	default:
+		return fmt.Errorf("unknown operation type '%s'", op.Type)
+	}
+
+	return nil
+}
+
+// applyRender writes rendered template output, tracking overwrites of existing content.
+// Output containing secrets is only readable by its owner.
+func (dm *DotfilesManager) applyRender(op Operation) error {
+	if op.Secret && op.Content == "" {
+		// Saved plans leave secrets out
+		content, err := dm.renderTemplateFile(op.Source)
+		if err != nil {
+			return err
+		}
+		op.Content = content
+	}
+
+	// Keep the permissions of existing output, unless it has to be private
+	perm, currentPerm := os.FileMode(0644), os.FileMode(0)
+	if info, err := os.Stat(op.Target); err == nil {
+		perm, currentPerm = info.Mode().Perm(), info.Mode().Perm()
+	}
+	if op.Secret {
+		perm = 0600
+	}
+
+	if existingContent, err := os.ReadFile(op.Target); err == nil {
+		if string(existingContent) == op.Content && perm == currentPerm {
+			// Content is identical, no need to overwrite
+			dm.recordTemplate(op.Source, op.Target, op.Content, op.Secret)
+			return nil
+		}
+
+		// Track template overwrite for commit marking (before writing)
+		if string(existingContent) != op.Content {
+			fmt.Printf("TEMPLATE: Overwriting existing file %s (template takes precedence)\n", op.Target)
+			dm.trackTemplateOverwrite(op.Target)
+		}
+	}
+
+	if err := dm.writeFile(op.Target, []byte(op.Content), perm); err != nil {
+		return fmt.Errorf("failed to write processed template: %w", err)
+	}
+	dm.recordTemplate(op.Source, op.Target, op.Content, op.Secret)
+
+	fmt.Printf("TEMPLATE: %s -> %s\n", op.Source, op.Target)
+	return nil
+}
+
+// writePlan builds the plan a command would execute and prints it, or saves it
+// as JSON when output is set so it can be reviewed and run later with apply
+func (dm *DotfilesManager) writePlan(args []string, interactive bool, encrypt bool, output string) error {
+	command := "deploy"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	var plan *DeploymentPlan
+	var planErrors []error
+	switch command {
+	case "deploy":
+		plan, planErrors = dm.planDeploy(args, interactive)
+	case "undeploy":
+		plan, planErrors = dm.planUndeploy(args)
+	case "adopt":
+		var err error
+		if plan, err = dm.planAdopt(args, encrypt); err != nil {
+			return err
+		}
+		if plan == nil {
+			plan = dm.newPlan("adopt")
+		}
+	case "cleanup":
+		var err error
+		if plan, err = dm.planCleanup(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("cannot plan '%s' (use deploy, undeploy, adopt or cleanup)", command)
+	}
+
+	for _, err := range planErrors {
+		fmt.Fprintf(os.Stderr, "✗ %v\n", err)
+	}
+
+	if output == "" {
+		fmt.Fprintf(dm.out, "Plan for %s on %s:\n", command, dm.System)
+		printPlan(dm.out, plan)
+	} else {
+		if err := savePlan(plan, output); err != nil {
+			return fmt.Errorf("failed to save plan: %w", err)
+		}
+		if output != "-" {
+			fmt.Fprintf(dm.out, "✓ Saved plan with %d operation(s) to %s\n", len(plan.Operations), output)
+		}
+	}
+
+	if len(planErrors) > 0 {
+		return fmt.Errorf("planning failed for %d package(s)", len(planErrors))
+	}
+	return nil
+}
+
+// applyPlanFile executes a plan previously saved with 'dotctl plan --output'
+func (dm *DotfilesManager) applyPlanFile(path string, dryRun, atomic bool) error {
+	plan, err := loadPlan(path)
+	if err != nil {
+		return err
+	}
+
+	if plan.System != dm.System {
+		fmt.Printf("Warning: Plan was created for system '%s', current system is '%s'\n", plan.System, dm.System)
+	}
+	if plan.DotfilesDir != dm.DotfilesDir {
+		fmt.Printf("Warning: Plan was created for dotfiles directory %s, current directory is %s\n", plan.DotfilesDir, dm.DotfilesDir)
+	}
+	if plan.TargetHome != dm.TargetHome {
+		// Targets in the plan are absolute, but the state would be recorded elsewhere
+		fmt.Printf("Warning: Plan was created for target home '%s', current target home is '%s'\n", plan.TargetHome, dm.TargetHome)
+	}
+
+	fmt.Printf("Applying %s plan from %s (created %s)\n", plan.Command, path, plan.CreatedAt.Format("2006-01-02 15:04:05"))
+	return dm.runPlan(plan, dryRun, atomic, 0)
+}
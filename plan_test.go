@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestHelperProcess runs dotctl with the arguments in DOTCTL_TEST_ARGS when
+// the test binary is started by runDotctl
+func TestHelperProcess(t *testing.T) {
+	args := os.Getenv("DOTCTL_TEST_ARGS")
+	if args == "" {
+		return
+	}
+	os.Args = append([]string{"dotctl"}, strings.Split(args, "\n")...)
+	main()
+	os.Exit(0)
+}
+
+// runDotctl runs dotctl in a separate process with home as $HOME, returning what
+// it printed to stdout and stderr
+func runDotctl(t *testing.T, home string, stdin []byte, args ...string) ([]byte, []byte, error) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+	cmd.Env = append(os.Environ(),
+		"DOTCTL_TEST_ARGS="+strings.Join(args, "\n"),
+		"HOME="+home,
+		"XDG_CONFIG_HOME="+filepath.Join(home, ".config"),
+		"XDG_DATA_HOME="+filepath.Join(home, ".local", "share"),
+		"XDG_STATE_HOME="+filepath.Join(home, ".local", "state"),
+	)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlanToStdoutIsJSON(t *testing.T) {
+	home := t.TempDir()
+	dotfiles := filepath.Join(home, ".dotfiles")
+	writeTestFile(t, filepath.Join(dotfiles, "dotctl.yaml"), "packages:\n  vim: all\n  shell:\n    systems: [all]\n    home: true\n")
+	writeTestFile(t, filepath.Join(dotfiles, "vim", "vimrc"), "set number\n")
+	writeTestFile(t, filepath.Join(dotfiles, "shell", ".zshrc.template"), "export EDITOR=vim\n")
+
+	stdout, stderr, err := runDotctl(t, home, nil, "--dotfiles-dir", dotfiles, "plan", "deploy", "-o", "-")
+	if err != nil {
+		t.Fatalf("plan failed: %v\n%s", err, stderr)
+	}
+
+	var plan DeploymentPlan
+	if err := json.Unmarshal(stdout, &plan); err != nil {
+		t.Fatalf("stdout is not a JSON plan: %v\n%s", err, stdout)
+	}
+	if plan.Command != "deploy" || len(plan.Operations) == 0 {
+		t.Fatalf("unexpected plan: %+v", plan)
+	}
+
+	// The plan piped into apply is carried out
+	_, stderr, err = runDotctl(t, home, stdout, "--dotfiles-dir", dotfiles, "apply", "-")
+	if err != nil {
+		t.Fatalf("apply failed: %v\n%s", err, stderr)
+	}
+	if content, err := os.ReadFile(filepath.Join(home, ".config", "vim", "vimrc")); err != nil || string(content) != "set number\n" {
+		t.Errorf("vimrc = %q, %v", content, err)
+	}
+	if content, err := os.ReadFile(filepath.Join(home, "shell", ".zshrc")); err != nil || string(content) != "export EDITOR=vim\n" {
+		t.Errorf(".zshrc = %q, %v", content, err)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SecretScanConfig is the secret_scan section of dotctl.yaml
+type SecretScanConfig struct {
+	AllowPaths []string `yaml:"allow_paths,omitempty" json:"allow_paths,omitempty"` // Files that are never scanned, as gitignore-style patterns
+	Allow      []string `yaml:"allow,omitempty" json:"allow,omitempty"`             // Regular expressions matching findings that are not secrets
+}
+
+// scanAllowMarker on a line keeps the scanner from reporting it
+const scanAllowMarker = "dotctl:allow"
+
+// secretRule is a pattern for a well-known kind of secret
+type secretRule struct {
+	name  string
+	regex *regexp.Regexp
+}
+
+var secretRules = []secretRule{
+	{"private key", regexp.MustCompile(`-----BEGIN ((RSA|DSA|EC|OPENSSH|PGP|ENCRYPTED) )?PRIVATE KEY( BLOCK)?-----`)},
+	{"AWS access key ID", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"AWS secret access key", regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?[A-Za-z0-9/+=]{40}\b`)},
+	{"GitHub token", regexp.MustCompile(`\b(ghp|gho|ghu|ghs|ghr)_[A-Za-z0-9]{36}\b`)},
+	{"GitHub token", regexp.MustCompile(`\bgithub_pat_[A-Za-z0-9_]{82}\b`)},
+	{"Slack token", regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}\b`)},
+}
+
+// secretAssignment matches a value assigned to something named like a secret.
+// Such values are reported when they look random enough to be one.
+var secretAssignment = regexp.MustCompile(`(?i)(key|token|secret|passw(or)?d|pwd|auth|credential)[A-Za-z0-9_.-]*["']?\s*[:=]\s*["']?([A-Za-z0-9+/=_.~-]{16,})`)
+
+// minSecretEntropy is the Shannon entropy in bits per character above which an
+// assigned value counts as random
+const minSecretEntropy = 3.5
+
+// sensitiveFiles are files that hold secrets by their name alone
+var sensitiveFiles = []string{
+	"id_rsa", "id_dsa", "id_ecdsa", "id_ed25519", "*.pem", "*.p12", "*.pfx", "*.key",
+	".netrc", ".pgpass", "credentials",
+}
+
+// scanFinding is a possible secret in the staged changes
+type scanFinding struct {
+	Path  string
+	Line  int // 0 for findings about the file itself
+	Rule  string
+	Match string
+}
+
+func (f scanFinding) String() string {
+	location := f.Path
+	if f.Line > 0 {
+		location += ":" + strconv.Itoa(f.Line)
+	}
+	if f.Match == "" {
+		return fmt.Sprintf("%s: %s", location, f.Rule)
+	}
+	return fmt.Sprintf("%s: %s (%s)", location, f.Rule, redact(f.Match))
+}
+
+// redact shows just enough of a possible secret to find it again
+func redact(value string) string {
+	if len(value) <= 8 {
+		return strings.Repeat("*", len(value))
+	}
+	return value[:4] + "…" + value[len(value)-4:]
+}
+
+// secretScanner holds the allowlist of a scan
+type secretScanner struct {
+	allowPaths *pathMatcher
+	allow      []*regexp.Regexp
+	files      *pathMatcher
+}
+
+// newSecretScanner compiles the allowlist from dotctl.yaml
+func (dm *DotfilesManager) newSecretScanner() (*secretScanner, error) {
+	scanner := &secretScanner{allowPaths: &pathMatcher{}, files: &pathMatcher{}}
+	if err := scanner.files.add(sensitiveFiles); err != nil {
+		return nil, err
+	}
+
+	config := dm.Config.SecretScan
+	if config == nil {
+		return scanner, nil
+	}
+	if err := scanner.allowPaths.add(config.AllowPaths); err != nil {
+		return nil, fmt.Errorf("secret_scan.allow_paths: %w", err)
+	}
+	for _, pattern := range config.Allow {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("secret_scan.allow: invalid expression '%s': %w", pattern, err)
+		}
+		scanner.allow = append(scanner.allow, regex)
+	}
+	return scanner, nil
+}
+
+// allowed reports whether a finding is on the allowlist
+func (s *secretScanner) allowed(finding scanFinding) bool {
+	if s.allowPaths.matches(finding.Path, false) {
+		return true
+	}
+	for _, regex := range s.allow {
+		if regex.MatchString(finding.Match) || (finding.Match == "" && regex.MatchString(finding.Path)) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanLine returns the possible secrets on an added line
+func (s *secretScanner) scanLine(path string, number int, line string) []scanFinding {
+	if strings.Contains(line, scanAllowMarker) {
+		return nil
+	}
+
+	var findings []scanFinding
+	for _, rule := range secretRules {
+		for _, match := range rule.regex.FindAllString(line, -1) {
+			findings = append(findings, scanFinding{Path: path, Line: number, Rule: rule.name, Match: match})
+		}
+	}
+	if len(findings) > 0 {
+		return findings
+	}
+
+	for _, groups := range secretAssignment.FindAllStringSubmatch(line, -1) {
+		if value := groups[3]; looksRandom(value) {
+			findings = append(findings, scanFinding{Path: path, Line: number, Rule: "high-entropy value assigned to " + strings.ToLower(groups[1]), Match: value})
+		}
+	}
+	return findings
+}
+
+// looksRandom reports whether a value could be a generated secret rather than
+// a word, setting or path: it mixes letters and digits and has high entropy
+func looksRandom(value string) bool {
+	if strings.ContainsAny(value[:1], "~/.") {
+		return false
+	}
+	if !strings.ContainsAny(value, "0123456789") || !strings.ContainsAny(strings.ToLower(value), "abcdefghijklmnopqrstuvwxyz") {
+		return false
+	}
+	return shannonEntropy(value) >= minSecretEntropy
+}
+
+// shannonEntropy returns the entropy of s in bits per character
+func shannonEntropy(s string) float64 {
+	counts := make(map[rune]int)
+	for _, r := range s {
+		counts[r]++
+	}
+	length := float64(len([]rune(s)))
+	entropy := 0.0
+	for _, count := range counts {
+		p := float64(count) / length
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// hunkHeader matches the start of a hunk in a diff, capturing the first new line
+var hunkHeader = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,\d+)? @@`)
+
+// scanDiff returns the possible secrets on the lines a unified diff adds. A
+// "+++ " line names the file only in the header of a file's diff, right after
+// its "--- " line; in a hunk it is an added line starting with "++ ".
+func (s *secretScanner) scanDiff(diff []byte) ([]scanFinding, error) {
+	var findings []scanFinding
+	var path string
+	line := 0
+	header := false
+	previous := ""
+
+	lines := bufio.NewScanner(bytes.NewReader(diff))
+	lines.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lines.Scan() {
+		text := lines.Text()
+		switch {
+		case strings.HasPrefix(text, "diff --git "):
+			header = true
+		case header && strings.HasPrefix(text, "+++ ") && strings.HasPrefix(previous, "--- "):
+			path = strings.TrimPrefix(strings.TrimPrefix(text, "+++ "), "b/")
+		case strings.HasPrefix(text, "@@"):
+			header = false
+			if groups := hunkHeader.FindStringSubmatch(text); groups != nil {
+				line, _ = strconv.Atoi(groups[1])
+			}
+		case !header && strings.HasPrefix(text, "+"):
+			findings = append(findings, s.scanLine(path, line, text[1:])...)
+			line++
+		}
+		previous = text
+	}
+	if err := lines.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read staged changes: %w", err)
+	}
+	return findings, nil
+}
+
+// scanStaged inspects the staged changes of the dotfiles repository for
+// secrets: files known to hold them and lines added by the changes.
+// Encrypted files are skipped.
+func (dm *DotfilesManager) scanStaged() ([]scanFinding, error) {
+	scanner, err := dm.newSecretScanner()
+	if err != nil {
+		return nil, err
+	}
+
+	var findings []scanFinding
+	report := func(finding scanFinding) {
+		if !strings.HasSuffix(finding.Path, encryptedSuffix) && !scanner.allowed(finding) {
+			findings = append(findings, finding)
+		}
+	}
+
+	cmd := exec.Command("git", "-c", "core.quotepath=false", "diff", "--cached", "--name-only", "--diff-filter=ACR", "-z")
+	cmd.Dir = dm.DotfilesDir
+	names, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list staged files: %w", err)
+	}
+	for _, path := range strings.Split(string(names), "\x00") {
+		if path != "" && scanner.files.matches(path, false) {
+			report(scanFinding{Path: path, Rule: "file that usually holds a secret"})
+		}
+	}
+
+	cmd = exec.Command("git", "-c", "core.quotepath=false", "diff", "--cached", "--no-color", "--no-ext-diff", "--unified=0", "--diff-filter=ACMR")
+	cmd.Dir = dm.DotfilesDir
+	diff, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read staged changes: %w", err)
+	}
+
+	diffFindings, err := scanner.scanDiff(diff)
+	if err != nil {
+		return nil, err
+	}
+	for _, finding := range diffFindings {
+		report(finding)
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].Path != findings[j].Path {
+			return findings[i].Path < findings[j].Path
+		}
+		return findings[i].Line < findings[j].Line
+	})
+	return findings, nil
+}
+
+// checkStagedSecrets aborts a sync when the staged changes contain possible
+// secrets, unstaging the files they are in
+func (dm *DotfilesManager) checkStagedSecrets() error {
+	findings, err := dm.scanStaged()
+	if err != nil {
+		return err
+	}
+	if len(findings) == 0 {
+		return nil
+	}
+
+	fmt.Printf("✗ Possible secrets in the changes to commit:\n")
+	var paths []string
+	for _, finding := range findings {
+		fmt.Printf("  %s\n", finding)
+		if len(paths) == 0 || paths[len(paths)-1] != finding.Path {
+			paths = append(paths, finding.Path)
+		}
+	}
+	fmt.Println("\nMove secrets into {{secret \"name\"}} references or encrypted .enc files.")
+	fmt.Printf("False positives can be allowed under secret_scan: in %s, or with a %s comment on the line.\n", dm.ConfigFile, scanAllowMarker)
+
+	if err := dm.runGitCommand(append([]string{"reset", "--quiet", "--"}, paths...)...); err != nil {
+		fmt.Printf("Warning: failed to unstage the files: %v\n", err)
+	}
+	return fmt.Errorf("secret scan found %d possible secret(s), nothing was committed", len(findings))
+}
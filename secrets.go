@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Secret providers, tried in the order they are configured
+const (
+	secretProviderEnv     = "env"     // Environment variables
+	secretProviderFile    = "file"    // An age encrypted file in the repository
+	secretProviderCommand = "command" // An external command such as pass
+)
+
+const defaultSecretEnvPrefix = "DOTCTL_SECRET_"
+
+// SecretsConfig is the secrets section of dotctl.yaml
+type SecretsConfig struct {
+	Providers []string `yaml:"providers,omitempty" json:"providers,omitempty"`   // Default: env, then file and command if configured
+	File      string   `yaml:"file,omitempty" json:"file,omitempty"`             // age encrypted YAML of name: value pairs, relative to the dotfiles directory
+	Identity  string   `yaml:"identity,omitempty" json:"identity,omitempty"`     // age identity file outside the repository, a passphrase is asked for without one
+	EnvPrefix string   `yaml:"env_prefix,omitempty" json:"env_prefix,omitempty"` // Prefix of the environment variables, default DOTCTL_SECRET_
+	Command   string   `yaml:"command,omitempty" json:"command,omitempty"`       // Shell command printing a secret, {name} is replaced with its name
+}
+
+// secretRef matches a secret reference such as {{secret "github_token"}}, or
+// one escaped as \{{secret "github_token"}} to keep it literal
+var secretRef = regexp.MustCompile(`\\?\{\{\s*secret\s+"([^"]*)"\s*\}\}`)
+
+// secretName is what a secret can be called, which keeps names safe to pass to a command
+var secretName = regexp.MustCompile(`^[A-Za-z0-9_./-]+$`)
+
+// envUnsafe matches the characters of a secret name that cannot be part of an environment variable
+var envUnsafe = regexp.MustCompile(`[^A-Za-z0-9]`)
+
+// secretProvider looks up secrets from one source
+type secretProvider struct {
+	name     string
+	lookup   func(name string) (string, bool, error)
+	describe func(name string) string // Where a secret was looked for
+}
+
+// secretStore holds the configured providers and the secrets looked up so far
+type secretStore struct {
+	providers []secretProvider
+	values    map[string]string
+}
+
+// secretProviders returns the configured providers in the order they are tried
+func (dm *DotfilesManager) secretProviders() ([]secretProvider, error) {
+	config := dm.Config.Secrets
+	if config == nil {
+		config = &SecretsConfig{}
+	}
+
+	names := config.Providers
+	if len(names) == 0 {
+		names = []string{secretProviderEnv}
+		if config.File != "" {
+			names = append(names, secretProviderFile)
+		}
+		if config.Command != "" {
+			names = append(names, secretProviderCommand)
+		}
+	}
+
+	var providers []secretProvider
+	for _, name := range names {
+		switch name {
+		case secretProviderEnv:
+			providers = append(providers, envSecrets(config.EnvPrefix))
+		case secretProviderFile:
+			provider, err := dm.fileSecrets(config)
+			if err != nil {
+				return nil, err
+			}
+			providers = append(providers, provider)
+		case secretProviderCommand:
+			if config.Command == "" {
+				return nil, fmt.Errorf("secrets: the command provider needs a command")
+			}
+			providers = append(providers, commandSecrets(config.Command))
+		default:
+			return nil, fmt.Errorf("secrets: unknown provider '%s' (use env, file or command)", name)
+		}
+	}
+	return providers, nil
+}
+
+// envSecrets looks up a secret such as github_token in DOTCTL_SECRET_GITHUB_TOKEN
+func envSecrets(prefix string) secretProvider {
+	if prefix == "" {
+		prefix = defaultSecretEnvPrefix
+	}
+	variable := func(name string) string {
+		return prefix + strings.ToUpper(envUnsafe.ReplaceAllString(name, "_"))
+	}
+	return secretProvider{
+		name: secretProviderEnv,
+		lookup: func(name string) (string, bool, error) {
+			value, ok := os.LookupEnv(variable(name))
+			return value, ok, nil
+		},
+		describe: func(name string) string { return "$" + variable(name) },
+	}
+}
+
+// fileSecrets reads secrets from an age encrypted file, which is decrypted
+// with the age command the first time a secret is looked up
+func (dm *DotfilesManager) fileSecrets(config *SecretsConfig) (secretProvider, error) {
+	if config.File == "" {
+		return secretProvider{}, fmt.Errorf("secrets: the file provider needs a file")
+	}
+	path := config.File
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dm.DotfilesDir, path)
+	}
+
+	var identity string
+	if config.Identity != "" {
+		expanded, err := dm.expandPath(config.Identity)
+		if err != nil {
+			return secretProvider{}, err
+		}
+		// The key would be pushed along with the secrets it protects
+		if isWithin(expanded, dm.DotfilesDir) {
+			return secretProvider{}, fmt.Errorf("secrets: identity %s must be kept outside the dotfiles directory", expanded)
+		}
+		identity = expanded
+	}
+
+	var values map[string]string
+	return secretProvider{
+		name: secretProviderFile,
+		lookup: func(name string) (string, bool, error) {
+			if values == nil {
+				plaintext, err := ageDecrypt(path, identity)
+				if err != nil {
+					return "", false, err
+				}
+				values = make(map[string]string)
+				if err := yaml.Unmarshal(plaintext, &values); err != nil {
+					return "", false, fmt.Errorf("failed to parse decrypted %s: %w", path, err)
+				}
+			}
+			value, ok := values[name]
+			return value, ok, nil
+		},
+		describe: func(string) string { return config.File },
+	}, nil
+}
+
+// ageDecrypt decrypts a file with the age command, which asks for the
+// passphrase itself when no identity is given
+func ageDecrypt(path, identity string) ([]byte, error) {
+	if _, err := exec.LookPath("age"); err != nil {
+		return nil, fmt.Errorf("the age command is needed to decrypt %s, see https://age-encryption.org", path)
+	}
+	args := []string{"--decrypt"}
+	if identity != "" {
+		args = append(args, "--identity", identity)
+	}
+	args = append(args, path)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("age", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %s", path, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// commandSecrets runs a command such as "pass show dotfiles/{name}" and uses its output
+func commandSecrets(command string) secretProvider {
+	expand := func(name string) string {
+		return strings.ReplaceAll(command, "{name}", name)
+	}
+	return secretProvider{
+		name: secretProviderCommand,
+		lookup: func(name string) (string, bool, error) {
+			var stderr bytes.Buffer
+			cmd := exec.Command("sh", "-c", expand(name))
+			cmd.Stdin = os.Stdin
+			cmd.Stderr = &stderr
+			output, err := cmd.Output()
+			if err != nil {
+				return "", false, fmt.Errorf("'%s' failed: %s", expand(name), strings.TrimSpace(stderr.String()))
+			}
+			return strings.TrimRight(string(output), "\n"), true, nil
+		},
+		describe: expand,
+	}
+}
+
+// lookupSecret returns the value of a secret from the first provider that has it
+func (dm *DotfilesManager) lookupSecret(name string) (string, error) {
+	if !secretName.MatchString(name) {
+		return "", fmt.Errorf("invalid secret name '%s', use letters, digits and _ . / -", name)
+	}
+	if dm.secrets == nil {
+		providers, err := dm.secretProviders()
+		if err != nil {
+			return "", err
+		}
+		dm.secrets = &secretStore{providers: providers, values: make(map[string]string)}
+	}
+	if value, ok := dm.secrets.values[name]; ok {
+		return value, nil
+	}
+
+	var searched []string
+	for _, provider := range dm.secrets.providers {
+		value, ok, err := provider.lookup(name)
+		if err != nil {
+			return "", fmt.Errorf("secret '%s': %w", name, err)
+		}
+		if ok {
+			if strings.Contains(value, "\n") {
+				return "", fmt.Errorf("secret '%s' spans several lines, which templates do not support", name)
+			}
+			dm.secrets.values[name] = value
+			return value, nil
+		}
+		searched = append(searched, provider.describe(name))
+	}
+	return "", fmt.Errorf("secret '%s' not found, looked in %s", name, strings.Join(searched, ", "))
+}
+
+// substituteSecrets replaces every secret reference in a line with its value
+func (dm *DotfilesManager) substituteSecrets(line string) (string, error) {
+	if !strings.Contains(line, "secret") {
+		return line, nil
+	}
+
+	var lookupErr error
+	result := secretRef.ReplaceAllStringFunc(line, func(ref string) string {
+		if escapedRef(ref) {
+			return ref[1:]
+		}
+		if lookupErr != nil {
+			return ref
+		}
+		value, err := dm.lookupSecret(secretRef.FindStringSubmatch(ref)[1])
+		lookupErr = err
+		return value
+	})
+	return result, lookupErr
+}
+
+// secretsInUse returns the secrets looked up so far
+func (dm *DotfilesManager) secretsInUse() map[string]string {
+	if dm.secrets == nil {
+		return nil
+	}
+	return dm.secrets.values
+}
+
+// templateUsesSecrets reports whether a template, or a file it includes,
+// refers to a secret. Conditions are ignored, so this holds on every system.
+func (dm *DotfilesManager) templateUsesSecrets(templatePath string) bool {
+	return dm.usesSecrets(templatePath, make(map[string]bool))
+}
+
+func (dm *DotfilesManager) usesSecrets(path string, seen map[string]bool) bool {
+	if seen[path] {
+		return false
+	}
+	seen[path] = true
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	for _, ref := range secretRef.FindAllString(string(content), -1) {
+		if !escapedRef(ref) {
+			return true
+		}
+	}
+	lines, err := parseTemplate(path, string(content))
+	if err != nil {
+		return false
+	}
+	for _, line := range lines {
+		if (line.Kind == tagPartial || line.Kind == tagInclude) && dm.usesSecrets(dm.includePath(path, line), seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// withholdSecrets drops template edits that would write the value of a
+// secret into the template, returning a warning for each
+func withholdSecrets(edits []templateEdit, secrets map[string]string) ([]templateEdit, []string) {
+	var kept []templateEdit
+	var warnings []string
+	for _, edit := range edits {
+		leaked := ""
+		for _, name := range sortedKeys(secrets) {
+			value := secrets[name]
+			for _, line := range edit.Lines {
+				if value != "" && strings.Contains(line, value) {
+					leaked = name
+				}
+			}
+		}
+		if leaked == "" {
+			kept = append(kept, edit)
+			continue
+		}
+		warnings = append(warnings, fmt.Sprintf("not merging a change at template line %d, it contains the value of secret '%s', use {{secret \"%s\"}} instead", edit.Line+1, leaked, leaked))
+	}
+	return kept, warnings
+}
+
+// secretOutputs returns the outputs rendered inside the repository from
+// templates that use secrets, relative to the dotfiles directory
+func (dm *DotfilesManager) secretOutputs() ([]string, error) {
+	templates, err := dm.repoTemplates()
+	if err != nil {
+		return nil, err
+	}
+	var outputs []string
+	for _, template := range templates {
+		if dm.templateUsesSecrets(filepath.Join(dm.DotfilesDir, filepath.FromSlash(template))) {
+			outputs = append(outputs, strings.TrimSuffix(template, ".template"))
+		}
+	}
+	return outputs, nil
+}
+
+// protectSecretOutputs keeps rendered files that contain secrets out of the
+// repository: they are listed in .gitignore and untracked if committed before
+func (dm *DotfilesManager) protectSecretOutputs() error {
+	outputs, err := dm.secretOutputs()
+	if err != nil {
+		return err
+	}
+	if err := dm.updateIgnoreSection("secret outputs", outputs); err != nil {
+		return err
+	}
+
+	for _, output := range outputs {
+		cmd := exec.Command("git", "ls-files", "--error-unmatch", output)
+		cmd.Dir = dm.DotfilesDir
+		if cmd.Run() != nil {
+			continue
+		}
+		if err := dm.runGitCommand("rm", "--cached", "--quiet", output); err != nil {
+			return fmt.Errorf("failed to untrack %s: %w", output, err)
+		}
+		fmt.Printf("Warning: %s contains secrets and was committed before, it is untracked now but its secrets remain in the history\n", output)
+	}
+	return nil
+}
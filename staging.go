@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Kinds of changes sync can commit
+const (
+	changeNew      = "new"
+	changeModified = "modified"
+	changeDeleted  = "deleted"
+)
+
+// repositoryGroup labels changes to files of the repository itself, such as dotctl.yaml
+const repositoryGroup = "repository"
+
+// syncChange is a changed file in the dotfiles repository
+type syncChange struct {
+	Path   string // Relative to the dotfiles directory, with slashes
+	Kind   string
+	Group  string // Package the file belongs to, or repositoryGroup
+	Staged bool   // Already in the index
+}
+
+// isHelperFile reports whether path is a file dotctl leaves behind temporarily,
+// such as the reference and merge files of template conflict resolution
+func isHelperFile(path string) bool {
+	return strings.HasSuffix(path, ".base-reference") || strings.HasSuffix(path, ".merge") || strings.Contains(filepath.Base(path), ".bootstrap-backup-")
+}
+
+// syncGroup returns what a changed file belongs to, or "" if sync leaves it alone
+func (dm *DotfilesManager) syncGroup(path string, globalExcludes *pathMatcher) string {
+	if isHelperFile(path) {
+		return ""
+	}
+
+	repositoryFiles := []string{".gitignore"}
+	if configPath, err := filepath.Rel(dm.DotfilesDir, dm.ConfigFile); err == nil {
+		repositoryFiles = append(repositoryFiles, filepath.ToSlash(configPath))
+	}
+	if dm.Config.Secrets != nil && dm.Config.Secrets.File != "" && !filepath.IsAbs(dm.Config.Secrets.File) {
+		repositoryFiles = append(repositoryFiles, filepath.ToSlash(filepath.Clean(dm.Config.Secrets.File)))
+	}
+	for _, file := range repositoryFiles {
+		if path == file {
+			return repositoryGroup
+		}
+	}
+
+	top, rest, found := strings.Cut(path, "/")
+	if !found {
+		return ""
+	}
+	if top == partialsDir {
+		return partialsDir
+	}
+	if _, configured := dm.Config.Packages[top]; configured && !globalExcludes.matches(rest, false) {
+		return top
+	}
+	return ""
+}
+
+// topGroup groups a file by its top-level directory, or as a repository file
+func topGroup(path string) string {
+	top, _, found := strings.Cut(path, "/")
+	if !found {
+		return repositoryGroup
+	}
+	return top
+}
+
+// syncChanges lists the changes in the dotfiles repository, split into those
+// sync commits and those it leaves alone. Deleting a tracked file is always synced.
+func (dm *DotfilesManager) syncChanges() ([]syncChange, []syncChange, error) {
+	cmd := exec.Command("git", "status", "--porcelain=v1", "-z", "--untracked-files=all", "--no-renames")
+	cmd.Dir = dm.DotfilesDir
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list changes: %w", err)
+	}
+	globalExcludes, err := dm.globalExcludes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var synced, skipped []syncChange
+	for _, entry := range strings.Split(string(output), "\x00") {
+		if len(entry) < 4 {
+			continue
+		}
+		index, worktree, path := entry[0], entry[1], entry[3:]
+
+		change := syncChange{Path: path, Kind: changeModified, Staged: index != ' ' && index != '?'}
+		switch {
+		case index == '?' || (index == 'A' && worktree != 'D'):
+			change.Kind = changeNew
+		case index == 'D' || worktree == 'D':
+			change.Kind = changeDeleted
+		}
+
+		change.Group = dm.syncGroup(path, globalExcludes)
+		if change.Group == "" && change.Kind == changeDeleted && !isHelperFile(path) {
+			change.Group = topGroup(path)
+		}
+		if change.Group == "" {
+			skipped = append(skipped, change)
+		} else {
+			synced = append(synced, change)
+		}
+	}
+	return synced, skipped, nil
+}
+
+// groupChanges returns the groups of changes in order, the repository itself first
+func groupChanges(changes []syncChange) ([]string, map[string][]syncChange) {
+	groups := make(map[string][]syncChange)
+	for _, change := range changes {
+		groups[change.Group] = append(groups[change.Group], change)
+	}
+	names := sortedKeys(groups)
+	sort.SliceStable(names, func(i, j int) bool {
+		return names[i] == repositoryGroup && names[j] != repositoryGroup
+	})
+	return names, groups
+}
+
+// summarizeChanges counts the kinds of changes, e.g. "1 new, 2 modified"
+func summarizeChanges(changes []syncChange) string {
+	counts := make(map[string]int)
+	for _, change := range changes {
+		counts[change.Kind]++
+	}
+	var parts []string
+	for _, kind := range []string{changeNew, changeModified, changeDeleted} {
+		if counts[kind] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[kind], kind))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatChanges lists changes grouped by package, each line indented by indent
+func formatChanges(changes []syncChange, indent string) string {
+	var b strings.Builder
+	names, groups := groupChanges(changes)
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s%s (%s):\n", indent, name, summarizeChanges(groups[name]))
+		for _, change := range groups[name] {
+			fmt.Fprintf(&b, "%s  %-9s %s\n", indent, change.Kind, change.Path)
+		}
+	}
+	return b.String()
+}
+
+// printChanges prints changes grouped by package
+func printChanges(changes []syncChange) {
+	fmt.Print(formatChanges(changes, "  "))
+}
+
+// printSkippedChanges lists the files sync leaves untracked
+func printSkippedChanges(skipped []syncChange) {
+	if len(skipped) == 0 {
+		return
+	}
+	fmt.Printf("Not synced, as they are not part of a configured package (%d):\n", len(skipped))
+	for _, change := range skipped {
+		fmt.Printf("    %-9s %s\n", change.Kind, change.Path)
+	}
+}
+
+// selectChanges asks which packages, or which of their files, to include
+func selectChanges(changes []syncChange) []syncChange {
+	var selected []syncChange
+	names, groups := groupChanges(changes)
+	for _, name := range names {
+		group := groups[name]
+		for {
+			fmt.Printf("Include %s (%s)? [Y/n/f=choose files/d=details]: ", name, summarizeChanges(group))
+			var response string
+			fmt.Scanln(&response)
+
+			switch strings.ToLower(strings.TrimSpace(response)) {
+			case "", "y":
+				selected = append(selected, group...)
+			case "n":
+			case "f":
+				for _, change := range group {
+					fmt.Printf("  Include %s %s? [Y/n]: ", change.Kind, change.Path)
+					var answer string
+					fmt.Scanln(&answer)
+					if strings.ToLower(strings.TrimSpace(answer)) != "n" {
+						selected = append(selected, change)
+					}
+				}
+			case "d":
+				for _, change := range group {
+					fmt.Printf("    %-9s %s\n", change.Kind, change.Path)
+				}
+				continue
+			default:
+				fmt.Printf("Invalid choice '%s'\n", response)
+				continue
+			}
+			break
+		}
+	}
+	return selected
+}
+
+// stageChanges stages the changes sync commits and shows what they are. With
+// interactive set, the changes to include are chosen first; changes left out
+// are unstaged so they are not committed either.
+func (dm *DotfilesManager) stageChanges(interactive bool) error {
+	synced, skipped, err := dm.syncChanges()
+	if err != nil {
+		return err
+	}
+
+	selected := synced
+	if len(synced) > 0 {
+		fmt.Println("Changes to sync:")
+		printChanges(synced)
+		if interactive {
+			fmt.Println()
+			selected = selectChanges(synced)
+		}
+	}
+	printSkippedChanges(skipped)
+
+	included := make(map[string]bool)
+	var paths []string
+	for _, change := range selected {
+		included[change.Path] = true
+		paths = append(paths, change.Path)
+	}
+	var unstage []string
+	for _, change := range append(synced, skipped...) {
+		if change.Staged && !included[change.Path] {
+			unstage = append(unstage, change.Path)
+		}
+	}
+
+	if len(unstage) > 0 {
+		if err := dm.runGitPathspecs(unstage, "reset", "--quiet"); err != nil {
+			return fmt.Errorf("failed to unstage files left out: %w", err)
+		}
+	}
+	if len(paths) > 0 {
+		if err := dm.runGitPathspecs(paths, "add", "--all"); err != nil {
+			return fmt.Errorf("failed to add files: %w", err)
+		}
+	}
+	return nil
+}
+
+// runGitPathspecs runs a git command on literal paths, passed on stdin so any
+// number of them fit
+func (dm *DotfilesManager) runGitPathspecs(paths []string, args ...string) error {
+	args = append(append([]string{"--literal-pathspecs"}, args...), "--pathspec-from-file=-", "--pathspec-file-nul")
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dm.DotfilesDir
+	cmd.Stdin = strings.NewReader(strings.Join(paths, "\x00"))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git command failed: %w\nOutput: %s", err, string(output))
+	}
+	return nil
+}
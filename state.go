@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// State entry types recorded in the deployment manifest
+const (
+	stateEntryLink      = "link"      // Symlink created by dotctl
+	stateEntryTemplate  = "template"  // File rendered from a .template file
+	stateEntryDir       = "dir"       // Directory created to hold a deployed target
+	stateEntryCopy      = "copy"      // File copied from the package (link_mode: copy)
+	stateEntryDecrypted = "decrypted" // File decrypted from an encrypted package file
+)
+
+// StateEntry records a single filesystem object created by dotctl
+type StateEntry struct {
+	Type       string    `yaml:"type"`
+	Package    string    `yaml:"package"`
+	Source     string    `yaml:"source,omitempty"`
+	Target     string    `yaml:"target"`
+	Hash       string    `yaml:"hash,omitempty"`
+	Secret     bool      `yaml:"secret,omitempty"` // Rendered output contains secrets
+	DeployedAt time.Time `yaml:"deployed_at"`
+}
+
+// DeploymentState is the persistent manifest of everything dotctl has deployed
+type DeploymentState struct {
+	Version int           `yaml:"version"`
+	Entries []StateEntry  `yaml:"entries"`
+	Backups []BackupEntry `yaml:"backups,omitempty"`
+}
+
+const deploymentStateVersion = 1
+
+// defaultStateFile returns the location of the deployment manifest. It lives
+// under the target home so a --target-home deployment is tracked on its own.
+func (dm *DotfilesManager) defaultStateFile() (string, error) {
+	stateHome, err := dm.stateHome()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stateHome, "dotctl", "state.yaml"), nil
+}
+
+func (dm *DotfilesManager) loadState() (*DeploymentState, error) {
+	state := &DeploymentState{Version: deploymentStateVersion}
+
+	data, err := os.ReadFile(dm.StateFile)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file %s: %w", dm.StateFile, err)
+	}
+
+	if err := yaml.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", dm.StateFile, err)
+	}
+	if state.Version == 0 {
+		state.Version = deploymentStateVersion
+	}
+
+	return state, nil
+}
+
+func (dm *DotfilesManager) saveState() error {
+	if err := os.MkdirAll(filepath.Dir(dm.StateFile), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	sort.Slice(dm.State.Entries, func(i, j int) bool {
+		return dm.State.Entries[i].Target < dm.State.Entries[j].Target
+	})
+
+	data, err := yaml.Marshal(dm.State)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+
+	header := "# dotctl deployment state - managed automatically, do not edit\n"
+	if err := os.WriteFile(dm.StateFile, append([]byte(header), data...), 0644); err != nil {
+		return err
+	}
+	dm.pruneRendered()
+	return nil
+}
+
+// record adds an entry to the state, replacing any existing entry for the same target
+func (s *DeploymentState) record(entry StateEntry) {
+	if entry.DeployedAt.IsZero() {
+		entry.DeployedAt = time.Now()
+	}
+
+	for i := range s.Entries {
+		if s.Entries[i].Target == entry.Target {
+			s.Entries[i] = entry
+			return
+		}
+	}
+	s.Entries = append(s.Entries, entry)
+}
+
+// find returns the entry recorded for target, or nil if there is none
+func (s *DeploymentState) find(target string) *StateEntry {
+	for i := range s.Entries {
+		if s.Entries[i].Target == target {
+			return &s.Entries[i]
+		}
+	}
+	return nil
+}
+
+// remove drops the entry recorded for target
+func (s *DeploymentState) remove(target string) {
+	for i := range s.Entries {
+		if s.Entries[i].Target == target {
+			s.Entries = append(s.Entries[:i], s.Entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// entriesForPackage returns a copy of all entries that belong to a package
+func (s *DeploymentState) entriesForPackage(packageName string) []StateEntry {
+	var entries []StateEntry
+	for _, entry := range s.Entries {
+		if entry.Package == packageName {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// packages returns the sorted names of every package with recorded entries
+func (s *DeploymentState) packages() []string {
+	seen := make(map[string]bool)
+	var packages []string
+	for _, entry := range s.Entries {
+		if !seen[entry.Package] {
+			seen[entry.Package] = true
+			packages = append(packages, entry.Package)
+		}
+	}
+	sort.Strings(packages)
+	return packages
+}
+
+func hashContent(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashFile returns the content hash of a regular file, or "" for directories and unreadable paths
+func hashFile(path string) string {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return hashContent(data)
+}
+
+// packageForPath returns the package a path inside the dotfiles directory belongs to
+func (dm *DotfilesManager) packageForPath(path string) string {
+	relPath, err := filepath.Rel(dm.DotfilesDir, path)
+	if err != nil || strings.HasPrefix(relPath, "..") {
+		return ""
+	}
+	return strings.Split(filepath.ToSlash(relPath), "/")[0]
+}
+
+func (dm *DotfilesManager) recordLink(packageName, source, target string) {
+	dm.State.record(StateEntry{
+		Type:    stateEntryLink,
+		Package: packageName,
+		Source:  source,
+		Target:  target,
+		Hash:    hashFile(source),
+	})
+}
+
+func (dm *DotfilesManager) recordTemplate(templatePath, outputPath, content string, secret bool) {
+	hash := hashContent([]byte(content))
+	dm.State.record(StateEntry{
+		Type:    stateEntryTemplate,
+		Package: dm.packageForPath(templatePath),
+		Source:  templatePath,
+		Target:  outputPath,
+		Hash:    hash,
+		Secret:  secret,
+	})
+
+	// Keep the rendered output as the base for merging later edits back into the template
+	perm := os.FileMode(0644)
+	if secret {
+		perm = 0600
+	}
+	err := os.MkdirAll(dm.renderedDir(), 0755)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dm.renderedDir(), hash), []byte(content), perm)
+	}
+	if err == nil {
+		err = os.Chmod(filepath.Join(dm.renderedDir(), hash), perm)
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to save rendered output of %s: %v\n", templatePath, err)
+	}
+}
+
+// renderedDir holds the last rendered output of every deployed template, named by hash
+func (dm *DotfilesManager) renderedDir() string {
+	return filepath.Join(filepath.Dir(dm.StateFile), "rendered")
+}
+
+// renderedBase returns what dotctl last rendered to outputPath, if it was recorded
+func (dm *DotfilesManager) renderedBase(outputPath string) (string, bool) {
+	entry := dm.State.find(outputPath)
+	if entry == nil || entry.Type != stateEntryTemplate || entry.Hash == "" {
+		return "", false
+	}
+	content, err := os.ReadFile(filepath.Join(dm.renderedDir(), entry.Hash))
+	if err != nil || hashContent(content) != entry.Hash {
+		return "", false
+	}
+	return string(content), true
+}
+
+// pruneRendered removes recorded template output no state entry refers to anymore
+func (dm *DotfilesManager) pruneRendered() {
+	files, err := os.ReadDir(dm.renderedDir())
+	if err != nil {
+		return
+	}
+
+	referenced := make(map[string]bool)
+	for _, entry := range dm.State.Entries {
+		if entry.Type == stateEntryTemplate {
+			referenced[entry.Hash] = true
+		}
+	}
+	for _, file := range files {
+		if !referenced[file.Name()] {
+			os.Remove(filepath.Join(dm.renderedDir(), file.Name()))
+		}
+	}
+}
+
+func (dm *DotfilesManager) recordCopy(packageName, source, target string, data []byte) {
+	dm.State.record(StateEntry{
+		Type:    stateEntryCopy,
+		Package: packageName,
+		Source:  source,
+		Target:  target,
+		Hash:    hashContent(data),
+	})
+}
+
+func (dm *DotfilesManager) recordDecrypted(packageName, source, target string, data []byte) {
+	dm.State.record(StateEntry{
+		Type:    stateEntryDecrypted,
+		Package: packageName,
+		Source:  source,
+		Target:  target,
+		Hash:    hashContent(data),
+	})
+}
+
+// ensureDir creates dir and any missing parents, recording each directory it had to create
+func (dm *DotfilesManager) ensureDir(packageName, dir string) error {
+	var missing []string
+	for current := dir; ; current = filepath.Dir(current) {
+		if _, err := os.Lstat(current); err == nil {
+			break
+		}
+		missing = append(missing, current)
+		if filepath.Dir(current) == current {
+			break
+		}
+	}
+
+	if err := dm.makeDirs(dir, missing); err != nil {
+		return fmt.Errorf("failed to create target directory %s: %w", dir, err)
+	}
+
+	for _, created := range missing {
+		dm.State.record(StateEntry{
+			Type:    stateEntryDir,
+			Package: packageName,
+			Target:  created,
+		})
+	}
+	return nil
+}
+
+// isLinkTo reports whether path is a symlink that resolves to source
+func isLinkTo(path, source string) bool {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+	dest, err := os.Readlink(path)
+	if err != nil {
+		return false
+	}
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(filepath.Dir(path), dest)
+	}
+	return filepath.Clean(dest) == filepath.Clean(source)
+}
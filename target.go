@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// mappedFile is a package file deployed to an explicit destination via files:
+type mappedFile struct {
+	RelPath string // Path inside the package, as written in the configuration
+	Source  string // File that is linked or copied (the output for templates)
+	Target  string
+}
+
+// resolveTarget returns where a package is deployed. When spread is true the
+// package's contents are placed individually inside root (the shell package)
+// rather than the package itself being placed at root.
+func (dm *DotfilesManager) resolveTarget(packageName string) (root string, spread bool, err error) {
+	homeDir, err := dm.homeDir()
+	if err != nil {
+		return "", false, err
+	}
+
+	packageConfig := dm.getPackageConfig(packageName)
+	switch {
+	case packageConfig != nil && packageConfig.Target != "":
+		// Explicit target directory
+		root, err := dm.expandPath(packageConfig.Target)
+		return root, false, err
+	case packageConfig != nil && packageConfig.Home:
+		// Home setting enabled - symlink to $HOME directory
+		return filepath.Join(homeDir, packageName), false, nil
+	case isConfigPackage(packageName):
+		// Config packages go to $XDG_CONFIG_HOME/PACKAGE_NAME
+		configHome, err := dm.configHome()
+		if err != nil {
+			return "", false, err
+		}
+		return filepath.Join(configHome, packageName), false, nil
+	case packageName == "shell":
+		// Shell package contents go directly to home directory
+		return homeDir, true, nil
+	default:
+		// Other home packages (like .oh-my-zsh) go to ~/PACKAGE_NAME
+		return filepath.Join(homeDir, packageName), false, nil
+	}
+}
+
+// mappedFiles returns the package files configured with explicit destinations,
+// sorted by their path inside the package
+func (dm *DotfilesManager) mappedFiles(packageName string) ([]mappedFile, error) {
+	packageConfig := dm.getPackageConfig(packageName)
+	if packageConfig == nil || len(packageConfig.Files) == 0 {
+		return nil, nil
+	}
+
+	packageDir := filepath.Join(dm.DotfilesDir, packageName)
+	var files []mappedFile
+	for relPath, destination := range packageConfig.Files {
+		cleanRel := filepath.Clean(relPath)
+		if filepath.IsAbs(cleanRel) || cleanRel == "." || strings.HasPrefix(cleanRel, "..") {
+			return nil, fmt.Errorf("files entry '%s' in %s must be a path inside the package", relPath, packageName)
+		}
+
+		source := filepath.Join(packageDir, cleanRel)
+		name := filepath.Base(cleanRel)
+		if strings.HasSuffix(source, ".template") {
+			source = strings.TrimSuffix(source, ".template")
+			name = strings.TrimSuffix(name, ".template")
+		}
+		name = decryptedName(name)
+
+		// A trailing slash places the file inside the destination directory
+		target, err := dm.expandPath(destination)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(destination, "/") {
+			target = filepath.Join(target, name)
+		}
+
+		files = append(files, mappedFile{RelPath: filepath.ToSlash(cleanRel), Source: source, Target: target})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].RelPath < files[j].RelPath
+	})
+	return files, nil
+}
+
+// mappedSources returns the package-relative paths of mapped files, which are
+// left out of the regular placement of the package
+func mappedSources(files []mappedFile) map[string]bool {
+	sources := make(map[string]bool)
+	for _, file := range files {
+		sources[file.RelPath] = true
+	}
+	return sources
+}
+
+// planMappedFiles plans deploying each mapped file to its destination
+func (dm *DotfilesManager) planMappedFiles(plan *DeploymentPlan, packageName string, files []mappedFile, interactive bool) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	mode, err := dm.linkMode(packageName)
+	if err != nil {
+		return err
+	}
+	copies, err := dm.packageCopies(packageName)
+	if err != nil {
+		return err
+	}
+	encrypted, err := dm.packageEncrypted(packageName)
+	if err != nil {
+		return err
+	}
+
+	packageDir := filepath.Join(dm.DotfilesDir, packageName)
+	for _, file := range files {
+		templatePath := filepath.Join(packageDir, filepath.FromSlash(file.RelPath))
+		if _, err := os.Stat(templatePath); err != nil {
+			return fmt.Errorf("file '%s' listed under files: in %s not found", file.RelPath, packageName)
+		}
+		dm.planMissingDirs(plan, packageName, filepath.Dir(file.Target))
+
+		if isEncrypted(encrypted, file.RelPath) {
+			if err := dm.planDecrypt(plan, packageName, file.Source, file.Target); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if templatePath != file.Source {
+			if dm.rendersToTarget() {
+				if err := dm.planRenderAtTarget(plan, packageName, templatePath, file.Target, interactive); err != nil {
+					return fmt.Errorf("failed to process template %s: %w", templatePath, err)
+				}
+				continue
+			}
+			if err := dm.planRender(plan, packageName, templatePath, file.Source, interactive); err != nil {
+				return fmt.Errorf("failed to process template %s: %w", templatePath, err)
+			}
+		}
+
+		if mode == linkModeCopy || copies.matches(file.RelPath, false) {
+			if err := dm.planCopy(plan, packageName, file.Source, plan.contentHash(file.Source), file.Target, false, interactive); err != nil {
+				return err
+			}
+			continue
+		}
+
+		proceed, err := dm.planTarget(plan, packageName, file.Source, file.Target)
+		if err != nil {
+			return err
+		}
+		if proceed {
+			plan.add(Operation{Type: opLink, Package: packageName, Source: file.Source, Target: file.Target})
+		}
+	}
+	return nil
+}
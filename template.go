@@ -0,0 +1,404 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/yourusername/dotctl/internal/diff"
+)
+
+// partialsDir holds the partials templates can include with {{> name}}
+const partialsDir = "_partials"
+
+// lineOrigin records where a line of template output came from
+type lineOrigin struct {
+	Line        int      // 1-based line in the template
+	Blocks      []string // Enclosing conditional blocks, outermost first
+	Partial     string   // File the line was included from, "" if it is in the template itself
+	PartialLine int      // 1-based line in Partial
+}
+
+// String describes the origin, e.g. "line 3 in {{#if linux}}" or
+// "line 2 of _partials/aliases, included at line 3"
+func (o lineOrigin) String() string {
+	description := fmt.Sprintf("line %d", o.Line)
+	if o.Partial != "" {
+		description = fmt.Sprintf("line %d of %s, included at line %d", o.PartialLine, o.Partial, o.Line)
+	}
+	if len(o.Blocks) > 0 {
+		description += " in " + strings.Join(o.Blocks, " > ")
+	}
+	return description
+}
+
+// Kinds of template line
+const (
+	tagText    = ""        // Ordinary content
+	tagIf      = "if"      // {{#if cond}}
+	tagUnless  = "unless"  // {{#unless cond}}
+	tagElif    = "elif"    // {{#elif cond}}
+	tagElse    = "else"    // {{else}}
+	tagEnd     = "end"     // {{/if}} or {{/unless}}
+	tagPartial = "partial" // {{> name}}
+	tagInclude = "include" // {{include "path"}}
+)
+
+// templateLine is one parsed line of a template
+type templateLine struct {
+	Kind    string
+	Text    string
+	Cond    *condExpr // Condition of if, unless and elif tags
+	Include string    // Partial name or path of partial and include tags
+	Blocks  []string  // Blocks open after this line, outermost first
+}
+
+// parseTemplate splits a template into lines and checks that its block tags
+// are well formed and balanced. name is used in error messages.
+func parseTemplate(name, content string) ([]templateLine, error) {
+	type openBlock struct {
+		tag     string // "if" or "unless"
+		opening string // The opening tag as written
+		line    int
+		branch  string // Description of the current branch
+		inElse  bool
+	}
+
+	var parsed []templateLine
+	var stack []openBlock
+	blocks := func() []string {
+		var open []string
+		for _, block := range stack {
+			open = append(open, block.branch)
+		}
+		return open
+	}
+
+	for i, text := range strings.Split(content, "\n") {
+		line := templateLine{Kind: tagText, Text: text}
+		trimmed := strings.TrimSpace(text)
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("%s:%d: %s", name, i+1, fmt.Sprintf(format, args...))
+		}
+
+		if strings.HasPrefix(trimmed, "{{") && strings.HasSuffix(trimmed, "}}") && len(trimmed) > 4 {
+			tag := strings.TrimSpace(trimmed[2 : len(trimmed)-2])
+			keyword, condition, _ := strings.Cut(tag, " ")
+			condition = strings.TrimSpace(condition)
+
+			switch keyword {
+			case "#if", "#unless", "#elif":
+				if condition == "" {
+					return nil, fail("{{%s}} needs a condition", keyword)
+				}
+				cond, err := parseCondition(condition)
+				if err != nil {
+					return nil, fail("invalid condition in %s: %v", trimmed, err)
+				}
+				line.Cond = cond
+				line.Kind = strings.TrimPrefix(keyword, "#")
+			case "else":
+				if condition != "" {
+					return nil, fail("{{else}} takes no condition, use {{#elif %s}}", condition)
+				}
+				line.Kind = tagElse
+			case "/if", "/unless":
+				if condition != "" {
+					return nil, fail("unexpected text in %s", trimmed)
+				}
+				line.Kind = tagEnd
+			case "include":
+				path, err := strconv.Unquote(condition)
+				if err != nil || path == "" {
+					return nil, fail("{{include}} needs a quoted path, e.g. {{include \"aliases.sh\"}}")
+				}
+				line.Kind = tagInclude
+				line.Include = path
+			default:
+				if name, ok := strings.CutPrefix(tag, ">"); ok {
+					name = strings.TrimSpace(name)
+					if name == "" || strings.ContainsAny(name, " \t") {
+						return nil, fail("{{>}} needs the name of a partial in %s/, e.g. {{> aliases}}", partialsDir)
+					}
+					line.Kind = tagPartial
+					line.Include = name
+					break
+				}
+				if strings.HasPrefix(keyword, "#") || strings.HasPrefix(keyword, "/") {
+					return nil, fail("unknown tag %s", trimmed)
+				}
+			}
+		}
+
+		switch line.Kind {
+		case tagIf, tagUnless:
+			stack = append(stack, openBlock{tag: line.Kind, opening: trimmed, line: i + 1, branch: trimmed})
+		case tagElif, tagElse:
+			if len(stack) == 0 {
+				return nil, fail("%s without an open {{#if}}", trimmed)
+			}
+			top := &stack[len(stack)-1]
+			if top.inElse {
+				return nil, fail("%s after {{else}} of the block opened at line %d", trimmed, top.line)
+			}
+			if line.Kind == tagElse {
+				top.inElse = true
+				top.branch = "{{else}} of " + top.branch
+			} else {
+				top.branch = trimmed
+			}
+		case tagEnd:
+			if len(stack) == 0 {
+				return nil, fail("%s without an open block", trimmed)
+			}
+			top := stack[len(stack)-1]
+			if trimmed != "{{/"+top.tag+"}}" {
+				return nil, fail("%s closes %s opened at line %d, expected {{/%s}}", trimmed, top.opening, top.line, top.tag)
+			}
+			stack = stack[:len(stack)-1]
+		}
+
+		line.Blocks = blocks()
+		parsed = append(parsed, line)
+	}
+
+	if len(stack) > 0 {
+		top := stack[len(stack)-1]
+		return nil, fmt.Errorf("%s:%d: %s is never closed with {{/%s}}", name, top.line, top.opening, top.tag)
+	}
+	return parsed, nil
+}
+
+func (dm *DotfilesManager) processTemplateContent(name, content string) (string, error) {
+	output, _, err := dm.renderTemplate(name, content)
+	return output, err
+}
+
+// renderTemplateFile renders the template at path for the current system
+func (dm *DotfilesManager) renderTemplateFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read template: %w", err)
+	}
+	return dm.processTemplateContent(path, string(content))
+}
+
+// renderTemplate processes a template for the current system and returns,
+// alongside the output, the origin of every output line
+func (dm *DotfilesManager) renderTemplate(name, content string) (string, []lineOrigin, error) {
+	result, origins, err := dm.renderTemplateLines(name, content, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	return strings.Join(result, "\n"), origins, nil
+}
+
+// renderTemplateLines renders the lines of a template or of a file it
+// includes. including lists the files whose includes led here, outermost first.
+func (dm *DotfilesManager) renderTemplateLines(name, content string, including []string) ([]string, []lineOrigin, error) {
+	lines, err := parseTemplate(name, content)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Each open block tracks whether its current branch is rendered and
+	// whether an earlier branch already was
+	type branchState struct {
+		parent, active, taken bool
+	}
+	var stack []branchState
+	active := func() bool {
+		return len(stack) == 0 || stack[len(stack)-1].active
+	}
+
+	var result []string
+	var origins []lineOrigin
+	for i, line := range lines {
+		switch line.Kind {
+		case tagIf, tagUnless:
+			holds := line.Cond.eval(dm.matchesCondition) == (line.Kind == tagIf)
+			stack = append(stack, branchState{parent: active(), active: active() && holds, taken: holds})
+		case tagElif:
+			top := &stack[len(stack)-1]
+			holds := !top.taken && line.Cond.eval(dm.matchesCondition)
+			top.active = top.parent && holds
+			top.taken = top.taken || holds
+		case tagElse:
+			top := &stack[len(stack)-1]
+			top.active = top.parent && !top.taken
+			top.taken = true
+		case tagEnd:
+			stack = stack[:len(stack)-1]
+		case tagPartial, tagInclude:
+			if !active() {
+				continue
+			}
+			included, includedOrigins, err := dm.renderInclude(name, line, append(including, name))
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s:%d: %w", name, i+1, err)
+			}
+			for _, origin := range includedOrigins {
+				if origin.Partial == "" {
+					origin.Partial, origin.PartialLine = dm.relativeToDotfiles(dm.includePath(name, line)), origin.Line
+				}
+				origin.Line = i + 1
+				origin.Blocks = append(append([]string(nil), line.Blocks...), origin.Blocks...)
+				origins = append(origins, origin)
+			}
+			result = append(result, included...)
+		default:
+			// Add line if not in a skipped block
+			if active() {
+				text, err := dm.substituteVariables(line.Text)
+				if err == nil {
+					text, err = dm.substituteSecrets(text)
+				}
+				if err != nil {
+					return nil, nil, fmt.Errorf("%s:%d: %w", name, i+1, err)
+				}
+				result = append(result, text)
+				origins = append(origins, lineOrigin{Line: i + 1, Blocks: line.Blocks})
+			}
+		}
+	}
+
+	return result, origins, nil
+}
+
+// includePath returns the file a partial or include tag in the template name
+// refers to. Partials live in _partials/ of the dotfiles directory, included
+// paths are relative to the including file.
+func (dm *DotfilesManager) includePath(name string, line templateLine) string {
+	if line.Kind == tagPartial {
+		return filepath.Join(dm.DotfilesDir, partialsDir, line.Include)
+	}
+	if filepath.IsAbs(line.Include) {
+		return line.Include
+	}
+	return filepath.Join(filepath.Dir(name), line.Include)
+}
+
+// renderInclude renders the file a partial or include tag refers to.
+// including lists the files that led to it, to detect include cycles.
+func (dm *DotfilesManager) renderInclude(name string, line templateLine, including []string) ([]string, []lineOrigin, error) {
+	path := dm.includePath(name, line)
+	for i, file := range including {
+		if filepath.Clean(file) == path {
+			var cycle []string
+			for _, file := range append(including[i:], path) {
+				cycle = append(cycle, dm.relativeToDotfiles(file))
+			}
+			return nil, nil, fmt.Errorf("include cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) && line.Kind == tagPartial {
+		return nil, nil, fmt.Errorf("partial '%s' not found, expected %s", line.Include, path)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to include %s: %w", line.Include, err)
+	}
+
+	// The final newline of an included file ends its last line rather than adding an empty one
+	text := strings.TrimSuffix(string(content), "\n")
+	if text == "" {
+		return nil, nil, nil
+	}
+	return dm.renderTemplateLines(path, text, including)
+}
+
+// relativeToDotfiles shortens a path inside the dotfiles directory for display
+func (dm *DotfilesManager) relativeToDotfiles(path string) string {
+	if relPath, err := filepath.Rel(dm.DotfilesDir, path); err == nil && !strings.HasPrefix(relPath, "..") {
+		return relPath
+	}
+	return path
+}
+
+// findTemplate returns the template a path is rendered from and the file it
+// is rendered to. path may be the template, its output or a deployed link to it.
+func (dm *DotfilesManager) findTemplate(path string) (string, string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", "", err
+	}
+	// Deployed links lead back into the dotfiles directory
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+
+	if strings.HasSuffix(path, ".template") {
+		if _, err := os.Stat(path); err != nil {
+			return "", "", fmt.Errorf("template %s not found", path)
+		}
+		return path, strings.TrimSuffix(path, ".template"), nil
+	}
+
+	if entry := dm.State.find(path); entry != nil && entry.Type == stateEntryTemplate {
+		return entry.Source, entry.Target, nil
+	}
+	if _, err := os.Stat(path + ".template"); err == nil {
+		return path + ".template", path, nil
+	}
+	return "", "", fmt.Errorf("%s is not rendered from a template", path)
+}
+
+// explainTemplate prints a template output file with the template line each
+// of its lines came from
+func (dm *DotfilesManager) explainTemplate(path string) error {
+	templatePath, outputPath, err := dm.findTemplate(path)
+	if err != nil {
+		return err
+	}
+	templateContent, err := os.ReadFile(templatePath)
+	if err != nil {
+		return fmt.Errorf("failed to read template: %w", err)
+	}
+	rendered, origins, err := dm.renderTemplate(templatePath, string(templateContent))
+	if err != nil {
+		return err
+	}
+	renderedLines := diff.SplitLines(rendered)
+
+	// Explain the file as it is, which may have been edited since it was rendered
+	outputLines := renderedLines
+	if content, err := os.ReadFile(outputPath); err == nil {
+		outputLines = diff.SplitLines(string(content))
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %w", outputPath, err)
+	} else {
+		fmt.Printf("Note: %s does not exist, explaining the output the template would render\n", outputPath)
+	}
+
+	explanations := make([]string, len(outputLines))
+	missing := 0
+	for _, edit := range diff.Lines(renderedLines, outputLines) {
+		switch edit.Kind {
+		case diff.Equal:
+			explanations[edit.NewLine-1] = origins[edit.OldLine-1].String()
+		case diff.Insert:
+			explanations[edit.NewLine-1] = "not in template (local edit)"
+		case diff.Delete:
+			missing++
+		}
+	}
+
+	width := 0
+	for _, line := range outputLines {
+		width = max(width, min(len(line), 50))
+	}
+
+	fmt.Printf("%s\n", outputPath)
+	fmt.Printf("Template: %s (rendered for %s)\n\n", templatePath, dm.System)
+	for i, line := range outputLines {
+		fmt.Printf("%4d  %-*s  │ %s\n", i+1, width, truncate(line, 50), explanations[i])
+	}
+
+	if missing > 0 {
+		fmt.Printf("\n%d line(s) the template renders are missing from the file, run 'dotctl diff' to see them\n", missing)
+	}
+	return nil
+}
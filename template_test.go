@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// nestedTemplate has blocks nested in each kind of branch
+const nestedTemplate = `common
+{{#if macos}}
+mac
+{{#unless ubuntu}}
+mac home
+{{else}}
+mac work
+{{/unless}}
+{{#elif linux}}
+linux
+  {{#if arch or fedora}}
+linux rolling
+  {{/if}}
+{{else}}
+other
+{{/if}}
+end`
+
+func TestParseTemplateBlocks(t *testing.T) {
+	lines, err := parseTemplate("t", nestedTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Kind of each line and the blocks open after it
+	want := []struct {
+		kind   string
+		blocks []string
+	}{
+		{tagText, nil},
+		{tagIf, []string{"{{#if macos}}"}},
+		{tagText, []string{"{{#if macos}}"}},
+		{tagUnless, []string{"{{#if macos}}", "{{#unless ubuntu}}"}},
+		{tagText, []string{"{{#if macos}}", "{{#unless ubuntu}}"}},
+		{tagElse, []string{"{{#if macos}}", "{{else}} of {{#unless ubuntu}}"}},
+		{tagText, []string{"{{#if macos}}", "{{else}} of {{#unless ubuntu}}"}},
+		{tagEnd, []string{"{{#if macos}}"}},
+		{tagElif, []string{"{{#elif linux}}"}},
+		{tagText, []string{"{{#elif linux}}"}},
+		{tagIf, []string{"{{#elif linux}}", "{{#if arch or fedora}}"}},
+		{tagText, []string{"{{#elif linux}}", "{{#if arch or fedora}}"}},
+		{tagEnd, []string{"{{#elif linux}}"}},
+		{tagElse, []string{"{{else}} of {{#elif linux}}"}},
+		{tagText, []string{"{{else}} of {{#elif linux}}"}},
+		{tagEnd, nil},
+		{tagText, nil},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("parsed %d lines, want %d", len(lines), len(want))
+	}
+	for i, line := range lines {
+		if line.Kind != want[i].kind || !reflect.DeepEqual(line.Blocks, want[i].blocks) {
+			t.Errorf("line %d %q: kind %q in %q, want kind %q in %q", i+1, line.Text, line.Kind, line.Blocks, want[i].kind, want[i].blocks)
+		}
+	}
+}
+
+func TestRenderNestedTemplate(t *testing.T) {
+	tests := []struct {
+		system string
+		want   []string
+	}{
+		{"macos", []string{"common", "mac", "mac home", "end"}},
+		{"arch", []string{"common", "linux", "linux rolling", "end"}},
+		{"ubuntu", []string{"common", "linux", "end"}},
+		{"windows", []string{"common", "other", "end"}},
+	}
+	for _, test := range tests {
+		dm := &DotfilesManager{System: test.system, variables: map[string]string{}}
+		rendered, origins, err := dm.renderTemplate("t", nestedTemplate)
+		if err != nil {
+			t.Fatalf("%s: %v", test.system, err)
+		}
+		if got := strings.Split(rendered, "\n"); !reflect.DeepEqual(got, test.want) || len(origins) != len(got) {
+			t.Errorf("%s: rendered %q with %d origins, want %q", test.system, got, len(origins), test.want)
+		}
+	}
+}
+
+func TestParseTemplateErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		err      string
+	}{
+		{"never closed", "a\n{{#if macos}}\nb", "t:2: {{#if macos}} is never closed with {{/if}}"},
+		{"inner block never closed", "{{#if macos}}\n{{#unless arch}}\n{{/if}}", "t:3: {{/if}} closes {{#unless arch}} opened at line 2, expected {{/unless}}"},
+		{"wrong closing tag", "{{#if macos}}\nb\n{{/unless}}", "t:3: {{/unless}} closes {{#if macos}} opened at line 1, expected {{/if}}"},
+		{"end without block", "a\n{{/if}}", "t:2: {{/if}} without an open block"},
+		{"else without block", "{{else}}", "t:1: {{else}} without an open {{#if}}"},
+		{"elif without block", "a\n\n{{#elif linux}}", "t:3: {{#elif linux}} without an open {{#if}}"},
+		{"elif after else", "{{#if macos}}\n{{else}}\n{{#elif linux}}\n{{/if}}", "t:3: {{#elif linux}} after {{else}} of the block opened at line 1"},
+		{"second else", "{{#unless macos}}\n{{else}}\n{{else}}\n{{/unless}}", "t:3: {{else}} after {{else}} of the block opened at line 1"},
+		{"else with a condition", "{{#if macos}}\n{{else linux}}\n{{/if}}", "t:2: {{else}} takes no condition, use {{#elif linux}}"},
+		{"if without condition", "{{#if }}", "t:1: {{#if}} needs a condition"},
+		{"invalid condition", "{{#if macos and}}\n{{/if}}", "t:1: invalid condition in {{#if macos and}}: condition ends unexpectedly"},
+		{"unknown condition", "a\n{{#if hots:laptop}}\n{{/if}}", "t:2: invalid condition in {{#if hots:laptop}}: unknown condition 'hots:laptop'"},
+		{"text after closing tag", "{{#if macos}}\n{{/if macos}}", "t:2: unexpected text in {{/if macos}}"},
+		{"unknown tag", "{{#each items}}", "t:1: unknown tag {{#each items}}"},
+		{"unknown closing tag", "{{/each}}", "t:1: unknown tag {{/each}}"},
+		{"partial without name", "{{>}}", "t:1: {{>}} needs the name of a partial in _partials/, e.g. {{> aliases}}"},
+		{"include without quotes", "{{include keys.zsh}}", "t:1: {{include}} needs a quoted path"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseTemplate("t", test.template)
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("error = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// deployTransaction journals filesystem changes so a failed deploy can be undone
+type deployTransaction struct {
+	steps     []transactionStep
+	trashDir  string
+	state     DeploymentState
+	overwrite int // Length of templateOverwrites when the transaction began
+}
+
+// transactionStep is one applied change together with the action that reverses it
+type transactionStep struct {
+	description string
+	undo        func() error
+}
+
+func (dm *DotfilesManager) beginTransaction() {
+	state := DeploymentState{
+		Version: dm.State.Version,
+		Entries: append([]StateEntry(nil), dm.State.Entries...),
+		Backups: append([]BackupEntry(nil), dm.State.Backups...),
+	}
+
+	dm.tx = &deployTransaction{
+		trashDir:  filepath.Join(filepath.Dir(dm.StateFile), "transactions", time.Now().Format("20060102-150405.000000")),
+		state:     state,
+		overwrite: len(templateOverwrites),
+	}
+}
+
+// journal records an applied change while a transaction is active
+func (dm *DotfilesManager) journal(description string, undo func() error) {
+	if dm.tx == nil {
+		return
+	}
+	dm.tx.steps = append(dm.tx.steps, transactionStep{description: description, undo: undo})
+}
+
+// commitTransaction makes all journaled changes permanent
+func (dm *DotfilesManager) commitTransaction() {
+	if dm.tx == nil {
+		return
+	}
+	if err := os.RemoveAll(dm.tx.trashDir); err != nil {
+		fmt.Printf("Warning: Failed to remove transaction files in %s: %v\n", dm.tx.trashDir, err)
+	}
+	dm.tx = nil
+}
+
+// rollbackTransaction reverses every journaled change in reverse order and
+// returns the descriptions of the steps that were rolled back
+func (dm *DotfilesManager) rollbackTransaction() ([]string, error) {
+	if dm.tx == nil {
+		return nil, nil
+	}
+	tx := dm.tx
+	dm.tx = nil
+
+	var rolledBack []string
+	var failures []string
+	for i := len(tx.steps) - 1; i >= 0; i-- {
+		step := tx.steps[i]
+		if err := step.undo(); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", step.description, err))
+			continue
+		}
+		rolledBack = append(rolledBack, step.description)
+	}
+
+	restored := tx.state
+	dm.State = &restored
+	templateOverwrites = templateOverwrites[:tx.overwrite]
+
+	if len(failures) > 0 {
+		return rolledBack, fmt.Errorf("failed to roll back %d step(s) (transaction files kept in %s):\n  %s",
+			len(failures), tx.trashDir, strings.Join(failures, "\n  "))
+	}
+
+	os.RemoveAll(tx.trashDir)
+	return rolledBack, nil
+}
+
+// createSymlink creates a symlink and journals its removal
+func (dm *DotfilesManager) createSymlink(oldname, newname string) error {
+	if err := os.Symlink(oldname, newname); err != nil {
+		return err
+	}
+	dm.journal("created symlink "+newname, func() error {
+		return os.Remove(newname)
+	})
+	return nil
+}
+
+// writeFile writes a file and journals restoring its previous content
+func (dm *DotfilesManager) writeFile(path string, data []byte, perm os.FileMode) error {
+	previous, readErr := os.ReadFile(path)
+	var previousMode os.FileMode
+	if info, err := os.Stat(path); err == nil {
+		previousMode = info.Mode().Perm()
+	}
+
+	// Existing files get their new permissions before the content, so content
+	// meant to be private is never readable by others
+	if readErr == nil && previousMode != perm {
+		if err := os.Chmod(path, perm); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(path, data, perm); err != nil {
+		return err
+	}
+
+	if readErr == nil {
+		dm.journal("wrote "+path, func() error {
+			if err := os.WriteFile(path, previous, previousMode); err != nil {
+				return err
+			}
+			return os.Chmod(path, previousMode)
+		})
+	} else {
+		dm.journal("wrote "+path, func() error {
+			return os.Remove(path)
+		})
+	}
+	return nil
+}
+
+// removePath removes a file, symlink or directory tree. Inside a transaction the
+// path is moved into the transaction's trash directory so it can be put back.
+func (dm *DotfilesManager) removePath(path string) error {
+	if dm.tx == nil {
+		return os.RemoveAll(path)
+	}
+
+	trashPath := filepath.Join(dm.tx.trashDir, fmt.Sprintf("%d", len(dm.tx.steps)), filepath.Base(path))
+	if err := os.MkdirAll(filepath.Dir(trashPath), 0755); err != nil {
+		return fmt.Errorf("failed to create transaction directory: %w", err)
+	}
+	if err := os.Rename(path, trashPath); err != nil {
+		return err
+	}
+	dm.journal("removed "+path, func() error {
+		return os.Rename(trashPath, path)
+	})
+	return nil
+}
+
+// removeEmptyDir removes a directory only if it is empty
+func (dm *DotfilesManager) removeEmptyDir(path string) error {
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	dm.journal("removed directory "+path, func() error {
+		return os.Mkdir(path, 0755)
+	})
+	return nil
+}
+
+// renamePath moves a file or directory and journals moving it back
+func (dm *DotfilesManager) renamePath(from, to string) error {
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	dm.journal("moved "+from+" to "+to, func() error {
+		return os.Rename(to, from)
+	})
+	return nil
+}
+
+// makeDirs creates the given directories, which must be ordered deepest first,
+// and journals their removal. They are journaled in the order they are
+// created, so rolling back removes the deepest first.
+func (dm *DotfilesManager) makeDirs(dir string, created []string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i := len(created) - 1; i >= 0; i-- {
+		path := created[i]
+		dm.journal("created directory "+path, func() error {
+			return os.Remove(path)
+		})
+	}
+	return nil
+}
+
+// deployAllAtomic deploys packages as a single unit: the full plan is computed
+// before anything is touched, and the first failure rolls back all applied changes
+func (dm *DotfilesManager) deployAllAtomic(packages []string, interactive bool) error {
+	plan, planErrors := dm.planDeploy(packages, interactive)
+	if len(planErrors) > 0 {
+		for _, err := range planErrors {
+			fmt.Printf("✗ %v\n", err)
+		}
+		return fmt.Errorf("planning failed for %d package(s), nothing was changed", len(planErrors))
+	}
+
+	if len(plan.Packages) == 0 {
+		fmt.Printf("No packages configured for system '%s'\n", dm.System)
+		return nil
+	}
+
+	fmt.Printf("Planned atomic deployment for %s: %s\n", dm.System, strings.Join(plan.Packages, ", "))
+	printPlan(dm.out, plan)
+	fmt.Println()
+
+	return dm.runPlan(plan, false, true, 0)
+}
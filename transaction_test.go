@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRollbackRemovesNestedDirectories(t *testing.T) {
+	root := t.TempDir()
+	dm := &DotfilesManager{State: &DeploymentState{}, StateFile: filepath.Join(root, "state", "state.json")}
+	dm.beginTransaction()
+
+	dir := filepath.Join(root, "home", ".config", "nvim", "lua")
+	if err := dm.ensureDir("nvim", dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dm.rollbackTransaction(); err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "home")); !os.IsNotExist(err) {
+		t.Errorf("created directories were left behind: %v", err)
+	}
+	if len(dm.State.Entries) != 0 {
+		t.Errorf("state entries were left behind: %+v", dm.State.Entries)
+	}
+}
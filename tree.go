@@ -0,0 +1,476 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Link modes deciding how a package is placed at its target
+const (
+	linkModeDir   = "dir"   // Symlink the whole package directory (default)
+	linkModeFiles = "files" // Mirror the directory tree and symlink individual files, like GNU Stow
+	linkModeCopy  = "copy"  // Mirror the directory tree and copy individual files
+)
+
+func isValidLinkMode(mode string) bool {
+	switch mode {
+	case linkModeDir, linkModeFiles, linkModeCopy:
+		return true
+	}
+	return false
+}
+
+// linkMode returns the link mode configured for a package
+func (dm *DotfilesManager) linkMode(packageName string) (string, error) {
+	mode := linkModeDir
+	if packageConfig := dm.getPackageConfig(packageName); packageConfig != nil && packageConfig.LinkMode != "" {
+		mode = packageConfig.LinkMode
+	}
+	if !isValidLinkMode(mode) {
+		return "", fmt.Errorf("invalid link_mode '%s' for %s (use dir, files or copy)", mode, packageName)
+	}
+
+	// A linked package directory could only show output rendered into the
+	// repository, so packages with templates are placed file by file instead.
+	// Encrypted files are never decrypted into the repository either.
+	if mode == linkModeDir && ((dm.rendersToTarget() && dm.hasTemplates(packageName)) || dm.hasEncrypted(packageName)) {
+		if _, spread, err := dm.resolveTarget(packageName); err == nil && !spread {
+			return linkModeFiles, nil
+		}
+	}
+	return mode, nil
+}
+
+// treePlanner plans mirroring a package directory tree into its target
+type treePlanner struct {
+	dm          *DotfilesManager
+	plan        *DeploymentPlan
+	packageName string
+	packageDir  string
+	excludes    *pathMatcher
+	copies      *pathMatcher // Files that are copied instead of linked
+	encrypted   *pathMatcher // Files stored encrypted besides *.enc
+	copyAll     bool
+	mapped      map[string]bool // Files deployed to explicit destinations instead
+	interactive bool
+}
+
+// packageCopies returns a matcher for the files a package copies instead of linking
+func (dm *DotfilesManager) packageCopies(packageName string) (*pathMatcher, error) {
+	matcher := &pathMatcher{}
+	if packageConfig := dm.getPackageConfig(packageName); packageConfig != nil {
+		if err := matcher.add(packageConfig.Copy); err != nil {
+			return nil, fmt.Errorf("copy patterns for %s: %w", packageName, err)
+		}
+	}
+	return matcher, nil
+}
+
+// planTreeDeploy plans deploying a package file by file below root. Directories
+// that no other package uses are folded into a single symlink; a directory
+// folded by another package is unfolded so both can share it.
+func (dm *DotfilesManager) planTreeDeploy(plan *DeploymentPlan, packageName, packageDir, root string, mapped []mappedFile, interactive bool) error {
+	excludes, err := dm.packageExcludes(packageName)
+	if err != nil {
+		return err
+	}
+	copies, err := dm.packageCopies(packageName)
+	if err != nil {
+		return err
+	}
+	encrypted, err := dm.packageEncrypted(packageName)
+	if err != nil {
+		return err
+	}
+	mode, err := dm.linkMode(packageName)
+	if err != nil {
+		return err
+	}
+
+	// Plan into a scratch plan first so stale entries can be removed before anything new is created
+	tree := &treePlanner{
+		dm:          dm,
+		plan:        &DeploymentPlan{dirs: plan.dirs, links: plan.links, gone: plan.gone},
+		packageName: packageName,
+		packageDir:  packageDir,
+		excludes:    excludes,
+		copies:      copies,
+		encrypted:   encrypted,
+		copyAll:     mode == linkModeCopy,
+		mapped:      mappedSources(mapped),
+		interactive: interactive,
+	}
+	dm.planMissingDirs(tree.plan, packageName, filepath.Dir(root))
+	if err := tree.planSubdir(packageDir, root, false, false); err != nil {
+		tree.plan.discard(0)
+		return err
+	}
+
+	planned := make(map[string]bool)
+	for _, op := range tree.plan.Operations {
+		planned[op.Target] = true
+	}
+	for _, file := range mapped {
+		planned[file.Target] = true
+	}
+
+	var stale []StateEntry
+	for _, entry := range dm.State.entriesForPackage(packageName) {
+		// Anything an earlier package in this plan takes over is not stale either
+		if _, linked := plan.links[entry.Target]; planned[entry.Target] || linked || plan.dirs[entry.Target] {
+			continue
+		}
+		if entry.Type == stateEntryDir {
+			// Directories are kept while the package still has a matching directory
+			relPath, err := filepath.Rel(root, entry.Target)
+			if err != nil || strings.HasPrefix(relPath, "..") {
+				continue
+			}
+			source := filepath.Join(packageDir, relPath)
+			if info, err := os.Stat(source); err == nil && info.IsDir() && (relPath == "." || !excludes.matches(relPath, true)) {
+				continue
+			}
+		}
+		stale = append(stale, entry)
+	}
+	if err := dm.planRemoveEntries(plan, stale); err != nil {
+		return err
+	}
+
+	plan.Operations = append(plan.Operations, tree.plan.Operations...)
+	return nil
+}
+
+// planSubdir plans placing the package directory src at dst. fresh means dst's
+// parent will be newly created, so nothing exists at dst yet.
+func (t *treePlanner) planSubdir(src, dst string, fresh, canFold bool) error {
+	if t.plan.dirs[dst] {
+		// Created earlier in this plan, possibly by unfolding for another package
+		return t.planDir(src, dst, true)
+	}
+	if claim, ok := t.plan.links[dst]; ok {
+		return t.planClaimed(src, dst, claim, true)
+	}
+
+	if !fresh {
+		info, err := os.Lstat(dst)
+		switch {
+		case os.IsNotExist(err):
+			fresh = true
+		case err != nil:
+			return fmt.Errorf("failed to inspect %s: %w", dst, err)
+		case info.IsDir():
+			return t.planDir(src, dst, false)
+		case isLinkTo(dst, src):
+			// Previously folded by this package
+			t.plan.add(Operation{Type: opUnlink, Package: t.packageName, Target: dst})
+			fresh = true
+		default:
+			if owner, ownerDir := t.dm.foldedPackage(dst); owner != "" && owner != t.packageName {
+				return t.unfold(src, dst, owner, ownerDir)
+			}
+			proceed, err := t.dm.planTarget(t.plan, t.packageName, src, dst)
+			if err != nil || !proceed {
+				return err
+			}
+			fresh = true
+		}
+	}
+
+	if canFold && t.foldable(src) {
+		t.plan.add(Operation{Type: opLink, Package: t.packageName, Source: src, Target: dst})
+		return nil
+	}
+
+	t.plan.add(Operation{Type: opMkdir, Package: t.packageName, Target: dst})
+	return t.planDir(src, dst, fresh)
+}
+
+// planClaimed handles a target an earlier package in this plan already links
+func (t *treePlanner) planClaimed(src, dst string, claim Operation, isDir bool) error {
+	if claim.owner() == t.packageName && claim.Source == src {
+		return nil // Already planned on this package's behalf
+	}
+	if info, err := os.Stat(claim.Source); err == nil && info.IsDir() && isDir {
+		return t.unfold(src, dst, claim.owner(), claim.Source)
+	}
+	return fmt.Errorf("%s is provided by both %s and %s", dst, claim.owner(), t.packageName)
+}
+
+// planDir plans the contents of src inside the directory dst
+func (t *treePlanner) planDir(src, dst string, fresh bool) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", src, err)
+	}
+
+	names := make(map[string]bool)
+	for _, entry := range entries {
+		names[entry.Name()] = true
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		sourcePath := filepath.Join(src, name)
+		if relPath, _ := filepath.Rel(t.packageDir, sourcePath); t.excludes.matches(relPath, entry.IsDir()) {
+			continue
+		}
+
+		relPath, _ := filepath.Rel(t.packageDir, sourcePath)
+		if t.mapped[filepath.ToSlash(relPath)] {
+			continue
+		}
+		if !entry.IsDir() && isEncrypted(t.encrypted, relPath) {
+			targetPath := filepath.Join(dst, decryptedName(name))
+			if claim, ok := t.plan.links[targetPath]; ok {
+				if err := t.planClaimed(sourcePath, targetPath, claim, false); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := t.dm.planDecrypt(t.plan, t.packageName, sourcePath, targetPath); err != nil {
+				return err
+			}
+			continue
+		}
+		if !entry.IsDir() && strings.HasSuffix(name, ".template") && t.dm.rendersToTarget() {
+			targetPath := filepath.Join(dst, strings.TrimSuffix(name, ".template"))
+			if err := t.dm.planRenderAtTarget(t.plan, t.packageName, sourcePath, targetPath, t.interactive); err != nil {
+				return fmt.Errorf("failed to process template %s: %w", sourcePath, err)
+			}
+			continue
+		}
+		if !entry.IsDir() && strings.HasSuffix(name, ".template") {
+			// Templates render next to themselves and the output is linked
+			outputName := strings.TrimSuffix(name, ".template")
+			outputPath := filepath.Join(src, outputName)
+			if err := t.dm.planRender(t.plan, t.packageName, sourcePath, outputPath, t.interactive); err != nil {
+				return fmt.Errorf("failed to process template %s: %w", sourcePath, err)
+			}
+			name = outputName
+			sourcePath = outputPath
+			relPath = strings.TrimSuffix(relPath, ".template")
+		} else if names[name+".template"] {
+			continue // Generated output, linked through its template
+		}
+
+		targetPath := filepath.Join(dst, name)
+		if claim, ok := t.plan.links[targetPath]; ok {
+			if err := t.planClaimed(sourcePath, targetPath, claim, entry.IsDir()); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if entry.IsDir() {
+			if !t.hasContent(sourcePath) {
+				continue
+			}
+			if err := t.planSubdir(sourcePath, targetPath, fresh, true); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if t.copyAll || t.copies.matches(relPath, false) {
+			if err := t.dm.planCopy(t.plan, t.packageName, sourcePath, t.plan.contentHash(sourcePath), targetPath, fresh, t.interactive); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !fresh {
+			proceed, err := t.dm.planTarget(t.plan, t.packageName, sourcePath, targetPath)
+			if err != nil {
+				return err
+			}
+			if !proceed {
+				continue
+			}
+		}
+		t.plan.add(Operation{Type: opLink, Package: t.packageName, Source: sourcePath, Target: targetPath})
+	}
+
+	return nil
+}
+
+// unfold replaces a directory symlink owned by another package with a real
+// directory holding links to each of that package's files, then adds ours
+func (t *treePlanner) unfold(src, dst, owner, ownerDir string) error {
+	ownerExcludes, err := t.dm.packageExcludes(owner)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(ownerDir)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", ownerDir, err)
+	}
+
+	t.plan.add(Operation{Type: opUnlink, Package: t.packageName, Target: dst, Reason: "unfolding " + owner})
+	t.plan.add(Operation{Type: opMkdir, Package: t.packageName, Target: dst})
+
+	ownerPackageDir := filepath.Join(t.dm.DotfilesDir, owner)
+	for _, entry := range entries {
+		sourcePath := filepath.Join(ownerDir, entry.Name())
+		if relPath, _ := filepath.Rel(ownerPackageDir, sourcePath); ownerExcludes.matches(relPath, entry.IsDir()) {
+			continue
+		}
+		t.plan.add(Operation{
+			Type:    opLink,
+			Package: t.packageName,
+			Owner:   owner,
+			Source:  sourcePath,
+			Target:  filepath.Join(dst, entry.Name()),
+		})
+	}
+
+	return t.planDir(src, dst, true)
+}
+
+// foldable reports whether dir can be deployed as a single symlink: nothing in
+// it may be excluded, copied, encrypted or need rendering
+func (t *treePlanner) foldable(dir string) bool {
+	if t.copyAll {
+		return false
+	}
+	foldable := true
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			foldable = false
+			return filepath.SkipDir
+		}
+		relPath, _ := filepath.Rel(t.packageDir, path)
+		if t.excludes.matches(relPath, info.IsDir()) || t.copies.matches(relPath, info.IsDir()) || t.mapped[filepath.ToSlash(relPath)] || strings.HasSuffix(info.Name(), ".template") || (!info.IsDir() && isEncrypted(t.encrypted, relPath)) {
+			foldable = false
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return foldable
+}
+
+// hasContent reports whether dir contains any file that is placed in the tree
+func (t *treePlanner) hasContent(dir string) bool {
+	found := false
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || found {
+			return filepath.SkipDir
+		}
+		relPath, _ := filepath.Rel(t.packageDir, path)
+		if t.excludes.matches(relPath, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && !t.mapped[filepath.ToSlash(relPath)] {
+			found = true
+		}
+		return nil
+	})
+	return found
+}
+
+// foldedPackage returns the package and directory a folded directory symlink
+// points into, or "" if path is not such a link
+func (dm *DotfilesManager) foldedPackage(path string) (string, string) {
+	entry := dm.State.find(path)
+	if entry == nil || entry.Type != stateEntryLink || !isLinkTo(path, entry.Source) {
+		return "", ""
+	}
+	if info, err := os.Stat(entry.Source); err != nil || !info.IsDir() {
+		return "", ""
+	}
+	// A link to a whole package directory is a dir mode deployment, not a fold
+	if filepath.Dir(entry.Source) == dm.DotfilesDir {
+		return "", ""
+	}
+	return entry.Package, entry.Source
+}
+
+// planRefold plans turning a directory created by unfolding back into a single
+// symlink once the only remaining contents are the links of one other package.
+// removing holds the targets already planned for removal.
+func (dm *DotfilesManager) planRefold(plan *DeploymentPlan, entry StateEntry, removing map[string]bool) bool {
+	children, err := os.ReadDir(entry.Target)
+	if err != nil {
+		return false
+	}
+
+	var owner, ownerDir string
+	remaining := make(map[string]bool)
+	for _, child := range children {
+		path := filepath.Join(entry.Target, child.Name())
+		if removing[path] || plan.gone[path] {
+			continue
+		}
+		recorded := dm.State.find(path)
+		if recorded == nil || recorded.Type != stateEntryLink || recorded.Package == entry.Package || !isLinkTo(path, recorded.Source) {
+			return false
+		}
+		if owner == "" {
+			owner, ownerDir = recorded.Package, filepath.Dir(recorded.Source)
+		} else if recorded.Package != owner || filepath.Dir(recorded.Source) != ownerDir {
+			return false
+		}
+		remaining[child.Name()] = true
+	}
+	if owner == "" || plan.removing[owner] || filepath.Dir(ownerDir) == dm.DotfilesDir {
+		return false
+	}
+
+	// Only fold when the links cover the owner's directory exactly
+	ownerExcludes, err := dm.packageExcludes(owner)
+	if err != nil {
+		return false
+	}
+	sources, err := os.ReadDir(ownerDir)
+	if err != nil {
+		return false
+	}
+	count := 0
+	for _, source := range sources {
+		relPath, _ := filepath.Rel(filepath.Join(dm.DotfilesDir, owner), filepath.Join(ownerDir, source.Name()))
+		if ownerExcludes.matches(relPath, source.IsDir()) {
+			return false
+		}
+		if !remaining[source.Name()] {
+			return false
+		}
+		count++
+	}
+	if count != len(remaining) {
+		return false
+	}
+
+	for name := range remaining {
+		plan.add(Operation{Type: opUnlink, Package: entry.Package, Target: filepath.Join(entry.Target, name)})
+	}
+	plan.add(Operation{Type: opRmdir, Package: entry.Package, Target: entry.Target})
+	plan.add(Operation{Type: opLink, Package: entry.Package, Owner: owner, Source: ownerDir, Target: entry.Target})
+	return true
+}
+
+// planTreeUndeploy removes links of a files mode package that has no recorded state
+func (dm *DotfilesManager) planTreeUndeploy(plan *DeploymentPlan, packageName, packageDir, root string) error {
+	return filepath.Walk(packageDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, _ := filepath.Rel(packageDir, path)
+		if relPath == "." {
+			return nil
+		}
+
+		targetPath := filepath.Join(root, strings.TrimSuffix(relPath, ".template"))
+		if isLinkTo(targetPath, strings.TrimSuffix(path, ".template")) {
+			plan.add(Operation{Type: opUnlink, Package: packageName, Target: targetPath})
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// localConfigFile holds machine-specific settings. It is never committed.
+const localConfigFile = "dotctl.local.yaml"
+
+// VariablesConfig is the variables section of dotctl.yaml. Values apply
+// everywhere, system and host entries override them on matching machines.
+type VariablesConfig struct {
+	Values  map[string]string            `yaml:",inline" json:"-"`
+	Systems map[string]map[string]string `yaml:"systems,omitempty" json:"systems,omitempty"`
+	Hosts   map[string]map[string]string `yaml:"hosts,omitempty" json:"hosts,omitempty"`
+}
+
+// UnmarshalJSON reads variables in the same shape as YAML: values inline,
+// next to the systems and hosts overrides
+func (v *VariablesConfig) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	*v = VariablesConfig{}
+	for key, value := range fields {
+		var err error
+		switch key {
+		case "systems":
+			err = json.Unmarshal(value, &v.Systems)
+		case "hosts":
+			err = json.Unmarshal(value, &v.Hosts)
+		default:
+			var scalar interface{}
+			if err = json.Unmarshal(value, &scalar); err != nil {
+				break
+			}
+			if v.Values == nil {
+				v.Values = make(map[string]string)
+			}
+			switch scalar := scalar.(type) {
+			case string:
+				v.Values[key] = scalar
+			case float64, bool:
+				// Numbers and booleans are kept as written, like in YAML
+				v.Values[key] = string(value)
+			default:
+				err = fmt.Errorf("must be a string, number or boolean")
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("variables.%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// MarshalJSON writes variables in the shape UnmarshalJSON reads
+func (v VariablesConfig) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]interface{})
+	for key, value := range v.Values {
+		fields[key] = value
+	}
+	if len(v.Systems) > 0 {
+		fields["systems"] = v.Systems
+	}
+	if len(v.Hosts) > 0 {
+		fields["hosts"] = v.Hosts
+	}
+	return json.Marshal(fields)
+}
+
+// LocalConfig is the content of dotctl.local.yaml
+type LocalConfig struct {
+	Variables map[string]string `yaml:"variables,omitempty"`
+}
+
+// variableRef matches a variable reference such as {{ email }}, or one escaped
+// as \{{ email }} to keep it literal
+var variableRef = regexp.MustCompile(`\\?\{\{\s*([A-Za-z_][A-Za-z0-9_.-]*)\s*\}\}`)
+
+// escapedRef reports whether a reference matched by variableRef or secretRef
+// is escaped with a backslash, which renders it as written without the backslash
+func escapedRef(ref string) bool {
+	return strings.HasPrefix(ref, `\`)
+}
+
+// templateVariables returns the values available to templates, from lowest to
+// highest precedence: built-ins, variables from dotctl.yaml, their system and
+// host overrides, and dotctl.local.yaml
+func (dm *DotfilesManager) templateVariables() (map[string]string, error) {
+	if dm.variables != nil {
+		return dm.variables, nil
+	}
+
+	variables, err := dm.builtinVariables()
+	if err != nil {
+		return nil, err
+	}
+
+	if config := dm.Config.Variables; config != nil {
+		mergeVariables(variables, config.Values)
+
+		// A family such as linux applies before the exact system
+		for _, system := range sortedKeys(config.Systems) {
+			if system != dm.System && dm.matchesCondition(system) {
+				mergeVariables(variables, config.Systems[system])
+			}
+		}
+		mergeVariables(variables, config.Systems[dm.System])
+
+		// Patterns apply before the exact hostname
+		hostname := variables["hostname"]
+		for _, pattern := range sortedKeys(config.Hosts) {
+			if pattern != hostname && hostMatches(pattern, hostname) {
+				mergeVariables(variables, config.Hosts[pattern])
+			}
+		}
+		mergeVariables(variables, config.Hosts[hostname])
+	}
+
+	local, err := dm.loadLocalConfig()
+	if err != nil {
+		return nil, err
+	}
+	mergeVariables(variables, local.Variables)
+
+	dm.variables = variables
+	return variables, nil
+}
+
+// builtinVariables describes the machine dotctl is running on
+func (dm *DotfilesManager) builtinVariables() (map[string]string, error) {
+	home, err := dm.homeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	variables := map[string]string{
+		"home":           home,
+		"system":         dm.System,
+		"arch":           runtime.GOARCH,
+		"distro_version": distroVersion(),
+	}
+	if name := hostname(); name != "" {
+		variables["hostname"] = name
+	}
+	if name := currentUser(); name != "" {
+		variables["user"] = name
+	}
+	return variables, nil
+}
+
+// hostname returns the name of this machine, or "" if it is unknown
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// currentUser returns the name of the user running dotctl, or "" if it is unknown
+func currentUser() string {
+	if usr, err := user.Current(); err == nil {
+		return usr.Username
+	}
+	return os.Getenv("USER")
+}
+
+// distroVersion returns the version of the operating system release, or "" if unknown
+func distroVersion() string {
+	if runtime.GOOS == "darwin" {
+		output, err := exec.Command("sw_vers", "-productVersion").Output()
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(output))
+	}
+
+	data, err := os.ReadFile("/etc/os-release")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "VERSION_ID="); ok {
+			return strings.Trim(value, `"'`)
+		}
+	}
+	return ""
+}
+
+// loadLocalConfig reads dotctl.local.yaml, which is optional
+func (dm *DotfilesManager) loadLocalConfig() (*LocalConfig, error) {
+	local := &LocalConfig{}
+	localPath := filepath.Join(dm.DotfilesDir, localConfigFile)
+
+	data, err := os.ReadFile(localPath)
+	if os.IsNotExist(err) {
+		return local, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", localPath, err)
+	}
+	if err := yaml.Unmarshal(data, local); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", localPath, err)
+	}
+	return local, nil
+}
+
+// substituteVariables replaces every variable reference in a line with its
+// value. Values must fit on the line, so every output line keeps one origin.
+func (dm *DotfilesManager) substituteVariables(line string) (string, error) {
+	if !strings.Contains(line, "{{") {
+		return line, nil
+	}
+	variables, err := dm.templateVariables()
+	if err != nil {
+		return "", err
+	}
+
+	var substituteErr error
+	result := variableRef.ReplaceAllStringFunc(line, func(ref string) string {
+		if escapedRef(ref) {
+			return ref[1:]
+		}
+		name := variableRef.FindStringSubmatch(ref)[1]
+		value, ok := variables[name]
+		switch {
+		case substituteErr != nil:
+		case !ok:
+			substituteErr = fmt.Errorf("undefined variable '%s', define it under variables: in dotctl.yaml or in %s", name, localConfigFile)
+		case strings.Contains(value, "\n"):
+			substituteErr = fmt.Errorf("variable '%s' spans several lines, which templates do not support", name)
+		}
+		return value
+	})
+	if substituteErr != nil {
+		return "", substituteErr
+	}
+	return result, nil
+}
+
+// restoreVariables carries an edited output line back to its template line,
+// putting a variable reference back where the edit left its value intact. A
+// value only counts as intact when it is surrounded by the same characters as
+// the reference in the template, or by whitespace where the reference starts
+// or ends the line, so an edited value stays literal.
+func restoreVariables(templateLine, editedLine string, variables map[string]string) string {
+	return restoreRefs(variableRef, templateLine, editedLine, variables)
+}
+
+// restoreSecrets puts secret references back like restoreVariables
+func restoreSecrets(templateLine, editedLine string, secrets map[string]string) string {
+	return restoreRefs(secretRef, templateLine, editedLine, secrets)
+}
+
+// restoreRefs puts back the references ref finds in the template line, whose
+// first group names the value in values. An escaped reference is put back
+// where its literal text is intact, so it stays escaped.
+func restoreRefs(ref *regexp.Regexp, templateLine, editedLine string, values map[string]string) string {
+	refs := ref.FindAllStringSubmatchIndex(templateLine, -1)
+	limit := len(editedLine)
+
+	// Right to left, so restored references are never searched again
+	for i := len(refs) - 1; i >= 0; i-- {
+		start, end := refs[i][0], refs[i][1]
+		value := values[templateLine[refs[i][2]:refs[i][3]]]
+		if escapedRef(templateLine[start:end]) {
+			value = templateLine[start+1 : end]
+		}
+		if value == "" {
+			continue
+		}
+
+		for at := strings.LastIndex(editedLine[:limit], value); at >= 0; at = strings.LastIndex(editedLine[:at], value) {
+			after := at + len(value)
+			var beforeOK, afterOK bool
+			switch {
+			case at == 0:
+				beforeOK = start == 0
+			case start == 0:
+				beforeOK = editedLine[at-1] == ' ' || editedLine[at-1] == '\t'
+			default:
+				beforeOK = editedLine[at-1] == templateLine[start-1]
+			}
+			switch {
+			case after == len(editedLine):
+				afterOK = end == len(templateLine)
+			case end == len(templateLine):
+				afterOK = editedLine[after] == ' ' || editedLine[after] == '\t'
+			default:
+				afterOK = editedLine[after] == templateLine[end]
+			}
+			if beforeOK && afterOK {
+				editedLine = editedLine[:at] + templateLine[start:end] + editedLine[after:]
+				limit = at
+				break
+			}
+		}
+	}
+	return editedLine
+}
+
+// hostMatches reports whether a hostname matches a glob pattern. Patterns
+// without a domain also match the short form of a fully qualified hostname.
+func hostMatches(pattern, hostname string) bool {
+	if matched, _ := path.Match(pattern, hostname); matched {
+		return true
+	}
+	short, _, _ := strings.Cut(hostname, ".")
+	matched, _ := path.Match(pattern, short)
+	return matched && !strings.Contains(pattern, ".")
+}
+
+// mergeVariables copies values over variables
+func mergeVariables(variables, values map[string]string) {
+	for name, value := range values {
+		variables[name] = value
+	}
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ensureLocalConfigIgnored keeps dotctl.local.yaml out of the repository
+func (dm *DotfilesManager) ensureLocalConfigIgnored() error {
+	if _, err := os.Stat(filepath.Join(dm.DotfilesDir, localConfigFile)); os.IsNotExist(err) {
+		return nil
+	}
+
+	ignorePath := filepath.Join(dm.DotfilesDir, ".gitignore")
+	data, err := os.ReadFile(ignorePath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %w", ignorePath, err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == localConfigFile || strings.TrimSpace(line) == "/"+localConfigFile {
+			return nil
+		}
+	}
+
+	if len(data) > 0 && !strings.HasSuffix(string(data), "\n") {
+		data = append(data, '\n')
+	}
+	data = append(data, []byte("/"+localConfigFile+"\n")...)
+	if err := os.WriteFile(ignorePath, data, 0644); err != nil {
+		return fmt.Errorf("failed to update %s: %w", ignorePath, err)
+	}
+	fmt.Printf("✓ Added %s to .gitignore\n", localConfigFile)
+	return nil
+}
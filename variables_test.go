@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestVariablesConfigJSONMatchesYAML(t *testing.T) {
+	yamlConfig := `
+email: me@example.com
+port: 8080
+systems:
+  macos:
+    browser: safari
+hosts:
+  work-laptop:
+    email: me@work.example.com
+`
+	jsonConfig := `{
+  "email": "me@example.com",
+  "port": 8080,
+  "systems": {"macos": {"browser": "safari"}},
+  "hosts": {"work-laptop": {"email": "me@work.example.com"}}
+}`
+
+	var fromYAML, fromJSON VariablesConfig
+	if err := yaml.Unmarshal([]byte(yamlConfig), &fromYAML); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(jsonConfig), &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromYAML, fromJSON) {
+		t.Fatalf("JSON config %+v differs from YAML config %+v", fromJSON, fromYAML)
+	}
+
+	// Written back, the JSON reads the same
+	data, err := json.Marshal(fromJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var roundTrip VariablesConfig
+	if err := json.Unmarshal(data, &roundTrip); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(roundTrip, fromJSON) {
+		t.Errorf("round trip through %s gave %+v, want %+v", data, roundTrip, fromJSON)
+	}
+
+	if err := json.Unmarshal([]byte(`{"email": ["a", "b"]}`), &fromJSON); err == nil {
+		t.Error("a list value was accepted")
+	}
+}
+
+func TestSubstituteVariables(t *testing.T) {
+	dm := &DotfilesManager{variables: map[string]string{
+		"email":    "me@example.com",
+		"greeting": "hello\nworld",
+	}}
+
+	tests := []struct {
+		line string
+		want string
+		err  string
+	}{
+		{"email = {{ email }}", "email = me@example.com", ""},
+		{"email = {{email}} # {{ email }}", "email = me@example.com # me@example.com", ""},
+		{`echo "\{{ name }} stays literal"`, `echo "{{ name }} stays literal"`, ""},
+		{`\{{ email }} = {{ email }}`, "{{ email }} = me@example.com", ""},
+		{`token = \{{secret "github_token"}}`, `token = \{{secret "github_token"}}`, ""},
+		{"{{ name }}", "", "undefined variable 'name'"},
+		{"echo {{ greeting }}", "", "variable 'greeting' spans several lines"},
+	}
+	for _, test := range tests {
+		got, err := dm.substituteVariables(test.line)
+		switch {
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("substituteVariables(%q) error = %v, want %q", test.line, err, test.err)
+		case test.err == "" && err != nil:
+			t.Errorf("substituteVariables(%q) failed: %v", test.line, err)
+		case got != test.want:
+			t.Errorf("substituteVariables(%q) = %q, want %q", test.line, got, test.want)
+		}
+	}
+
+	// An escaped secret reference is left alone by variables and unescaped
+	// without looking the secret up
+	got, err := dm.substituteSecrets(`token = \{{secret "github_token"}}`)
+	if err != nil || got != `token = {{secret "github_token"}}` {
+		t.Errorf("substituteSecrets = %q, %v", got, err)
+	}
+
+	// A multi-line value is a render error rather than output lines without an origin
+	if _, _, err := dm.renderTemplate("greeting.template", "first\n{{ greeting }}\nlast"); err == nil || !strings.Contains(err.Error(), "greeting.template:2:") {
+		t.Errorf("renderTemplate error = %v, want one at greeting.template:2", err)
+	}
+}
+
+func TestRestoreVariables(t *testing.T) {
+	variables := map[string]string{"email": "me@example.com", "editor": "vim"}
+	tests := []struct {
+		template, edited, want string
+	}{
+		{"email = {{ email }}", "email = me@example.com # work", "email = {{ email }} # work"},
+		{"email = {{ email }}", "email = you@example.com", "email = you@example.com"},
+		{"editor={{editor}} email={{ email }}", "editor=vim email=me@example.com extra", "editor={{editor}} email={{ email }} extra"},
+		{`echo "\{{ email }}"`, `echo "{{ email }}" >&2`, `echo "\{{ email }}" >&2`},
+		{`echo "\{{ email }}"`, `echo "me@example.com"`, `echo "me@example.com"`},
+	}
+	for _, test := range tests {
+		if got := restoreVariables(test.template, test.edited, variables); got != test.want {
+			t.Errorf("restoreVariables(%q, %q) = %q, want %q", test.template, test.edited, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// homeDir returns the home directory packages are deployed into: the
+// --target-home directory when given, otherwise $HOME
+func (dm *DotfilesManager) homeDir() (string, error) {
+	if dm.TargetHome != "" {
+		return dm.TargetHome, nil
+	}
+	if home := os.Getenv("HOME"); home != "" && filepath.IsAbs(home) {
+		return filepath.Clean(home), nil
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("failed to get current user: %w", err)
+	}
+	return usr.HomeDir, nil
+}
+
+// xdgDir returns the XDG base directory named by envVar, falling back to
+// fallback inside the home directory. As the spec requires, relative values are
+// ignored. With --target-home a value outside the target home is ignored too, so
+// the invoking user's own directories are never touched.
+func (dm *DotfilesManager) xdgDir(envVar, fallback string) (string, error) {
+	home, err := dm.homeDir()
+	if err != nil {
+		return "", err
+	}
+
+	if dir := os.Getenv(envVar); dir != "" && filepath.IsAbs(dir) {
+		dir = filepath.Clean(dir)
+		if dm.TargetHome == "" || isWithin(dir, home) {
+			return dir, nil
+		}
+	}
+	return filepath.Join(home, fallback), nil
+}
+
+// configHome returns $XDG_CONFIG_HOME, ~/.config by default
+func (dm *DotfilesManager) configHome() (string, error) {
+	return dm.xdgDir("XDG_CONFIG_HOME", ".config")
+}
+
+// dataHome returns $XDG_DATA_HOME, ~/.local/share by default
+func (dm *DotfilesManager) dataHome() (string, error) {
+	return dm.xdgDir("XDG_DATA_HOME", filepath.Join(".local", "share"))
+}
+
+// stateHome returns $XDG_STATE_HOME, ~/.local/state by default
+func (dm *DotfilesManager) stateHome() (string, error) {
+	return dm.xdgDir("XDG_STATE_HOME", filepath.Join(".local", "state"))
+}
+
+// isWithin reports whether path is dir or lies inside it
+func isWithin(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// expandPath expands ~, $HOME, the XDG base directories and other environment
+// variables in a configured path. HOME and XDG_* resolve as dotctl itself does,
+// so they follow --target-home. Relative paths are taken relative to the home
+// directory.
+func (dm *DotfilesManager) expandPath(path string) (string, error) {
+	home, err := dm.homeDir()
+	if err != nil {
+		return "", err
+	}
+
+	dirs := map[string]func() (string, error){
+		"XDG_CONFIG_HOME": dm.configHome,
+		"XDG_DATA_HOME":   dm.dataHome,
+		"XDG_STATE_HOME":  dm.stateHome,
+	}
+	var expandErr error
+	mapping := func(name string) string {
+		if name == "HOME" {
+			return home
+		}
+		if resolve, ok := dirs[name]; ok {
+			dir, err := resolve()
+			if err != nil {
+				expandErr = err
+			}
+			return dir
+		}
+		return os.Getenv(name)
+	}
+
+	if path == "~" {
+		path = home
+	} else if strings.HasPrefix(path, "~/") {
+		path = filepath.Join(home, path[2:])
+	}
+	path = os.Expand(path, mapping)
+	if expandErr != nil {
+		return "", expandErr
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(home, path)
+	}
+	return filepath.Clean(path), nil
+}